@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pkg/sftp"
+)
+
+// AccessMode is what the user is allowed to do in the container.
+type AccessMode string
+
+const (
+	AccessReadWrite AccessMode = "read-write"
+	AccessReadOnly  AccessMode = "read-only"
+
+	// The user can upload the files, but can't list, download or delete them (drop box).
+	AccessWriteOnly AccessMode = "write-only"
+)
+
+func ParseAccessMode(s string) (AccessMode, error) {
+	switch mode := AccessMode(s); mode {
+	case AccessReadWrite, AccessReadOnly, AccessWriteOnly:
+		return mode, nil
+	case "":
+		return AccessReadWrite, nil
+	default:
+		return "", fmt.Errorf("Invalid access mode '%s' (read-write, read-only or write-only)", s)
+	}
+}
+
+// CanRead returns true if the user can download the files and list the directories.
+func (m AccessMode) CanRead() bool {
+	return m != AccessWriteOnly
+}
+
+// CanWrite returns true if the user can upload the files and create the directories.
+func (m AccessMode) CanWrite() bool {
+	return m != AccessReadOnly
+}
+
+// CanModify returns true if the user can rename and delete the existing files.
+func (m AccessMode) CanModify() bool {
+	return m == AccessReadWrite || m == ""
+}
+
+// permit returns PERMISSION_DENIED and logs it if the operation is not allowed.
+func (fs *SwiftFS) permit(method, path string, allowed bool) error {
+	if allowed {
+		return nil
+	}
+	fs.log.Warnf("%s %s Permission denied (access mode is %s)", method, path, fs.mode)
+	return sftp.ErrSshFxPermissionDenied
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/sftp"
+)
+
+// ACLOperation is the operation that the rules allow.
+type ACLOperation string
+
+const (
+	ACLList   ACLOperation = "list"
+	ACLRead   ACLOperation = "read"
+	ACLWrite  ACLOperation = "write"
+	ACLRename ACLOperation = "rename"
+	ACLDelete ACLOperation = "delete"
+	ACLMkdir  ACLOperation = "mkdir"
+)
+
+var aclOperations = []ACLOperation{ACLList, ACLRead, ACLWrite, ACLRename, ACLDelete, ACLMkdir}
+
+// ACL is the path-based access control list that is loaded from the rules file.
+// The file is reloaded when it's modified, so the rules can be changed without restarting the server.
+//
+// The rules are checked in order and the first rule that matches the user and the path is used.
+// The users who aren't in any rule are not restricted by the ACL.
+// For the other users, the paths that don't match any rule are denied.
+type ACL struct {
+	path string
+
+	m       sync.Mutex
+	modtime time.Time
+	groups  map[string][]string // group -> users
+	rules   []aclRule
+
+	// groups of the users that are given outside of the rules file (e.g. LDAP)
+	userGroups map[string][]string // user -> groups
+}
+
+// Format of the rules file
+type aclFile struct {
+	Groups map[string][]string `toml:"groups"`
+	Rules  []struct {
+		Path   string   `toml:"path"`
+		Users  []string `toml:"users"`
+		Groups []string `toml:"groups"`
+		Allow  []string `toml:"allow"`
+	} `toml:"rules"`
+}
+
+type aclRule struct {
+	pattern *regexp.Regexp
+	prefix  string // the leading part of the path without wildcards
+	users   []string
+	groups  []string
+	allow   map[ACLOperation]bool
+}
+
+func NewACL(path string) *ACL {
+	return &ACL{
+		path: path,
+	}
+}
+
+// Load reads the rules file.
+func (a *ACL) Load() error {
+	s, err := os.Stat(a.path)
+	if err != nil {
+		return err
+	}
+
+	var f aclFile
+	if _, err = toml.DecodeFile(a.path, &f); err != nil {
+		return fmt.Errorf("Couldn't parse ACL file '%s' [%v]", a.path, err)
+	}
+
+	rules := make([]aclRule, 0, len(f.Rules))
+	for i, r := range f.Rules {
+		rule, err := newACLRule(r.Path, r.Users, r.Groups, r.Allow)
+		if err != nil {
+			return fmt.Errorf("Invalid rule #%d in ACL file '%s' [%v]", i+1, a.path, err)
+		}
+		rules = append(rules, rule)
+	}
+
+	a.m.Lock()
+	defer a.m.Unlock()
+	a.modtime = s.ModTime()
+	a.groups = f.Groups
+	a.rules = rules
+	return nil
+}
+
+// SetUserGroups adds the user to the groups in addition to the groups in the rules file.
+func (a *ACL) SetUserGroups(username string, groups []string) {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	if a.userGroups == nil {
+		a.userGroups = map[string][]string{}
+	}
+	a.userGroups[username] = groups
+}
+
+// reload loads the rules file again if it's modified.
+// The current rules are kept if the file is broken.
+func (a *ACL) reload() {
+	s, err := os.Stat(a.path)
+	if err != nil {
+		log.Warnf("Couldn't check ACL file '%s' [%v]", a.path, err)
+		return
+	}
+
+	a.m.Lock()
+	modified := !s.ModTime().Equal(a.modtime)
+	a.m.Unlock()
+
+	if modified {
+		if err = a.Load(); err != nil {
+			log.Warnf("%s", err.Error())
+			return
+		}
+		log.Infof("ACL file '%s' was reloaded", a.path)
+	}
+}
+
+// Allowed returns true if the user can do the operation on the path.
+func (a *ACL) Allowed(username string, op ACLOperation, p string) bool {
+	a.reload()
+
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	p = path.Clean(Delimiter + p)
+	covered := false
+	for _, r := range a.rules {
+		if !r.appliesTo(username, a.groups, a.userGroups[username]) {
+			continue
+		}
+		covered = true
+
+		if r.pattern.MatchString(p) {
+			return r.allow[op]
+		}
+	}
+	return !covered
+}
+
+// Visible returns true if the user can see the attributes of the path with Stat.
+// It's true if any operation is allowed on the path or under it, so that the client can
+// go through the parent directories to the allowed paths.
+func (a *ACL) Visible(username string, p string) bool {
+	a.reload()
+
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	p = path.Clean(Delimiter + p)
+	dir := strings.TrimSuffix(p, Delimiter) + Delimiter
+	covered := false
+	for _, r := range a.rules {
+		if !r.appliesTo(username, a.groups, a.userGroups[username]) {
+			continue
+		}
+		covered = true
+
+		if r.pattern.MatchString(p) {
+			return len(r.allow) > 0
+		} else if len(r.allow) > 0 && strings.HasPrefix(r.prefix, dir) {
+			return true
+		}
+	}
+	return !covered
+}
+
+func newACLRule(pattern string, users, groups, allow []string) (r aclRule, err error) {
+	if !strings.HasPrefix(pattern, Delimiter) {
+		return r, fmt.Errorf("Path must start with '/' [%s]", pattern)
+	} else if len(users) == 0 && len(groups) == 0 {
+		return r, fmt.Errorf("Users or groups required [%s]", pattern)
+	}
+
+	r.allow = map[ACLOperation]bool{}
+	for _, s := range allow {
+		valid := false
+		for _, op := range aclOperations {
+			if ACLOperation(s) == op {
+				r.allow[op] = true
+				valid = true
+			}
+		}
+		if !valid {
+			return r, fmt.Errorf("Unknown operation '%s' [%s]", s, pattern)
+		}
+	}
+
+	r.pattern, r.prefix = compileGlob(pattern)
+	r.users = users
+	r.groups = groups
+	return r, nil
+}
+
+// compileGlob converts the glob pattern to the regular expression.
+// "*" and "?" match within a directory, and "**" matches any number of directories.
+// The trailing "/**" also matches the directory itself.
+func compileGlob(pattern string) (*regexp.Regexp, string) {
+	pattern = path.Clean(pattern)
+
+	prefix := pattern
+	if pos := strings.IndexAny(pattern, "*?"); pos >= 0 {
+		prefix = pattern[:pos]
+	}
+
+	suffix := ""
+	if strings.HasSuffix(pattern, "/**") {
+		pattern = strings.TrimSuffix(pattern, "/**")
+		suffix = "(/.*)?"
+	}
+
+	expr := ""
+	for i := 0; i < len(pattern); i++ {
+		switch {
+		case strings.HasPrefix(pattern[i:], "**"):
+			expr += ".*"
+			i++
+		case pattern[i] == '*':
+			expr += "[^/]*"
+		case pattern[i] == '?':
+			expr += "[^/]"
+		default:
+			expr += regexp.QuoteMeta(pattern[i : i+1])
+		}
+	}
+	return regexp.MustCompile("^" + expr + suffix + "$"), prefix
+}
+
+func (r *aclRule) appliesTo(username string, groups map[string][]string, memberOf []string) bool {
+	for _, u := range r.users {
+		if u == "*" || u == username {
+			return true
+		}
+	}
+	for _, g := range r.groups {
+		for _, u := range groups[g] {
+			if u == username {
+				return true
+			}
+		}
+		for _, m := range memberOf {
+			if m == g {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// SetACL makes the client follow the rules of the ACL as the user.
+func (fs *SwiftFS) SetACL(acl *ACL, username string) {
+	fs.acl = acl
+	fs.username = username
+}
+
+// authorize returns PERMISSION_DENIED and logs it if the ACL doesn't allow the operation.
+func (fs *SwiftFS) authorize(method, path string, op ACLOperation) error {
+	if fs.acl == nil || fs.acl.Allowed(fs.username, op, path) {
+		return nil
+	}
+	fs.log.Warnf("%s %s Permission denied by ACL (%s)", method, path, op)
+	return sftp.ErrSshFxPermissionDenied
+}
+
+// authorizeCmd checks the ACL for the commands of Filecmd.
+func (fs *SwiftFS) authorizeCmd(r *sftp.Request) error {
+	switch r.Method {
+	case "Rename":
+		if err := fs.authorize(r.Method, r.Filepath, ACLRename); err != nil {
+			return err
+		}
+		return fs.authorize(r.Method, r.Target, ACLRename)
+	case "Remove", "Rmdir":
+		return fs.authorize(r.Method, r.Filepath, ACLDelete)
+	case "Mkdir":
+		return fs.authorize(r.Method, r.Filepath, ACLMkdir)
+	case "Symlink":
+		// r.Target is the path of the new symlink
+		return fs.authorize(r.Method, r.Target, ACLWrite)
+	case "Setstat":
+		return fs.authorize(r.Method, r.Filepath, ACLWrite)
+	}
+	return nil
+}
+
+// authorizeResolved checks the ACL on the path that the symlinks were resolved to,
+// because the rules for the path of the request don't cover the file that it points to.
+func (fs *SwiftFS) authorizeResolved(method, p string, f *SwiftFile, op ACLOperation) error {
+	if resolved := fs.object2filepath(f.objectname); resolved != path.Clean(Delimiter+p) {
+		return fs.authorize(method, resolved, op)
+	}
+	return nil
+}
+
+// authorizeStat is authorize() for Stat and Lstat.
+func (fs *SwiftFS) authorizeStat(method, path string) error {
+	if fs.acl == nil || fs.acl.Visible(fs.username, path) {
+		return nil
+	}
+	fs.log.Warnf("%s %s Permission denied by ACL", method, path)
+	return sftp.ErrSshFxPermissionDenied
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestACL(t *testing.T) {
+	acl := NewACL("misc/acl.conf")
+	if err := acl.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		username string
+		op       ACLOperation
+		path     string
+		allowed  bool
+	}{
+		{"alice", ACLWrite, "/incoming/report.csv", true},
+		{"alice", ACLWrite, "/incoming/2018/report.csv", false},
+		{"alice", ACLRead, "/incoming/report.csv", false},
+		{"alice", ACLList, "/incoming", false},
+		{"bob", ACLRead, "/reports/2018/01/summary.pdf", true},
+		{"bob", ACLList, "/reports", true},
+		{"bob", ACLDelete, "/reports/2018/01/summary.pdf", false},
+		{"bob", ACLRead, "/reports/../secret.txt", false},
+		{"alice", ACLList, "/", false},
+
+		// not in the rules
+		{"carol", ACLDelete, "/reports/2018/01/summary.pdf", true},
+	}
+
+	for _, test := range tests {
+		if allowed := acl.Allowed(test.username, test.op, test.path); allowed != test.allowed {
+			t.Errorf("%s %s %s should be allowed=%v", test.username, test.op, test.path, test.allowed)
+		}
+	}
+
+	// The parent directories of the allowed paths are visible
+	visible := map[string]bool{
+		"/":                 true,
+		"/incoming":         true,
+		"/reports/2018":     true,
+		"/secret":           false,
+		"/incoming/a/b.txt": false,
+	}
+	for p, expected := range visible {
+		if v := acl.Visible("alice", p); v != expected {
+			t.Errorf("%s should be visible=%v", p, expected)
+		}
+	}
+}
+
+func TestACLReload(t *testing.T) {
+	f, err := ioutil.TempFile("", "swift-sftp-acl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	write := func(content string, modtime time.Time) {
+		if err := ioutil.WriteFile(f.Name(), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(f.Name(), modtime, modtime)
+	}
+
+	now := time.Now()
+	write(`
+[[rules]]
+path  = "/**"
+users = ["alice"]
+allow = ["read"]
+`, now.Add(-2*time.Second))
+
+	acl := NewACL(f.Name())
+	if err = acl.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if !acl.Allowed("alice", ACLRead, "/a.txt") || acl.Allowed("alice", ACLWrite, "/a.txt") {
+		t.Fatal("Wrong rules are loaded")
+	}
+
+	// modified
+	write(`
+[[rules]]
+path  = "/**"
+users = ["alice"]
+allow = ["write"]
+`, now.Add(-time.Second))
+
+	if acl.Allowed("alice", ACLRead, "/a.txt") || !acl.Allowed("alice", ACLWrite, "/a.txt") {
+		t.Error("Rules should be reloaded")
+	}
+
+	// The broken file is ignored
+	write(`
+[[rules]]
+path  = "/**"
+users = ["alice"]
+allow = ["destroy"]
+`, now)
+
+	if !acl.Allowed("alice", ACLWrite, "/a.txt") {
+		t.Error("Rules should be kept if the file is broken")
+	}
+}
+
+func TestACLUserGroups(t *testing.T) {
+	acl := NewACL("misc/acl.conf")
+	if err := acl.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	// carol is not in the rules file, and the groups given by LDAP apply the rules of the group.
+	if !acl.Allowed("carol", ACLDelete, "/secret.txt") {
+		t.Fatal("carol should not be restricted")
+	}
+	acl.SetUserGroups("carol", []string{"sftp-users", "finance"})
+	if !acl.Allowed("carol", ACLRead, "/reports/summary.pdf") || acl.Allowed("carol", ACLDelete, "/secret.txt") {
+		t.Error("The rules of 'finance' should be applied to carol")
+	}
+	if !acl.Allowed("dave", ACLDelete, "/secret.txt") {
+		t.Error("dave should not be restricted")
+	}
+}
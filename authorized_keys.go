@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// authorizedKey is the public key in authorized_keys with its options.
+type authorizedKey struct {
+	key     ssh.PublicKey
+	options []string
+}
+
+// The options of authorized_keys that swift-sftp accepts. The keys with the other options are rejected.
+// The options of pty, forwarding and user rc (e.g. "restrict") do nothing, because swift-sftp doesn't provide them.
+// The options of FIDO keys ("verify-required" and "no-touch-required") are rejected, because the public key
+// callback can't see the flags of the signature.
+var knownKeyOptions = map[string]bool{
+	"restrict":            true,
+	"no-pty":              true,
+	"no-port-forwarding":  true,
+	"no-agent-forwarding": true,
+	"no-x11-forwarding":   true,
+	"no-user-rc":          true,
+	"pty":                 true,
+	"port-forwarding":     true,
+	"agent-forwarding":    true,
+	"x11-forwarding":      true,
+	"user-rc":             true,
+	"permitopen":          true,
+	"permitlisten":        true,
+	"tunnel":              true,
+	"environment":         true,
+	"from":                true,
+	"expiry-time":         true,
+	"command":             true,
+}
+
+// loadAuthorizedKeys reads the public keys in the format of authorized_keys.
+func loadAuthorizedKeys(path string) ([]authorizedKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []authorizedKey
+	for len(bytes.TrimSpace(data)) > 0 {
+		key, _, options, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, authorizedKey{key: key, options: options})
+		data = rest
+	}
+	return keys, nil
+}
+
+// userAuthorizedKeysPath returns the authorized_keys file of the user in the directory.
+func userAuthorizedKeysPath(dir, username string) (string, error) {
+	if username == "" || username == "." || username == ".." || strings.ContainsAny(username, "/\\") {
+		return "", fmt.Errorf("Username '%s' is not allowed for authorized_keys", username)
+	}
+	return filepath.Join(dir, username), nil
+}
+
+// userAuthorizedKeys returns the keys that the user can use. They are the keys in the user's file
+// of AuthorizedKeysDir and the keys in AuthorizedKeysPath, which are accepted for any user.
+func userAuthorizedKeys(conf Config, username string) ([]authorizedKey, error) {
+	var keys []authorizedKey
+	if conf.AuthorizedKeysDir != "" {
+		p, err := userAuthorizedKeysPath(conf.AuthorizedKeysDir, username)
+		if err != nil {
+			return nil, err
+		}
+
+		// The user may not have the file.
+		userKeys, err := loadAuthorizedKeys(p)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		keys = append(keys, userKeys...)
+	}
+
+	if conf.AuthorizedKeysPath != "" {
+		globalKeys, err := loadAuthorizedKeys(conf.AuthorizedKeysPath)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, globalKeys...)
+	}
+	return keys, nil
+}
+
+// option returns the value of the option. The quotes around the value are removed.
+func (k *authorizedKey) option(name string) (string, bool) {
+	for _, opt := range k.options {
+		n, v := splitKeyOption(opt)
+		if strings.EqualFold(n, name) {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+func splitKeyOption(opt string) (name, value string) {
+	kv := strings.SplitN(opt, "=", 2)
+	if len(kv) == 1 {
+		return kv[0], ""
+	}
+
+	value = kv[1]
+	if len(value) >= 2 && strings.HasPrefix(value, `"`) && strings.HasSuffix(value, `"`) {
+		value = strings.Replace(value[1:len(value)-1], `\"`, `"`, -1)
+	}
+	return kv[0], value
+}
+
+// permit checks the options of the key for the client.
+func (k *authorizedKey) permit(addr net.Addr, now time.Time) error {
+	for _, opt := range k.options {
+		name, _ := splitKeyOption(opt)
+		name = strings.ToLower(name)
+		if name == "cert-authority" || name == "principals" {
+			return fmt.Errorf("cert-authority is not supported in authorized_keys (use trusted_user_ca_keys)")
+		} else if name == "verify-required" || name == "no-touch-required" {
+			return fmt.Errorf("%s is not supported in authorized_keys", name)
+		} else if !knownKeyOptions[name] {
+			return fmt.Errorf("unsupported option '%s' of authorized_keys", name)
+		}
+	}
+
+	if expiry, ok := k.option("expiry-time"); ok {
+		t, err := parseExpiryTime(expiry)
+		if err != nil {
+			return err
+		} else if !now.Before(t) {
+			return fmt.Errorf("key expired at %s", t.Format(time.RFC3339))
+		}
+	}
+
+	if from, ok := k.option("from"); ok {
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			host = addr.String()
+		}
+		if !matchFrom(from, host) {
+			return fmt.Errorf("key is not allowed from %s", host)
+		}
+	}
+	return nil
+}
+
+// parseExpiryTime parses YYYYMMDD[HHMM[SS]] of expiry-time in the local time zone, or UTC with "Z" suffix.
+func parseExpiryTime(s string) (time.Time, error) {
+	loc := time.Local
+	if strings.HasSuffix(s, "Z") || strings.HasSuffix(s, "z") {
+		s = s[:len(s)-1]
+		loc = time.UTC
+	}
+
+	layouts := map[int]string{8: "20060102", 12: "200601021504", 14: "20060102150405"}
+	if layout, ok := layouts[len(s)]; ok {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid expiry-time '%s'", s)
+}
+
+// matchFrom checks the address against the pattern list of from option.
+// The patterns are the wildcards ("*" and "?") or CIDR, and "!" negates the pattern.
+// The host names are not resolved, so the patterns are matched only with the address.
+func matchFrom(patterns, addr string) bool {
+	ip := net.ParseIP(addr)
+	matched := false
+	for _, p := range strings.Split(patterns, ",") {
+		p = strings.TrimSpace(p)
+		negated := strings.HasPrefix(p, "!")
+		p = strings.TrimPrefix(p, "!")
+
+		var ok bool
+		if _, network, err := net.ParseCIDR(p); err == nil {
+			ok = ip != nil && network.Contains(ip)
+		} else {
+			ok, _ = path.Match(strings.ToLower(p), strings.ToLower(addr))
+		}
+
+		if ok && negated {
+			return false
+		} else if ok {
+			matched = true
+		}
+	}
+	return matched
+}
+
+// Name of the critical option of ssh.Permissions that holds the forced command
+const permForceCommand = "force-command"
+
+// forcedRequest returns the request that runs the forced command of the key instead of the requested one.
+// "internal-sftp" and sftp-server start the SFTP session. It returns nil if the request doesn't run a command.
+func forcedRequest(req *ssh.Request, command string) *ssh.Request {
+	if req.Type != "exec" && req.Type != "subsystem" && req.Type != "shell" {
+		return nil
+	}
+
+	if name := commandName(command); name == "internal-sftp" || name == "sftp-server" {
+		return &ssh.Request{Type: "subsystem", Payload: ssh.Marshal(struct{ Name string }{"sftp"})}
+	}
+	return &ssh.Request{Type: "exec", Payload: ssh.Marshal(struct{ Command string }{command})}
+}
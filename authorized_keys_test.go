@@ -0,0 +1,142 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestMatchFrom(t *testing.T) {
+	tests := []struct {
+		patterns string
+		addr     string
+		expected bool
+	}{
+		{"10.0.0.0/8", "10.1.2.3", true},
+		{"10.0.0.0/8", "192.168.0.1", false},
+		{"192.168.0.*,10.0.0.1", "192.168.0.10", true},
+		{"192.168.0.?", "192.168.0.10", false},
+		{"*,!192.168.0.10", "192.168.0.10", false},
+		{"!192.168.0.10", "192.168.0.11", false},
+		{"10.0.0.0/8,!10.0.0.0/24", "10.0.0.1", false},
+		{"2001:db8::/32", "2001:db8::1", true},
+		{"host.example.com", "10.0.0.1", false},
+	}
+
+	for _, test := range tests {
+		if matchFrom(test.patterns, test.addr) != test.expected {
+			t.Errorf("from=\"%s\" for %s should be %v", test.patterns, test.addr, test.expected)
+		}
+	}
+}
+
+func TestParseExpiryTime(t *testing.T) {
+	tests := map[string]time.Time{
+		"20300102":         time.Date(2030, 1, 2, 0, 0, 0, 0, time.Local),
+		"203001020304":     time.Date(2030, 1, 2, 3, 4, 0, 0, time.Local),
+		"20300102030405Z":  time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC),
+		"2030-01-02":       {},
+		"20301302":         {},
+		"2030010203040506": {},
+	}
+
+	for s, expected := range tests {
+		tm, err := parseExpiryTime(s)
+		if expected.IsZero() {
+			if err == nil {
+				t.Errorf("'%s' should be rejected", s)
+			}
+		} else if err != nil || !tm.Equal(expected) {
+			t.Errorf("'%s' was parsed wrongly %v [%v]", s, tm, err)
+		}
+	}
+}
+
+func TestAuthPkeyUserKeys(t *testing.T) {
+	c := defaultConfigForTesting()
+	c.AuthorizedKeysPath = ""
+
+	dir, err := ioutil.TempDir("", "authorized_keys_dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c.AuthorizedKeysDir = dir
+
+	keys := map[string]ssh.PublicKey{}
+	for _, name := range []string{"plain", "from", "expired", "valid", "unknown", "ca", "verify", "command"} {
+		keys[name] = signerForTesting(t).PublicKey()
+	}
+	line := func(options, name string) string {
+		if options != "" {
+			options += " "
+		}
+		return options + string(ssh.MarshalAuthorizedKey(keys[name]))
+	}
+
+	content := line("restrict", "plain") +
+		line(`from="10.0.0.0/8,192.168.0.*"`, "from") +
+		line(`expiry-time="20000101"`, "expired") +
+		line(`expiry-time="29991231235959Z",no-pty`, "valid") +
+		line(`unknown-option`, "unknown") +
+		line(`cert-authority`, "ca") +
+		line(`verify-required`, "verify") +
+		line(`restrict,command="internal-sftp"`, "command")
+	if err = ioutil.WriteFile(filepath.Join(dir, "alice"), []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	alice := testConnMetadata{user: "alice", addr: "192.168.0.5:50022"}
+	for _, name := range []string{"plain", "from", "valid"} {
+		if _, err = authPkey(c)(alice, keys[name]); err != nil {
+			t.Errorf("Key '%s' should be accepted [%v]", name, err)
+		}
+	}
+	for _, name := range []string{"expired", "unknown", "ca", "verify"} {
+		if _, err = authPkey(c)(alice, keys[name]); err == nil {
+			t.Errorf("Key '%s' should be rejected", name)
+		}
+	}
+
+	perms, err := authPkey(c)(alice, keys["command"])
+	if err != nil {
+		t.Fatal(err)
+	} else if perms.CriticalOptions[permForceCommand] != "internal-sftp" {
+		t.Errorf("Wrong forced command '%s'", perms.CriticalOptions[permForceCommand])
+	}
+
+	// source address
+	if _, err = authPkey(c)(testConnMetadata{user: "alice", addr: "172.16.0.1:50022"}, keys["from"]); err == nil {
+		t.Errorf("Key should be rejected from the other address")
+	}
+
+	// The keys are bound to the user.
+	for _, user := range []string{"bob", "../alice", ""} {
+		if _, err = authPkey(c)(testConnMetadata{user: user}, keys["plain"]); err == nil {
+			t.Errorf("Key of alice should be rejected for '%s'", user)
+		}
+	}
+}
+
+func TestForcedRequest(t *testing.T) {
+	exec := &ssh.Request{Type: "exec", Payload: ssh.Marshal(struct{ Command string }{"cp /a /b"})}
+
+	req := forcedRequest(exec, "/usr/lib/openssh/sftp-server -R")
+	if req == nil || req.Type != "subsystem" || string(req.Payload[4:]) != "sftp" {
+		t.Errorf("sftp-server should start SFTP session %+v", req)
+	}
+
+	req = forcedRequest(&ssh.Request{Type: "subsystem", Payload: ssh.Marshal(struct{ Name string }{"sftp"})}, "md5sum /a.txt")
+	var payload struct{ Command string }
+	if req == nil || req.Type != "exec" || ssh.Unmarshal(req.Payload, &payload) != nil || payload.Command != "md5sum /a.txt" {
+		t.Errorf("Forced command should run instead of SFTP %+v", req)
+	}
+
+	if forcedRequest(&ssh.Request{Type: "pty-req"}, "internal-sftp") != nil {
+		t.Errorf("pty-req should not run the command")
+	}
+}
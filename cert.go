@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// authCert authenticates the OpenSSH user certificate signed by the trusted CA keys.
+// The login user must be one of the principals of the certificate, and the certificate
+// must be valid at the moment and not be revoked.
+func authCert(conf Config, c ssh.ConnMetadata, cert *ssh.Certificate) (*ssh.Permissions, error) {
+	caKeys, err := loadCAKeys(conf.TrustedUserCAKeysPath)
+	if err != nil {
+		return nil, err
+	}
+
+	revoked := &revocationList{}
+	if conf.RevokedKeysPath != "" {
+		// The certificates are rejected if the list can't be read.
+		if revoked, err = loadRevocationList(conf.RevokedKeysPath); err != nil {
+			return nil, err
+		}
+	}
+
+	// ssh.CertChecker accepts any user if the certificate has no principals.
+	if len(cert.ValidPrincipals) == 0 {
+		return nil, fmt.Errorf("certificate %q has no principals for %q", cert.KeyId, c.User())
+	}
+
+	checker := &ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			for _, key := range caKeys {
+				if bytes.Equal(key.Marshal(), auth.Marshal()) {
+					return true
+				}
+			}
+			return false
+		},
+		IsRevoked: revoked.Revoked,
+
+		// force-command runs instead of the requested command like command="..." of authorized_keys.
+		SupportedCriticalOptions: []string{permForceCommand},
+	}
+
+	certPerms, err := checker.Authenticate(c, cert)
+	if err != nil {
+		return nil, err
+	}
+
+	// Record the certificate used for authentication.
+	perms := &ssh.Permissions{
+		CriticalOptions: certPerms.CriticalOptions,
+		Extensions: map[string]string{
+			"pubkey-fp":   ssh.FingerprintSHA256(cert.Key),
+			"cert-key-id": cert.KeyId,
+			"cert-serial": strconv.FormatUint(cert.Serial, 10),
+			"cert-ca-fp":  ssh.FingerprintSHA256(cert.SignatureKey),
+		},
+	}
+	return perms, nil
+}
+
+// loadCAKeys reads the CA public keys in the format of authorized_keys.
+func loadCAKeys(path string) ([]ssh.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []ssh.PublicKey
+	for len(bytes.TrimSpace(data)) > 0 {
+		key, _, _, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid CA key in '%s' [%v]", path, err)
+		}
+		keys = append(keys, key)
+		data = rest
+	}
+	return keys, nil
+}
+
+// revocationList is the list of the revoked certificates and keys.
+// It's loaded from the KRL of OpenSSH (ssh-keygen -k) or the plain list of the serial numbers.
+type revocationList struct {
+	certs   []krlCerts
+	keys    map[string]bool // public key blob
+	sha1    map[string]bool // SHA1 hash of the public key blob
+	sha256  map[string]bool // SHA256 hash of the public key blob
+	serials map[uint64]bool // serial numbers of the plain list (any CA)
+}
+
+// krlCerts is the revoked certificates of the CA.
+type krlCerts struct {
+	ca      []byte // public key blob of the CA, or nil for any CA
+	serials []serialRange
+	bitmaps []serialBitmap
+	keyIDs  map[string]bool
+}
+
+type serialRange struct {
+	min, max uint64
+}
+
+type serialBitmap struct {
+	offset uint64
+	bitmap *big.Int
+}
+
+// Magic number of KRL "SSHKRL\n\0"
+const krlMagic = "SSHKRL\n\x00"
+
+// Sections of KRL (PROTOCOL.krl of OpenSSH)
+const (
+	krlSectionCertificates      = 1
+	krlSectionExplicitKey       = 2
+	krlSectionFingerprintSHA1   = 3
+	krlSectionSignature         = 4
+	krlSectionFingerprintSHA256 = 5
+
+	krlSectionCertSerialList   = 0x20
+	krlSectionCertSerialRange  = 0x21
+	krlSectionCertSerialBitmap = 0x22
+	krlSectionCertKeyID        = 0x23
+)
+
+var errInvalidKRL = errors.New("invalid KRL")
+
+// loadRevocationList reads the KRL or the plain list of the serial numbers.
+// The plain list has a serial number (decimal or "0x" hex) per line, and "#" starts a comment.
+func loadRevocationList(path string) (*revocationList, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.HasPrefix(data, []byte(krlMagic)) {
+		l, err := parseKRL(data)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't parse KRL '%s' [%v]", path, err)
+		}
+		return l, nil
+	}
+
+	l := &revocationList{serials: map[uint64]bool{}}
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; s.Scan(); n++ {
+		line := s.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+
+		serial, err := strconv.ParseUint(line, 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid serial number at line %d in '%s'", n, path)
+		}
+		l.serials[serial] = true
+	}
+	return l, s.Err()
+}
+
+func parseKRL(data []byte) (*revocationList, error) {
+	l := &revocationList{
+		keys:   map[string]bool{},
+		sha1:   map[string]bool{},
+		sha256: map[string]bool{},
+	}
+
+	// header
+	b := data[len(krlMagic):]
+	version, b, ok := unmarshalUint32(b)
+	if !ok || version != 1 {
+		return nil, fmt.Errorf("unsupported KRL version %d", version)
+	}
+	for i := 0; i < 3; i++ {
+		// krl_version, generated_date and flags
+		if _, b, ok = unmarshalUint64(b); !ok {
+			return nil, errInvalidKRL
+		}
+	}
+	for i := 0; i < 2; i++ {
+		// reserved and comment
+		if _, b, ok = unmarshalString(b); !ok {
+			return nil, errInvalidKRL
+		}
+	}
+
+	for len(b) > 0 {
+		typ := b[0]
+		var section string
+		if section, b, ok = unmarshalString(b[1:]); !ok {
+			return nil, errInvalidKRL
+		}
+
+		var err error
+		switch typ {
+		case krlSectionCertificates:
+			err = l.parseCertificates([]byte(section))
+		case krlSectionExplicitKey:
+			err = parseKRLStrings([]byte(section), l.keys)
+		case krlSectionFingerprintSHA1:
+			err = parseKRLStrings([]byte(section), l.sha1)
+		case krlSectionFingerprintSHA256:
+			err = parseKRLStrings([]byte(section), l.sha256)
+		case krlSectionSignature:
+			// The signature of the KRL is not verified. The section has the key and the
+			// signature, so the section read above is the key and the signature follows.
+			if _, b, ok = unmarshalString(b); !ok {
+				return nil, errInvalidKRL
+			}
+		default:
+			err = fmt.Errorf("unknown section %d", typ)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+func (l *revocationList) parseCertificates(b []byte) error {
+	ca, b, ok := unmarshalString(b)
+	if !ok {
+		return errInvalidKRL
+	}
+	if _, b, ok = unmarshalString(b); !ok {
+		// reserved
+		return errInvalidKRL
+	}
+
+	certs := krlCerts{keyIDs: map[string]bool{}}
+	if ca != "" {
+		certs.ca = []byte(ca)
+	}
+
+	for len(b) > 0 {
+		typ := b[0]
+		var section string
+		if section, b, ok = unmarshalString(b[1:]); !ok {
+			return errInvalidKRL
+		}
+		s := []byte(section)
+
+		switch typ {
+		case krlSectionCertSerialList:
+			for len(s) > 0 {
+				var serial uint64
+				if serial, s, ok = unmarshalUint64(s); !ok {
+					return errInvalidKRL
+				}
+				certs.serials = append(certs.serials, serialRange{serial, serial})
+			}
+		case krlSectionCertSerialRange:
+			var r serialRange
+			if r.min, s, ok = unmarshalUint64(s); !ok {
+				return errInvalidKRL
+			}
+			if r.max, s, ok = unmarshalUint64(s); !ok || len(s) > 0 {
+				return errInvalidKRL
+			}
+			certs.serials = append(certs.serials, r)
+		case krlSectionCertSerialBitmap:
+			var m serialBitmap
+			if m.offset, s, ok = unmarshalUint64(s); !ok {
+				return errInvalidKRL
+			}
+			var bitmap string
+			if bitmap, s, ok = unmarshalString(s); !ok || len(s) > 0 {
+				return errInvalidKRL
+			}
+			m.bitmap = new(big.Int).SetBytes([]byte(bitmap))
+			certs.bitmaps = append(certs.bitmaps, m)
+		case krlSectionCertKeyID:
+			if err := parseKRLStrings(s, certs.keyIDs); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unknown certificate section %d", typ)
+		}
+	}
+
+	l.certs = append(l.certs, certs)
+	return nil
+}
+
+// parseKRLStrings adds the strings in the section to the set.
+func parseKRLStrings(b []byte, set map[string]bool) error {
+	for len(b) > 0 {
+		s, rest, ok := unmarshalString(b)
+		if !ok {
+			return errInvalidKRL
+		}
+		set[s] = true
+		b = rest
+	}
+	return nil
+}
+
+// Revoked returns true if the certificate, its key or the CA key is revoked.
+func (l *revocationList) Revoked(cert *ssh.Certificate) bool {
+	if l.serials[cert.Serial] {
+		return true
+	}
+
+	ca := cert.SignatureKey.Marshal()
+	for _, c := range l.certs {
+		if c.ca != nil && !bytes.Equal(c.ca, ca) {
+			continue
+		}
+		if c.keyIDs[cert.KeyId] {
+			return true
+		}
+		for _, r := range c.serials {
+			if r.min <= cert.Serial && cert.Serial <= r.max {
+				return true
+			}
+		}
+		for _, m := range c.bitmaps {
+			if cert.Serial >= m.offset && cert.Serial-m.offset < uint64(m.bitmap.BitLen()) && m.bitmap.Bit(int(cert.Serial-m.offset)) == 1 {
+				return true
+			}
+		}
+	}
+
+	return l.revokedKey(cert.Key.Marshal()) || l.revokedKey(ca)
+}
+
+func (l *revocationList) revokedKey(blob []byte) bool {
+	h1 := sha1.Sum(blob)
+	h256 := sha256.Sum256(blob)
+	return l.keys[string(blob)] || l.sha1[string(h1[:])] || l.sha256[string(h256[:])]
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func signerForTesting(t *testing.T) ssh.Signer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// certForTesting returns the user certificate signed by the CA, which is valid for an hour.
+func certForTesting(t *testing.T, ca ssh.Signer, serial uint64, keyID string, principals ...string) *ssh.Certificate {
+	now := time.Now()
+	cert := &ssh.Certificate{
+		Key:             signerForTesting(t).PublicKey(),
+		Serial:          serial,
+		CertType:        ssh.UserCert,
+		KeyId:           keyID,
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(now.Add(-time.Minute).Unix()),
+		ValidBefore:     uint64(now.Add(time.Hour).Unix()),
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// krlForTesting returns the KRL that revokes the serial range and the key ID of the CA, and the explicit key.
+func krlForTesting(ca ssh.PublicKey, min, max uint64, keyID string, key ssh.PublicKey) []byte {
+	uint64s := func(b []byte, vs ...uint64) []byte {
+		for _, v := range vs {
+			b = marshalUint32(marshalUint32(b, uint32(v>>32)), uint32(v))
+		}
+		return b
+	}
+
+	certs := marshalString(marshalString(nil, string(ca.Marshal())), "")
+	certs = marshalString(append(certs, krlSectionCertSerialRange), string(uint64s(nil, min, max)))
+	certs = marshalString(append(certs, krlSectionCertKeyID), string(marshalString(nil, keyID)))
+
+	krl := uint64s(marshalUint32([]byte(krlMagic), 1), 1, 0, 0)
+	krl = marshalString(marshalString(krl, ""), "comment")
+	krl = marshalString(append(krl, krlSectionCertificates), string(certs))
+	krl = marshalString(append(krl, krlSectionExplicitKey), string(marshalString(nil, string(key.Marshal()))))
+	return krl
+}
+
+func TestAuthCert(t *testing.T) {
+	c := defaultConfigForTesting()
+	ca := signerForTesting(t)
+
+	filename := "./trusted_user_ca_keys_test"
+	if err := ioutil.WriteFile(filename, ssh.MarshalAuthorizedKey(ca.PublicKey()), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(filename)
+	c.TrustedUserCAKeysPath = filename
+
+	cert := certForTesting(t, ca, 10, "alice@example", "alice", "admin")
+	perms, err := authPkey(c)(testConnMetadata{user: "alice"}, cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perms.Extensions["cert-key-id"] != "alice@example" || perms.Extensions["cert-serial"] != "10" {
+		t.Errorf("Wrong extensions %v", perms.Extensions)
+	}
+
+	// errors
+	expired := certForTesting(t, ca, 11, "expired", "alice")
+	expired.ValidBefore = uint64(time.Now().Add(-time.Second).Unix())
+	expired.SignCert(rand.Reader, ca)
+
+	for name, cert := range map[string]*ssh.Certificate{
+		"other principal": certForTesting(t, ca, 12, "bob", "bob"),
+		"no principals":   certForTesting(t, ca, 13, "any"),
+		"unknown CA":      certForTesting(t, signerForTesting(t), 14, "alice", "alice"),
+		"expired":         expired,
+	} {
+		if _, err = authPkey(c)(testConnMetadata{user: "alice"}, cert); err == nil {
+			t.Errorf("Certificate should be rejected (%s)", name)
+		}
+	}
+
+	// revocation with the serial numbers
+	revoked := "./revoked_keys_test"
+	if err = ioutil.WriteFile(revoked, []byte("# revoked\n5\n0x0a # alice\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(revoked)
+	c.RevokedKeysPath = revoked
+
+	if _, err = authPkey(c)(testConnMetadata{user: "alice"}, cert); err == nil {
+		t.Errorf("Revoked serial should be rejected")
+	}
+	if _, err = authPkey(c)(testConnMetadata{user: "alice"}, certForTesting(t, ca, 11, "alice", "alice")); err != nil {
+		t.Errorf("Certificate should be accepted [%v]", err)
+	}
+
+	// KRL
+	other := certForTesting(t, ca, 100, "other", "alice")
+	if err = ioutil.WriteFile(revoked, krlForTesting(ca.PublicKey(), 20, 29, "alice-laptop", other.Key), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for name, cert := range map[string]*ssh.Certificate{
+		"serial range": certForTesting(t, ca, 25, "alice", "alice"),
+		"key ID":       certForTesting(t, ca, 30, "alice-laptop", "alice"),
+		"explicit key": other,
+	} {
+		if _, err = authPkey(c)(testConnMetadata{user: "alice"}, cert); err == nil {
+			t.Errorf("Certificate should be revoked by KRL (%s)", name)
+		}
+	}
+	if _, err = authPkey(c)(testConnMetadata{user: "alice"}, certForTesting(t, ca, 30, "alice", "alice")); err != nil {
+		t.Errorf("Certificate should be accepted with KRL [%v]", err)
+	}
+
+	// signed KRL has the key and the signature in the signature section
+	krl := krlForTesting(ca.PublicKey(), 20, 29, "alice-laptop", other.Key)
+	sig, err := ca.Sign(rand.Reader, krl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	krl = marshalString(append(krl, krlSectionSignature), string(ca.PublicKey().Marshal()))
+	krl = marshalString(krl, string(ssh.Marshal(sig)))
+	ioutil.WriteFile(revoked, krl, 0600)
+	if _, err = authPkey(c)(testConnMetadata{user: "alice"}, other); err == nil {
+		t.Errorf("Certificate should be revoked by signed KRL")
+	}
+	if _, err = authPkey(c)(testConnMetadata{user: "alice"}, certForTesting(t, ca, 30, "alice", "alice")); err != nil {
+		t.Errorf("Certificate should be accepted with signed KRL [%v]", err)
+	}
+
+	// broken KRL
+	krl = krlForTesting(ca.PublicKey(), 20, 29, "alice-laptop", other.Key)
+	binary.BigEndian.PutUint32(krl[len(krlMagic):], 2)
+	ioutil.WriteFile(revoked, krl, 0600)
+	if _, err = authPkey(c)(testConnMetadata{user: "alice"}, cert); err == nil {
+		t.Errorf("Certificate should be rejected if the KRL is broken")
+	}
+}
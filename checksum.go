@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	"github.com/pkg/sftp"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// The hash functions of the checksum commands that the clients like rclone and WinSCP run
+// to verify the transfers.
+var checksumCommands = map[string]func() hash.Hash{
+	"md5sum":    md5.New,
+	"sha1sum":   sha1.New,
+	"sha256sum": sha256.New,
+}
+
+// checksumCommand is the command line of md5sum, sha1sum or sha256sum.
+type checksumCommand struct {
+	name  string
+	paths []string // "-" means the standard input
+}
+
+// parseChecksumCommand parses the command of the exec request.
+// Only the options that don't change the output are accepted.
+func parseChecksumCommand(command string) (*checksumCommand, error) {
+	args, err := splitCommand(command)
+	if err != nil {
+		return nil, err
+	} else if len(args) == 0 || checksumCommands[commandName(command)] == nil {
+		return nil, fmt.Errorf("Unsupported command '%s'", command)
+	}
+
+	cmd := &checksumCommand{
+		name: commandName(command),
+	}
+	i := 1
+	for ; i < len(args) && strings.HasPrefix(args[i], "-") && args[i] != "-"; i++ {
+		if args[i] == "--" {
+			i++
+			break
+		}
+
+		switch args[i] {
+		case "-b", "--binary", "-t", "--text":
+			// The mode makes no difference
+		default:
+			return nil, fmt.Errorf("Unsupported option '%s' of %s", args[i], cmd.name)
+		}
+	}
+
+	cmd.paths = args[i:]
+	if len(cmd.paths) == 0 {
+		cmd.paths = []string{"-"}
+	}
+	return cmd, nil
+}
+
+// StartChecksumSession runs the checksum command on the channel for "exec md5sum" request.
+// The output is the same as GNU coreutils, and the files are read through SwiftFS like SFTP sessions.
+// It returns the exit status for the client.
+func StartChecksumSession(conf Config, store ObjectStore, channel ssh.Channel, client *Client, cmd *checksumCommand) (status int, err error) {
+	// logger with client
+	clog := log.WithFields(logrus.Fields{
+		"client": client,
+	})
+
+	clog.Debugf("Starting %s session.", cmd.name)
+
+	fs, err := newSessionFS(conf, store, client, clog)
+	if err != nil {
+		return 1, err
+	}
+
+	s := &checksumSession{
+		fs:     fs,
+		log:    clog,
+		cmd:    cmd,
+		stdin:  channel,
+		stdout: channel,
+		stderr: channel.Stderr(),
+	}
+	if err = s.run(); err != nil || s.failed {
+		status = 1
+	}
+
+	clog.Debugf("End %s session (status=%d)", cmd.name, status)
+	return status, err
+}
+
+type checksumSession struct {
+	fs     *SwiftFS
+	log    *logrus.Entry
+	cmd    *checksumCommand
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+
+	failed bool // some files couldn't be read
+}
+
+func (s *checksumSession) run() error {
+	for _, p := range s.cmd.paths {
+		var sum string
+		var err error
+		if p == "-" {
+			sum, err = s.sum(s.stdin)
+		} else {
+			sum, err = s.file(p)
+		}
+
+		if err != nil {
+			s.failed = true
+			s.log.Warnf("%s %s %v", s.cmd.name, p, err)
+			if _, err = fmt.Fprintf(s.stderr, "%s: %s: %v\n", s.cmd.name, p, err); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// GNU coreutils escapes the name that contains backslashes or newlines.
+		line := fmt.Sprintf("%s  %s\n", sum, p)
+		if strings.ContainsAny(p, "\\\n") {
+			line = fmt.Sprintf("\\%s  %s\n", sum, strings.NewReplacer("\\", "\\\\", "\n", "\\n").Replace(p))
+		}
+		if _, err = io.WriteString(s.stdout, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// file returns the checksum of the file. MD5 is taken from the ETag if possible,
+// and the others are calculated by downloading the file.
+func (s *checksumSession) file(p string) (string, error) {
+	if fi, err := s.fs.stat(p); err != nil {
+		return "", err
+	} else if fi.IsDir() {
+		return "", fmt.Errorf("Is a directory")
+	}
+
+	r, err := s.fs.Fileread(sftp.NewRequest("Get", p))
+	if err != nil {
+		return "", err
+	}
+	reader := r.(*swiftReader)
+	defer reader.Close()
+
+	if s.cmd.name == "md5sum" {
+		if sum := reader.MD5(); sum != "" {
+			s.log.Debugf("%s %s is taken from the ETag", s.cmd.name, p)
+			return sum, nil
+		}
+	}
+	return s.sum(io.NewSectionReader(reader, 0, reader.downloadSize))
+}
+
+func (s *checksumSession) sum(r io.Reader) (string, error) {
+	h := checksumCommands[s.cmd.name]()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pkg/sftp"
+)
+
+func TestParseChecksumCommand(t *testing.T) {
+	tests := map[string]*checksumCommand{
+		"md5sum":                         {name: "md5sum", paths: []string{"-"}},
+		"md5sum /a.txt":                  {name: "md5sum", paths: []string{"/a.txt"}},
+		"/usr/bin/sha1sum -b -- 'a b'":   {name: "sha1sum", paths: []string{"a b"}},
+		`sha256sum --text - "dir/c.txt"`: {name: "sha256sum", paths: []string{"-", "dir/c.txt"}},
+		"md5sum -- -a.txt":               {name: "md5sum", paths: []string{"-a.txt"}},
+		"md5sum -c sums.txt":             nil,
+		"sha512sum /a.txt":               nil,
+		"cksum /a.txt":                   nil,
+		"md5sum 'a.txt":                  nil,
+		"":                               nil,
+	}
+
+	for command, expected := range tests {
+		cmd, err := parseChecksumCommand(command)
+		if expected == nil {
+			if err == nil {
+				t.Errorf("'%s' should be rejected", command)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("'%s' should be accepted [%v]", command, err)
+		} else if !reflect.DeepEqual(cmd, expected) {
+			t.Errorf("'%s' was parsed wrongly %+v", command, cmd)
+		}
+	}
+}
+
+func runChecksumForTesting(fs *SwiftFS, command, stdin string) (stdout, stderr string, failed bool) {
+	cmd, err := parseChecksumCommand(command)
+	if err != nil {
+		return "", err.Error(), true
+	}
+
+	out := new(bytes.Buffer)
+	errOut := new(bytes.Buffer)
+	s := &checksumSession{
+		fs:     fs,
+		log:    log.WithField("test", true),
+		cmd:    cmd,
+		stdin:  strings.NewReader(stdin),
+		stdout: out,
+		stderr: errOut,
+	}
+	if err = s.run(); err != nil {
+		return out.String(), err.Error(), true
+	}
+	return out.String(), errOut.String(), s.failed
+}
+
+func TestChecksum(t *testing.T) {
+	s := storeForTesting()
+	fs := NewSwiftFS(s, defaultConfigForTesting())
+
+	small := []byte("checksum test\n")
+	if err := s.Put("checksum-small.txt", bytes.NewReader(small)); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Delete("checksum-small.txt")
+
+	// large object with two segments
+	large := append(bytes.Repeat([]byte("0123456789abcdef"), minSegmentSize/16), []byte("tail")...)
+	seg1, err := s.PutSegment("checksum-large.dat/slo/00000000", bytes.NewReader(large[:minSegmentSize]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	seg2, err := s.PutSegment("checksum-large.dat/slo/00000001", bytes.NewReader(large[minSegmentSize:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.PutManifest("checksum-large.dat", []Segment{seg1, seg2}); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Delete("checksum-large.dat")
+
+	for name, sum := range map[string]func([]byte) string{
+		"md5sum":    func(b []byte) string { h := md5.Sum(b); return hex.EncodeToString(h[:]) },
+		"sha1sum":   func(b []byte) string { h := sha1.Sum(b); return hex.EncodeToString(h[:]) },
+		"sha256sum": func(b []byte) string { h := sha256.Sum256(b); return hex.EncodeToString(h[:]) },
+	} {
+		stdout, stderr, failed := runChecksumForTesting(fs, name+" /checksum-small.txt checksum-large.dat -", "stdin")
+		expected := sum(small) + "  /checksum-small.txt\n" + sum(large) + "  checksum-large.dat\n" + sum([]byte("stdin")) + "  -\n"
+		if failed || stdout != expected {
+			t.Errorf("Wrong output of %s '%s' (expected=%s) [%s]", name, stdout, expected, stderr)
+		}
+	}
+
+	// The ETag is used only for the normal object.
+	if _, ok := s.(*Swift); ok {
+		r, err := fs.Fileread(sftp.NewRequest("Get", "/checksum-small.txt"))
+		if err != nil {
+			t.Fatal(err)
+		} else if h := md5.Sum(small); r.(*swiftReader).MD5() != hex.EncodeToString(h[:]) {
+			t.Errorf("MD5 should be taken from the ETag")
+		}
+		r.(*swiftReader).Close()
+
+		if r, err = fs.Fileread(sftp.NewRequest("Get", "/checksum-large.dat")); err != nil {
+			t.Fatal(err)
+		} else if r.(*swiftReader).MD5() != "" {
+			t.Errorf("ETag of the large object should not be used")
+		}
+		r.(*swiftReader).Close()
+	}
+
+	// errors
+	stdout, stderr, failed := runChecksumForTesting(fs, "md5sum /checksum-missing.txt / /checksum-small.txt", "")
+	h := md5.Sum(small)
+	if !failed || stdout != hex.EncodeToString(h[:])+"  /checksum-small.txt\n" {
+		t.Errorf("The other files should be processed '%s'", stdout)
+	}
+	if !strings.HasPrefix(stderr, "md5sum: /checksum-missing.txt: ") || !strings.Contains(stderr, "md5sum: /: Is a directory\n") {
+		t.Errorf("Wrong errors '%s'", stderr)
+	}
+
+	fs.SetAccessMode(AccessWriteOnly)
+	if stdout, stderr, failed = runChecksumForTesting(fs, "md5sum /checksum-small.txt", ""); !failed || stdout != "" {
+		t.Errorf("Write-only user should not read the checksum '%s' [%s]", stdout, stderr)
+	}
+}
+
+func TestChecksumEscape(t *testing.T) {
+	s := storeForTesting()
+	fs := NewSwiftFS(s, defaultConfigForTesting())
+
+	if err := s.Put("checksum\\escape.txt", bytes.NewReader([]byte{})); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Delete("checksum\\escape.txt")
+
+	// GNU coreutils' format for the name with a backslash
+	stdout, stderr, failed := runChecksumForTesting(fs, `md5sum '/checksum\escape.txt'`, "")
+	if expected := "\\d41d8cd98f00b204e9800998ecf8427e  /checksum\\\\escape.txt\n"; failed || stdout != expected {
+		t.Errorf("Wrong output '%s' (expected=%s) [%s]", stdout, expected, stderr)
+	}
+}
@@ -8,6 +8,12 @@ import (
 type Client struct {
 	SessionID  string
 	Username   string
+	Groups     []string
+	Container  string
+	AccessMode AccessMode
 	RemoteAddr net.Addr
 	StartedAt  time.Time
+
+	// Command of the key that runs instead of the requested one
+	ForceCommand string
 }
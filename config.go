@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 
@@ -33,12 +34,72 @@ type Config struct {
 	ServerKeyPath      string `toml:"server_key"`
 	AuthorizedKeysPath string `toml:"authorized_keys"`
 
+	// Directory of the authorized_keys files of the users. The file has the same name as the user.
+	AuthorizedKeysDir string `toml:"authorized_keys_dir"`
+
+	// CA public keys that sign the user certificates, and the revoked certificates and keys (KRL or serial numbers)
+	TrustedUserCAKeysPath string `toml:"trusted_user_ca_keys"`
+	RevokedKeysPath       string `toml:"revoked_keys"`
+
 	// Container name
 	Container string `toml:"container"`
 
+	// Storage backend ("swift" or "memory")
+	Backend string `toml:"backend"`
+
 	// Timeout for downloading and uploading (sec)
 	SwiftTimeout int `toml:"swift_timeout"`
 
+	// Files larger than the segment size are uploaded as Static Large Object (MiB)
+	SegmentSize int `toml:"segment_size"`
+
+	// Capacity of the storage that is reported to the clients with statvfs (GiB)
+	// It's used if the quotas of the container and the account are not set.
+	StorageCapacity int64 `toml:"storage_capacity"`
+
+	// Max number of the objects in a directory listing whose metadata (mode and mtime) are read
+	// with HEAD requests. If 0, the listing shows Last-Modified and the default mode.
+	ListMetadataLimit int `toml:"list_metadata_limit"`
+
+	// Container to store the segments of Static Large Objects
+	SegmentContainer string `toml:"segment_container"`
+
+	// Containers for the users (username -> container)
+	// The users who are not in the map use the container above.
+	UserContainers map[string]string `toml:"user_containers"`
+
+	// Create the containers of the users if not exist
+	CreateUserContainers bool `toml:"create_user_containers"`
+
+	// Home directory of the users in the container. "%u" is replaced with the username.
+	// The users can't access the objects outside of it. If empty, the container root is used.
+	HomeDirectory string `toml:"home_directory"`
+
+	// Access mode of the users ("read-write", "read-only" or "write-only")
+	AccessMode string `toml:"access_mode"`
+
+	// Access modes for the users (username -> access mode)
+	// The users who are not in the map use the access mode above.
+	UserAccessModes map[string]string `toml:"user_access_modes"`
+
+	// ACL rules file that restricts the operations on the paths
+	ACLFilePath string `toml:"acl_file"`
+
+	// Containers, access modes and home directories for the groups of the users (group -> value)
+	// The groups are given by LDAP. The maps of the users above take precedence over them.
+	GroupContainers      map[string]string `toml:"group_containers"`
+	GroupAccessModes     map[string]string `toml:"group_access_modes"`
+	GroupHomeDirectories map[string]string `toml:"group_home_directories"`
+
+	// LDAP or Active Directory for the password and the public key authentication
+	LDAP LDAPConfig `toml:"ldap"`
+
+	// TOTP seeds file for the second factor after the password or the public key authentication
+	TOTPFilePath string `toml:"totp_file"`
+
+	// Rule for the users who don't have the TOTP seed ("deny" or "allow")
+	TOTPUnenrolled string `toml:"totp_unenrolled"`
+
 	// Optional parameters for OpenStack
 	// If those are not given, We use environment variables like OS_USERNAME to authenticate the client.
 	OsIdentityEndpoint string `toml:"os_identity_endpoint"`
@@ -55,11 +116,51 @@ type Config struct {
 func (c *Config) LoadFromContext(ctx *cli.Context) error {
 	c.BindAddress = ctx.String("address")
 	c.Container = ctx.String("container")
+	c.Backend = ctx.String("backend")
 	c.PasswordFilePath = ctx.String("password-file")
 	c.ServerKeyPath = ctx.String("server-key")
 	c.AuthorizedKeysPath = ctx.String("authorized-keys")
+	c.AuthorizedKeysDir = ctx.String("authorized-keys-dir")
+	if c.AuthorizedKeysDir != "" && !ctx.IsSet("authorized-keys") {
+		// The keys are bound to the users, so the default authorized_keys is not used.
+		c.AuthorizedKeysPath = ""
+	}
+	c.TrustedUserCAKeysPath = ctx.String("trusted-user-ca-keys")
+	c.RevokedKeysPath = ctx.String("revoked-keys")
 	c.CreateContainerIfNotExists = ctx.Bool("create-container")
 	c.SwiftTimeout = ctx.Int("swift-timeout")
+	c.SegmentSize = ctx.Int("segment-size")
+	c.SegmentContainer = ctx.String("segment-container")
+	c.StorageCapacity = ctx.Int64("storage-capacity")
+	c.ListMetadataLimit = ctx.Int("list-metadata-limit")
+	c.HomeDirectory = ctx.String("home-directory")
+	c.CreateUserContainers = ctx.Bool("create-user-containers")
+	c.AccessMode = ctx.String("access-mode")
+	c.ACLFilePath = ctx.String("acl-file")
+	c.TOTPFilePath = ctx.String("totp-file")
+	c.TOTPUnenrolled = ctx.String("totp-unenrolled")
+
+	for _, pair := range ctx.StringSlice("user-container") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return fmt.Errorf("Invalid user container '%s' (USER=CONTAINER)", pair)
+		}
+		if c.UserContainers == nil {
+			c.UserContainers = map[string]string{}
+		}
+		c.UserContainers[kv[0]] = kv[1]
+	}
+
+	for _, pair := range ctx.StringSlice("user-access-mode") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return fmt.Errorf("Invalid user access mode '%s' (USER=MODE)", pair)
+		}
+		if c.UserAccessModes == nil {
+			c.UserAccessModes = map[string]string{}
+		}
+		c.UserAccessModes[kv[0]] = kv[1]
+	}
 
 	return nil
 }
@@ -81,12 +182,7 @@ func (c *Config) Init() (err error) {
 
 	// All paths in a configuration must be absolute path.
 	if c.ServerKeyPath != "" {
-		path := c.ServerKeyPath
-		if u, err := user.Current(); err == nil {
-			path = strings.Replace(path, "~", u.HomeDir, 1)
-		}
-
-		path, err := filepath.Abs(path)
+		path, err := absPath(c.ServerKeyPath)
 		if err != nil {
 			return err
 		}
@@ -105,38 +201,86 @@ func (c *Config) Init() (err error) {
 	}
 
 	if c.PasswordFilePath != "" {
-		path := c.PasswordFilePath
-		if u, err := user.Current(); err == nil {
-			path = strings.Replace(path, "~", u.HomeDir, 1)
+		path, err := existingPath("Password file", c.PasswordFilePath, false)
+		if err != nil {
+			return err
 		}
+		c.PasswordFilePath = path
+	}
 
-		path, err = filepath.Abs(path)
+	if c.AuthorizedKeysPath != "" {
+		path, err := existingPath("Authorized keys file", c.AuthorizedKeysPath, false)
 		if err != nil {
 			return err
 		}
-		if _, err = os.Stat(path); err != nil {
-			return fmt.Errorf("Password file '%s' is not found", c.PasswordFilePath)
+		c.AuthorizedKeysPath = path
+
+	} else if c.AuthorizedKeysDir == "" && c.TrustedUserCAKeysPath == "" && c.LDAP.URL == "" {
+		return fmt.Errorf("Authorized keys file is required")
+	}
+
+	if c.AuthorizedKeysDir != "" {
+		path, err := existingPath("Authorized keys directory", c.AuthorizedKeysDir, true)
+		if err != nil {
+			return err
 		}
-		c.PasswordFilePath = path
+		c.AuthorizedKeysDir = path
 	}
 
-	if c.AuthorizedKeysPath != "" {
-		path := c.AuthorizedKeysPath
-		if u, err := user.Current(); err == nil {
-			path = strings.Replace(path, "~", u.HomeDir, 1)
+	if c.TrustedUserCAKeysPath != "" {
+		path, err := existingPath("Trusted user CA keys file", c.TrustedUserCAKeysPath, false)
+		if err != nil {
+			return err
 		}
+		c.TrustedUserCAKeysPath = path
 
-		path, err := filepath.Abs(path)
+		// Check the keys in advance
+		if _, err = loadCAKeys(path); err != nil {
+			return err
+		}
+	}
+
+	if c.RevokedKeysPath != "" {
+		path, err := existingPath("Revoked keys file", c.RevokedKeysPath, false)
 		if err != nil {
 			return err
 		}
-		if _, err = os.Stat(path); err != nil {
-			return fmt.Errorf("Authorized keys file '%s' is not found", c.AuthorizedKeysPath)
+		c.RevokedKeysPath = path
+
+		// Check the list in advance
+		if _, err = loadRevocationList(path); err != nil {
+			return err
 		}
-		c.AuthorizedKeysPath = path
+	}
 
-	} else {
-		return fmt.Errorf("Authorized keys file is required")
+	if c.ACLFilePath != "" {
+		path, err := existingPath("ACL file", c.ACLFilePath, false)
+		if err != nil {
+			return err
+		}
+		c.ACLFilePath = path
+
+		// Check the rules in advance
+		if err = NewACL(path).Load(); err != nil {
+			return err
+		}
+	}
+
+	if c.TOTPFilePath != "" {
+		path, err := existingPath("TOTP file", c.TOTPFilePath, false)
+		if err != nil {
+			return err
+		}
+		c.TOTPFilePath = path
+
+		// Check the seeds in advance
+		if _, err = NewTOTP(path).Load(); err != nil {
+			return err
+		}
+	}
+
+	if c.TOTPUnenrolled, err = ParseTOTPUnenrolled(c.TOTPUnenrolled); err != nil {
+		return err
 	}
 
 	// Default timeout
@@ -144,10 +288,139 @@ func (c *Config) Init() (err error) {
 		c.SwiftTimeout = 180
 	}
 
+	// Segments of large objects
+	if c.SegmentSize == 0 {
+		c.SegmentSize = DefaultSegmentSize
+	} else if c.SegmentSize < 0 || c.SegmentSize > MaxSegmentSize {
+		return fmt.Errorf("Segment size must be between 1 and %d (MiB)", MaxSegmentSize)
+	}
+
+	if c.StorageCapacity < 0 {
+		return fmt.Errorf("Storage capacity must not be negative")
+	}
+	if c.ListMetadataLimit < 0 {
+		return fmt.Errorf("List metadata limit must not be negative")
+	}
+
+	// Access modes
+	if _, err = ParseAccessMode(c.AccessMode); err != nil {
+		return err
+	}
+	for username, mode := range c.UserAccessModes {
+		if _, err = ParseAccessMode(mode); err != nil {
+			return fmt.Errorf("User '%s': %v", username, err)
+		}
+	}
+	for group, mode := range c.GroupAccessModes {
+		if _, err = ParseAccessMode(mode); err != nil {
+			return fmt.Errorf("Group '%s': %v", group, err)
+		}
+	}
+
+	// LDAP
+	if c.LDAP.URL != "" {
+		if c.LDAP.CACertPath != "" {
+			if c.LDAP.CACertPath, err = existingPath("LDAP CA certificate file", c.LDAP.CACertPath, false); err != nil {
+				return err
+			}
+		}
+
+		if err = c.LDAP.Init(); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
+// SegmentContainerName returns the container for the segments of Static Large Objects.
+func (c *Config) SegmentContainerName() string {
+	if c.SegmentContainer != "" {
+		return c.SegmentContainer
+	}
+	return c.Container + "_segments"
+}
+
+// UserContainer returns the container for the user.
+// If the user is not in the map, the container of the first group in the map is used.
+func (c *Config) UserContainer(username string, groups ...string) string {
+	if container, ok := c.UserContainers[username]; ok {
+		return container
+	}
+	if container, ok := groupValue(c.GroupContainers, groups); ok {
+		return container
+	}
+	return c.Container
+}
+
+// UserAccessMode returns the access mode of the user.
+// The modes are validated in Init(), so the invalid mode falls back to read-only.
+func (c *Config) UserAccessMode(username string, groups ...string) AccessMode {
+	s := c.AccessMode
+	if m, ok := c.UserAccessModes[username]; ok {
+		s = m
+	} else if m, ok := groupValue(c.GroupAccessModes, groups); ok {
+		s = m
+	}
+
+	mode, err := ParseAccessMode(s)
+	if err != nil {
+		return AccessReadOnly
+	}
+	return mode
+}
+
+// UserHomeDirectory returns the home directory of the user in the container.
+// The home directory of the first group in the map is used instead of HomeDirectory.
+func (c *Config) UserHomeDirectory(username string, groups ...string) (string, error) {
+	home := c.HomeDirectory
+	if dir, ok := groupValue(c.GroupHomeDirectories, groups); ok {
+		home = dir
+	}
+
+	if strings.Contains(home, "%u") {
+		// The username must not change the depth of the directory
+		if username == "" || username == "." || username == ".." || strings.Contains(username, Delimiter) {
+			return "", fmt.Errorf("Username '%s' is not allowed for home directory", username)
+		}
+	}
+
+	dir := strings.Replace(home, "%u", username, -1)
+	return strings.Trim(path.Clean(Delimiter+dir), Delimiter), nil
+}
+
+// groupValue returns the value of the first group that is in the map.
+func groupValue(m map[string]string, groups []string) (string, bool) {
+	for _, g := range groups {
+		if v, ok := m[g]; ok {
+			return v, true
+		}
+	}
+	return "", false
+}
+
 // Generate ECDSA private key
+// absPath expands "~" to the home directory and returns the absolute path.
+func absPath(path string) (string, error) {
+	if u, err := user.Current(); err == nil {
+		path = strings.Replace(path, "~", u.HomeDir, 1)
+	}
+	return filepath.Abs(path)
+}
+
+// existingPath returns the absolute path of the file, or the directory if dir is true.
+// name is the description of the path in the error.
+func existingPath(name, path string, dir bool) (string, error) {
+	abs, err := absPath(path)
+	if err != nil {
+		return "", err
+	}
+	if s, err := os.Stat(abs); err != nil || (dir && !s.IsDir()) {
+		return "", fmt.Errorf("%s '%s' is not found", name, path)
+	}
+	return abs, nil
+}
+
 func (c *Config) generatePrivateKey(path string) error {
 	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
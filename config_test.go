@@ -3,6 +3,8 @@ package main
 import (
 	"flag"
 	"fmt"
+	"os/user"
+	"path/filepath"
 	"reflect"
 	"testing"
 
@@ -25,7 +27,10 @@ func TestInitFromFile(t *testing.T) {
 		"BindAddress",
 		"AuthorizedKeysPath",
 		"Container",
+		"Backend",
 		"SwiftTimeout",
+		"SegmentSize",
+		"SegmentContainer",
 		"OsIdentityEndpoint",
 		"OsUserID",
 		"OsUsername",
@@ -46,11 +51,14 @@ func TestInitFromContext(t *testing.T) {
 	set := flag.NewFlagSet("test", flag.ContinueOnError)
 	set.Bool("debug,d", false, "")
 	set.String("container", "ojs-test-container", "")
+	set.String("backend", "swift", "")
 	set.String("address", "127.0.0.1:20022", "")
 	set.String("password-file", "misc/testing/dummypasswd", "")
 	set.String("server-key", "server.key", "")
 	set.String("authorized-keys", "misc/testing/authorized_keys", "")
 	set.Int("swift-timeout", 60, "")
+	set.Int("segment-size", 512, "")
+	set.String("segment-container", "ojs-test-container_segments", "")
 	set.Parse([]string{
 		"ojs-test-container",
 	})
@@ -68,7 +76,10 @@ func TestInitFromContext(t *testing.T) {
 		"BindAddress",
 		"AuthorizedKeysPath",
 		"Container",
+		"Backend",
 		"SwiftTimeout",
+		"SegmentSize",
+		"SegmentContainer",
 	}
 
 	if err := checkInitializedConfig(c, targets); err != nil {
@@ -114,3 +125,155 @@ func checkInitializedConfig(c1 Config, targets []string) error {
 	}
 	return nil
 }
+
+func TestExistingPath(t *testing.T) {
+	abs, _ := filepath.Abs("misc/swift-sftp.conf")
+	if path, err := existingPath("Config file", "misc/swift-sftp.conf", false); err != nil || path != abs {
+		t.Errorf("Wrong path '%s' [%v]", path, err)
+	}
+
+	abs, _ = filepath.Abs("misc")
+	if path, err := existingPath("Directory", "misc", true); err != nil || path != abs {
+		t.Errorf("Wrong path '%s' [%v]", path, err)
+	}
+
+	if _, err := existingPath("Directory", "misc/swift-sftp.conf", true); err == nil {
+		t.Errorf("File should be rejected as the directory")
+	}
+	if _, err := existingPath("Config file", "misc/missing.conf", false); err == nil || err.Error() != "Config file 'misc/missing.conf' is not found" {
+		t.Errorf("Wrong error [%v]", err)
+	}
+
+	if u, err := user.Current(); err == nil {
+		if path, err := absPath("~/.ssh/authorized_keys"); err != nil || path != filepath.Join(u.HomeDir, ".ssh/authorized_keys") {
+			t.Errorf("Home directory should be expanded '%s' [%v]", path, err)
+		}
+	}
+}
+
+func TestUserHomeDirectory(t *testing.T) {
+	c := Config{HomeDirectory: "partners/%u/"}
+
+	if dir, err := c.UserHomeDirectory("alice"); err != nil || dir != "partners/alice" {
+		t.Errorf("Wrong home directory '%s' [%v]", dir, err)
+	}
+
+	for _, username := range []string{"..", "alice/../bob", ""} {
+		if _, err := c.UserHomeDirectory(username); err == nil {
+			t.Errorf("Username '%s' should be rejected", username)
+		}
+	}
+
+	c.HomeDirectory = ""
+	if dir, err := c.UserHomeDirectory("alice"); err != nil || dir != "" {
+		t.Errorf("Home directory should be the container root '%s' [%v]", dir, err)
+	}
+}
+
+func TestUserContainer(t *testing.T) {
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	set.Var(&cli.StringSlice{"alice=tenant-a", "bob=tenant-b"}, "user-container", "")
+	ctx := cli.NewContext(cli.NewApp(), set, nil)
+
+	c := Config{}
+	if err := c.LoadFromContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+	c.Container = "default-container"
+
+	tests := map[string]string{
+		"alice": "tenant-a",
+		"bob":   "tenant-b",
+		"carol": "default-container",
+	}
+	for username, expected := range tests {
+		if container := c.UserContainer(username); container != expected {
+			t.Errorf("Wrong container for '%s' (%s)", username, container)
+		}
+	}
+
+	set = flag.NewFlagSet("test", flag.ContinueOnError)
+	set.Var(&cli.StringSlice{"alice"}, "user-container", "")
+	ctx = cli.NewContext(cli.NewApp(), set, nil)
+	if err := c.LoadFromContext(ctx); err == nil {
+		t.Error("Invalid user container should be rejected")
+	}
+}
+
+func TestUserAccessMode(t *testing.T) {
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	set.String("access-mode", "read-only", "")
+	set.Var(&cli.StringSlice{"alice=read-write", "bob=write-only"}, "user-access-mode", "")
+	ctx := cli.NewContext(cli.NewApp(), set, nil)
+
+	c := Config{}
+	if err := c.LoadFromContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]AccessMode{
+		"alice": AccessReadWrite,
+		"bob":   AccessWriteOnly,
+		"carol": AccessReadOnly,
+	}
+	for username, expected := range tests {
+		if mode := c.UserAccessMode(username); mode != expected {
+			t.Errorf("Wrong access mode for '%s' (%s)", username, mode)
+		}
+	}
+
+	c.AccessMode = ""
+	if mode := c.UserAccessMode("carol"); mode != AccessReadWrite {
+		t.Errorf("Default access mode should be read-write (%s)", mode)
+	}
+
+	c.UserAccessModes["dave"] = "read-only-ish"
+	if _, err := ParseAccessMode(c.UserAccessModes["dave"]); err == nil {
+		t.Error("Invalid access mode should be rejected")
+	} else if mode := c.UserAccessMode("dave"); mode != AccessReadOnly {
+		t.Errorf("Invalid access mode should fall back to read-only (%s)", mode)
+	}
+}
+
+func TestGroupMapping(t *testing.T) {
+	c := Config{
+		Container:       "default-container",
+		AccessMode:      "read-only",
+		HomeDirectory:   "/home/%u",
+		UserContainers:  map[string]string{"alice": "tenant-a"},
+		UserAccessModes: map[string]string{"alice": "write-only"},
+		GroupContainers: map[string]string{
+			"sftp-admins": "admin-container",
+			"sftp-users":  "users-container",
+		},
+		GroupAccessModes:     map[string]string{"sftp-admins": "read-write"},
+		GroupHomeDirectories: map[string]string{"sftp-admins": "/"},
+	}
+
+	// The maps of the users take precedence over the groups.
+	if container := c.UserContainer("alice", "sftp-admins"); container != "tenant-a" {
+		t.Errorf("Wrong container '%s'", container)
+	}
+	if mode := c.UserAccessMode("alice", "sftp-admins"); mode != AccessWriteOnly {
+		t.Errorf("Wrong access mode '%s'", mode)
+	}
+
+	// The first group in the map is used.
+	if container := c.UserContainer("bob", "other", "sftp-users", "sftp-admins"); container != "users-container" {
+		t.Errorf("Wrong container '%s'", container)
+	}
+	if mode := c.UserAccessMode("bob", "sftp-users", "sftp-admins"); mode != AccessReadWrite {
+		t.Errorf("Wrong access mode '%s'", mode)
+	}
+	if dir, err := c.UserHomeDirectory("bob", "sftp-admins"); err != nil || dir != "" {
+		t.Errorf("Wrong home directory '%s' [%v]", dir, err)
+	}
+
+	// no groups
+	if container, mode := c.UserContainer("bob"), c.UserAccessMode("bob"); container != "default-container" || mode != AccessReadOnly {
+		t.Errorf("Wrong container '%s' or access mode '%s'", container, mode)
+	}
+	if dir, err := c.UserHomeDirectory("bob", "sftp-users"); err != nil || dir != "home/bob" {
+		t.Errorf("Wrong home directory '%s' [%v]", dir, err)
+	}
+}
@@ -15,7 +15,10 @@ func listContainer(ctx *cli.Context) (err error) {
 		return err
 	}
 
-	s := NewSwift(c)
+	s, err := NewObjectStore(c)
+	if err != nil {
+		return err
+	}
 	if err = s.Init(); err != nil {
 		return err
 	}
@@ -82,7 +85,10 @@ func createContainer(ctx *cli.Context) (err error) {
 	}
 	c.Container = ctx.Args()[0]
 
-	s := NewSwift(c)
+	s, err := NewObjectStore(c)
+	if err != nil {
+		return err
+	}
 	if err = s.Init(); err != nil {
 		return err
 	}
@@ -124,7 +130,10 @@ func deleteContainer(ctx *cli.Context) (err error) {
 		return nil
 	}
 
-	s := NewSwift(c)
+	s, err := NewObjectStore(c)
+	if err != nil {
+		return err
+	}
 	if err = s.Init(); err != nil {
 		return err
 	}
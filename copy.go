@@ -0,0 +1,451 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/pkg/sftp"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// copyFile copies the file with the server-side copy of the storage, so that the data doesn't go through swift-sftp.
+// If the client is writing dst, the file is replaced with the copy.
+func (fs *SwiftFS) copyFile(src, dst string) error {
+	unlock := fs.paths.Lock(fs.filepath2object(dst))
+	defer unlock()
+	return fs.copyLocked(src, dst)
+}
+
+// copyLocked is copyFile for the callers that hold the path lock of dst.
+func (fs *SwiftFS) copyLocked(src, dst string) error {
+	const method = "Copy"
+	fs.log.Infof("%s %s %s", method, src, dst)
+
+	if err := fs.permit(method, src, fs.mode.CanRead()); err != nil {
+		return err
+	} else if err = fs.permit(method, dst, fs.mode.CanWrite()); err != nil {
+		return err
+	} else if err = fs.authorize(method, src, ACLRead); err != nil {
+		return err
+	} else if err = fs.authorize(method, dst, ACLWrite); err != nil {
+		return err
+	}
+
+	f, err := fs.lookup(src)
+	if err != nil || f == nil {
+		if err == nil {
+			err = ErrObjectNotFound
+		}
+		return fs.sftpError(src, err)
+	} else if f.IsDir() {
+		fs.log.Warnf("%s Is a directory", src)
+		return sftp.ErrSshFxFailure
+	}
+
+	// The file that the symlink points to must be also readable.
+	if err = fs.authorizeResolved(method, src, f, ACLRead); err != nil {
+		return err
+	}
+
+	name := fs.filepath2object(dst)
+	if d, err := fs.lookupLink(dst); name == fs.home || (err == nil && d != nil && d.IsDir()) {
+		fs.log.Warnf("%s Is a directory", dst)
+		return sftp.ErrSshFxFailure
+	}
+
+	put := func() error {
+		return fs.store.Copy(f.objectname, name)
+	}
+
+	fs.writingsLock.Lock()
+	w, ok := fs.writings[name]
+	fs.writingsLock.Unlock()
+	if ok {
+		err = w.replace(put)
+	} else {
+		err = put()
+	}
+	if err != nil {
+		return fs.sftpError(dst, err)
+	}
+
+	fs.log.Infof("'%s' was copied to '%s'", f.Name(), dst)
+	return nil
+}
+
+// The packet types of SFTP that copyDataChannel looks into
+const (
+	fxpVersion  = 2
+	fxpOpen     = 3
+	fxpClose    = 4
+	fxpStatus   = 101
+	fxpHandle   = 102
+	fxpExtended = 200
+)
+
+// Max length of the packets that the client sends (same as pkg/sftp)
+const maxPacketLength = 256 * 1024
+
+// copyDataChannel wraps the channel of SFTP session to support "copy-data" extension,
+// because pkg/sftp ignores the unknown extended requests. It adds the extension to SSH_FXP_VERSION,
+// follows the paths of the handles, and answers copy-data requests by itself with SwiftFS.copyFile.
+//
+// Only the whole file can be copied (offsets and length are 0), which is what "cp" of OpenSSH's sftp does.
+type copyDataChannel struct {
+	io.ReadWriteCloser
+	fs  *SwiftFS
+	log *logrus.Entry
+
+	incoming []byte // rest of the packet that pkg/sftp is reading
+	outgoing []byte // packet that pkg/sftp is writing
+
+	writeLock sync.Mutex
+	m         sync.Mutex
+	opening   map[uint32]string // request ID of SSH_FXP_OPEN -> path
+	handles   map[string]string // handle -> path
+
+	copying sync.WaitGroup // copy-data requests that are running
+}
+
+func newCopyDataChannel(rwc io.ReadWriteCloser, fs *SwiftFS, log *logrus.Entry) *copyDataChannel {
+	return &copyDataChannel{
+		ReadWriteCloser: rwc,
+		fs:              fs,
+		log:             log,
+		opening:         map[uint32]string{},
+		handles:         map[string]string{},
+	}
+}
+
+// Read returns the packets from the client except copy-data requests.
+func (c *copyDataChannel) Read(p []byte) (int, error) {
+	for len(c.incoming) == 0 {
+		pkt, err := c.readPacket()
+		if err != nil {
+			// The session ends after the status of the copies is sent.
+			c.copying.Wait()
+			return 0, err
+		}
+
+		if !c.filterIn(pkt) {
+			c.incoming = pkt
+		}
+	}
+
+	n := copy(p, c.incoming)
+	c.incoming = c.incoming[n:]
+	return n, nil
+}
+
+func (c *copyDataChannel) readPacket() ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(c.ReadWriteCloser, header); err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint32(header)
+	if length == 0 || length > maxPacketLength {
+		return nil, fmt.Errorf("Invalid length of the packet (length=%d)", length)
+	}
+
+	pkt := make([]byte, 4+length)
+	copy(pkt, header)
+	if _, err := io.ReadFull(c.ReadWriteCloser, pkt[4:]); err != nil {
+		return nil, err
+	}
+	return pkt, nil
+}
+
+// filterIn looks into the packet from the client. It returns true if the packet has been handled.
+func (c *copyDataChannel) filterIn(pkt []byte) bool {
+	b := pkt[5:]
+	switch pkt[4] {
+	case fxpOpen:
+		id, b, ok := unmarshalUint32(b)
+		filename, _, ok2 := unmarshalString(b)
+		if ok && ok2 {
+			c.m.Lock()
+			c.opening[id] = filename
+			c.m.Unlock()
+		}
+
+	case fxpClose:
+		if _, b, ok := unmarshalUint32(b); ok {
+			if handle, _, ok := unmarshalString(b); ok {
+				c.m.Lock()
+				delete(c.handles, handle)
+				c.m.Unlock()
+			}
+		}
+
+	case fxpExtended:
+		id, b, ok := unmarshalUint32(b)
+		name, b, ok2 := unmarshalString(b)
+		if ok && ok2 && name == "copy-data" {
+			c.copyData(id, b)
+			return true
+		}
+	}
+	return false
+}
+
+// Write sends the packets from pkg/sftp to the client. pkg/sftp may write a packet in several calls.
+func (c *copyDataChannel) Write(p []byte) (int, error) {
+	c.outgoing = append(c.outgoing, p...)
+	for len(c.outgoing) >= 4 {
+		n := 4 + int(binary.BigEndian.Uint32(c.outgoing))
+		if len(c.outgoing) < n {
+			break
+		}
+
+		if err := c.send(c.filterOut(c.outgoing[:n])); err != nil {
+			return 0, err
+		}
+		c.outgoing = c.outgoing[n:]
+	}
+	return len(p), nil
+}
+
+// filterOut looks into the packet to the client, and returns the packet to send.
+func (c *copyDataChannel) filterOut(pkt []byte) []byte {
+	switch pkt[4] {
+	case fxpVersion:
+		pkt = append(append([]byte{}, pkt...), marshalString(marshalString(nil, "copy-data"), "1")...)
+		binary.BigEndian.PutUint32(pkt, uint32(len(pkt)-4))
+
+	case fxpHandle:
+		id, b, ok := unmarshalUint32(pkt[5:])
+		handle, _, ok2 := unmarshalString(b)
+		c.m.Lock()
+		if p, opening := c.opening[id]; ok && ok2 && opening {
+			c.handles[handle] = p
+			delete(c.opening, id)
+		}
+		c.m.Unlock()
+
+	case fxpStatus:
+		// SSH_FXP_OPEN failed
+		if id, _, ok := unmarshalUint32(pkt[5:]); ok {
+			c.m.Lock()
+			delete(c.opening, id)
+			c.m.Unlock()
+		}
+	}
+	return pkt
+}
+
+func (c *copyDataChannel) send(pkt []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	_, err := c.ReadWriteCloser.Write(pkt)
+	return err
+}
+
+// copyData handles copy-data request and sends the status. The copy runs in the background,
+// so that it doesn't block the other requests of the session.
+//
+//	string read-from-handle
+//	uint64 read-from-offset
+//	uint64 read-data-length (0 means to the end of the file)
+//	string write-to-handle
+//	uint64 write-to-offset
+func (c *copyDataChannel) copyData(id uint32, b []byte) {
+	readHandle, b, ok1 := unmarshalString(b)
+	readOffset, b, ok2 := unmarshalUint64(b)
+	length, b, ok3 := unmarshalUint64(b)
+	writeHandle, b, ok4 := unmarshalString(b)
+	writeOffset, _, ok5 := unmarshalUint64(b)
+
+	c.m.Lock()
+	src, srcOk := c.handles[readHandle]
+	dst, dstOk := c.handles[writeHandle]
+	c.m.Unlock()
+
+	var err error
+	switch {
+	case !(ok1 && ok2 && ok3 && ok4 && ok5):
+		c.log.Warnf("copy-data Invalid request")
+		err = sftp.ErrSshFxFailure
+	case !srcOk || !dstOk:
+		c.log.Warnf("copy-data Invalid handle")
+		err = sftp.ErrSshFxFailure
+	case readOffset != 0 || length != 0 || writeOffset != 0:
+		c.log.Warnf("copy-data %s %s Partial copy is not supported (offset=%d, length=%d, write-offset=%d)",
+			src, dst, readOffset, length, writeOffset)
+		err = sftp.ErrSshFxOpUnsupported
+	default:
+		// dst is locked before the copy starts, so that the following commands on it wait for the copy.
+		unlock := c.fs.paths.Lock(c.fs.filepath2object(dst))
+		c.copying.Add(1)
+		go func() {
+			defer c.copying.Done()
+			defer unlock()
+			c.sendStatus(id, c.fs.copyLocked(src, dst))
+		}()
+		return
+	}
+	c.sendStatus(id, err)
+}
+
+func (c *copyDataChannel) sendStatus(id uint32, err error) {
+	if err = c.send(statusPacket(id, err)); err != nil {
+		c.log.Warnf("%s", err.Error())
+	}
+}
+
+// statusPacket returns SSH_FXP_STATUS for the error that SwiftFS returned.
+func statusPacket(id uint32, err error) []byte {
+	var code uint32
+	msg := "Success"
+	if err != nil {
+		msg = err.Error()
+		switch err {
+		case sftp.ErrSshFxNoSuchFile:
+			code = 2
+		case sftp.ErrSshFxPermissionDenied:
+			code = 3
+		case sftp.ErrSshFxOpUnsupported:
+			code = 8
+		case errFileAlreadyExists:
+			code = 11
+		default:
+			code = 4 // SSH_FX_FAILURE
+		}
+	}
+
+	pkt := make([]byte, 4, 64)
+	pkt = append(pkt, fxpStatus)
+	pkt = marshalUint32(pkt, id)
+	pkt = marshalUint32(pkt, code)
+	pkt = marshalString(marshalString(pkt, msg), "")
+	binary.BigEndian.PutUint32(pkt, uint32(len(pkt)-4))
+	return pkt
+}
+
+func unmarshalUint32(b []byte) (uint32, []byte, bool) {
+	if len(b) < 4 {
+		return 0, b, false
+	}
+	return binary.BigEndian.Uint32(b), b[4:], true
+}
+
+func unmarshalUint64(b []byte) (uint64, []byte, bool) {
+	if len(b) < 8 {
+		return 0, b, false
+	}
+	return binary.BigEndian.Uint64(b), b[8:], true
+}
+
+func unmarshalString(b []byte) (string, []byte, bool) {
+	n, b, ok := unmarshalUint32(b)
+	if !ok || uint32(len(b)) < n {
+		return "", b, false
+	}
+	return string(b[:n]), b[n:], true
+}
+
+func marshalUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func marshalString(b []byte, s string) []byte {
+	return append(marshalUint32(b, uint32(len(s))), s...)
+}
+
+// cpCommand is the command line of cp that copies the files with the server-side copy.
+type cpCommand struct {
+	sources []string
+	target  string
+}
+
+// parseCpCommand parses the command of the exec request. The attributes are always copied,
+// so -p is accepted but does nothing.
+func parseCpCommand(command string) (*cpCommand, error) {
+	args, err := splitCommand(command)
+	if err != nil {
+		return nil, err
+	} else if len(args) == 0 || commandName(command) != "cp" {
+		return nil, fmt.Errorf("Unsupported command '%s'", command)
+	}
+
+	i := 1
+	for ; i < len(args) && strings.HasPrefix(args[i], "-"); i++ {
+		if args[i] == "--" {
+			i++
+			break
+		}
+
+		for _, c := range args[i][1:] {
+			switch c {
+			case 'p', 'f':
+				// The attributes are copied, and the files are overwritten.
+			default:
+				return nil, fmt.Errorf("Unsupported option '-%c' of cp", c)
+			}
+		}
+	}
+
+	paths := args[i:]
+	if len(paths) < 2 {
+		return nil, errors.New("Missing destination file of cp")
+	}
+	return &cpCommand{
+		sources: paths[:len(paths)-1],
+		target:  paths[len(paths)-1],
+	}, nil
+}
+
+// StartCpSession copies the files for "exec cp" request. It returns the exit status for the client.
+func StartCpSession(conf Config, store ObjectStore, channel ssh.Channel, client *Client, cmd *cpCommand) (status int, err error) {
+	// logger with client
+	clog := log.WithFields(logrus.Fields{
+		"client": client,
+	})
+
+	clog.Debug("Starting cp session.")
+
+	fs, err := newSessionFS(conf, store, client, clog)
+	if err != nil {
+		return 1, err
+	}
+
+	if !runCp(fs, cmd, channel.Stderr()) {
+		status = 1
+	}
+
+	clog.Debugf("End cp session (status=%d)", status)
+	return status, nil
+}
+
+// runCp copies the files and writes the errors like cp does. It returns false if some files couldn't be copied.
+func runCp(fs *SwiftFS, cmd *cpCommand, stderr io.Writer) bool {
+	targetIsDir := false
+	if fi, err := fs.stat(cmd.target); err == nil {
+		targetIsDir = fi.IsDir()
+	}
+	if len(cmd.sources) > 1 && !targetIsDir {
+		fmt.Fprintf(stderr, "cp: target '%s' is not a directory\n", cmd.target)
+		return false
+	}
+
+	ok := true
+	for _, src := range cmd.sources {
+		dst := cmd.target
+		if targetIsDir {
+			dst = path.Join(cmd.target, path.Base(src))
+		}
+
+		if err := fs.copyFile(src, dst); err != nil {
+			fmt.Fprintf(stderr, "cp: cannot copy '%s' to '%s': %v\n", src, dst, err)
+			ok = false
+		}
+	}
+	return ok
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pkg/sftp"
+)
+
+func TestParseCpCommand(t *testing.T) {
+	tests := map[string]*cpCommand{
+		"cp /a.txt /b.txt":           {sources: []string{"/a.txt"}, target: "/b.txt"},
+		"/bin/cp -pf -- a 'b c' dir": {sources: []string{"a", "b c"}, target: "dir"},
+		"cp -r /dir /dir2":           nil,
+		"cp /a.txt":                  nil,
+		"mv /a.txt /b.txt":           nil,
+	}
+
+	for command, expected := range tests {
+		cmd, err := parseCpCommand(command)
+		if expected == nil {
+			if err == nil {
+				t.Errorf("'%s' should be rejected", command)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("'%s' should be accepted [%v]", command, err)
+		} else if !reflect.DeepEqual(cmd, expected) {
+			t.Errorf("'%s' was parsed wrongly %+v", command, cmd)
+		}
+	}
+}
+
+// sftpPacketForTesting returns the packet with the ID and the fields (uint32, uint64 or string).
+func sftpPacketForTesting(typ byte, id uint32, fields ...interface{}) []byte {
+	pkt := marshalUint32(append(make([]byte, 4), typ), id)
+	for _, f := range fields {
+		switch v := f.(type) {
+		case uint32:
+			pkt = marshalUint32(pkt, v)
+		case uint64:
+			pkt = marshalUint32(marshalUint32(pkt, uint32(v>>32)), uint32(v))
+		case string:
+			pkt = marshalString(pkt, v)
+		}
+	}
+	binary.BigEndian.PutUint32(pkt, uint32(len(pkt)-4))
+	return pkt
+}
+
+// sftpRoundTripForTesting sends the packet and returns the type and the payload after the ID of the response.
+func sftpRoundTripForTesting(t *testing.T, conn net.Conn, pkt []byte) (byte, []byte) {
+	if _, err := conn.Write(pkt); err != nil {
+		t.Fatal(err)
+	}
+	return sftpReadForTesting(t, conn)
+}
+
+// sftpReadForTesting returns the type and the payload after the ID of the next response.
+func sftpReadForTesting(t *testing.T, conn net.Conn) (byte, []byte) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Fatal(err)
+	}
+	res := make([]byte, binary.BigEndian.Uint32(header))
+	if _, err := io.ReadFull(conn, res); err != nil {
+		t.Fatal(err)
+	}
+	return res[0], res[5:]
+}
+
+func sftpOpenForTesting(t *testing.T, conn net.Conn, id uint32, path string, pflags uint32) string {
+	typ, res := sftpRoundTripForTesting(t, conn, sftpPacketForTesting(fxpOpen, id, path, pflags, uint32(0)))
+	if typ != fxpHandle {
+		t.Fatalf("Couldn't open '%s' (type=%d)", path, typ)
+	}
+	handle, _, _ := unmarshalString(res)
+	return handle
+}
+
+func sftpStatusForTesting(t *testing.T, conn net.Conn, pkt []byte) uint32 {
+	typ, res := sftpRoundTripForTesting(t, conn, pkt)
+	if typ != fxpStatus {
+		t.Fatalf("Wrong response (type=%d)", typ)
+	}
+	code, _, _ := unmarshalUint32(res)
+	return code
+}
+
+func TestCopyData(t *testing.T) {
+	s := storeForTesting()
+	fs := NewSwiftFS(s, defaultConfigForTesting())
+
+	if err := s.Put("copy-data-src.txt", bytes.NewReader([]byte("copy-data"))); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Delete("copy-data-src.txt")
+	defer s.Delete("copy-data-dst.txt")
+
+	conn, serverConn := net.Pipe()
+	defer conn.Close()
+
+	handlers := sftp.Handlers{FileGet: fs, FilePut: fs, FileCmd: fs, FileList: fs}
+	server := sftp.NewRequestServer(newCopyDataChannel(serverConn, fs, log.WithField("test", true)), handlers)
+	go server.Serve()
+	defer server.Close()
+
+	// The extension is added to SSH_FXP_VERSION.
+	init := append(make([]byte, 4), 1)
+	init = marshalUint32(init, 3)
+	binary.BigEndian.PutUint32(init, uint32(len(init)-4))
+	if typ, res := sftpRoundTripForTesting(t, conn, init); typ != fxpVersion || !bytes.Contains(res, []byte("\x00\x00\x00\x09copy-data\x00\x00\x00\x011")) {
+		t.Fatalf("copy-data should be in the extensions (type=%d) %q", typ, res)
+	}
+
+	src := sftpOpenForTesting(t, conn, 1, "/copy-data-src.txt", 0x01)
+	dst := sftpOpenForTesting(t, conn, 2, "/copy-data-dst.txt", 0x02|0x08|0x10)
+
+	// partial copy is not supported
+	if code := sftpStatusForTesting(t, conn, sftpPacketForTesting(fxpExtended, 3, "copy-data", src, uint64(1), uint64(0), dst, uint64(0))); code != 8 {
+		t.Errorf("Partial copy should be unsupported (status=%d)", code)
+	}
+	if code := sftpStatusForTesting(t, conn, sftpPacketForTesting(fxpExtended, 4, "copy-data", "unknown", uint64(0), uint64(0), dst, uint64(0))); code != 4 {
+		t.Errorf("Unknown handle should fail (status=%d)", code)
+	}
+
+	if code := sftpStatusForTesting(t, conn, sftpPacketForTesting(fxpExtended, 5, "copy-data", src, uint64(0), uint64(0), dst, uint64(0))); code != 0 {
+		t.Fatalf("copy-data failed (status=%d)", code)
+	}
+	for i, handle := range []string{src, dst} {
+		if code := sftpStatusForTesting(t, conn, sftpPacketForTesting(fxpClose, uint32(6+i), handle)); code != 0 {
+			t.Errorf("Close failed (status=%d)", code)
+		}
+	}
+
+	// Closing the handle doesn't overwrite the copy.
+	r, _, err := s.Download("copy-data-dst.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := ioutil.ReadAll(r)
+	r.Close()
+	if string(content) != "copy-data" {
+		t.Errorf("Wrong content '%s'", content)
+	}
+}
+
+// blockingCopyStore blocks the server-side copy until it's released.
+type blockingCopyStore struct {
+	ObjectStore
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingCopyStore) Copy(src, dst string) error {
+	close(s.started)
+	<-s.release
+	return s.ObjectStore.Copy(src, dst)
+}
+
+func TestCopyDataInBackground(t *testing.T) {
+	s := &blockingCopyStore{
+		ObjectStore: storeForTesting(),
+		started:     make(chan struct{}),
+		release:     make(chan struct{}),
+	}
+	fs := NewSwiftFS(s, defaultConfigForTesting())
+
+	if err := s.Put("copy-data-src.txt", bytes.NewReader([]byte("copy-data"))); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Delete("copy-data-src.txt")
+	defer s.Delete("copy-data-dst.txt")
+
+	conn, serverConn := net.Pipe()
+	defer conn.Close()
+
+	handlers := sftp.Handlers{FileGet: fs, FilePut: fs, FileCmd: fs, FileList: fs}
+	server := sftp.NewRequestServer(newCopyDataChannel(serverConn, fs, log.WithField("test", true)), handlers)
+	go server.Serve()
+	defer server.Close()
+
+	init := append(make([]byte, 4), 1)
+	init = marshalUint32(init, 3)
+	binary.BigEndian.PutUint32(init, uint32(len(init)-4))
+	sftpRoundTripForTesting(t, conn, init)
+
+	src := sftpOpenForTesting(t, conn, 1, "/copy-data-src.txt", 0x01)
+	dst := sftpOpenForTesting(t, conn, 2, "/copy-data-dst.txt", 0x02|0x08|0x10)
+
+	if _, err := conn.Write(sftpPacketForTesting(fxpExtended, 3, "copy-data", src, uint64(0), uint64(0), dst, uint64(0))); err != nil {
+		t.Fatal(err)
+	}
+	<-s.started
+
+	// The other requests are answered during the copy.
+	other := sftpOpenForTesting(t, conn, 4, "/copy-data-src.txt", 0x01)
+	if code := sftpStatusForTesting(t, conn, sftpPacketForTesting(fxpClose, 5, other)); code != 0 {
+		t.Errorf("Close failed (status=%d)", code)
+	}
+
+	close(s.release)
+	typ, res := sftpReadForTesting(t, conn)
+	if code, _, _ := unmarshalUint32(res); typ != fxpStatus || code != 0 {
+		t.Fatalf("copy-data failed (type=%d, status=%d)", typ, code)
+	}
+	for i, handle := range []string{src, dst} {
+		if code := sftpStatusForTesting(t, conn, sftpPacketForTesting(fxpClose, uint32(6+i), handle)); code != 0 {
+			t.Errorf("Close failed (status=%d)", code)
+		}
+	}
+
+	r, _, err := s.Download("copy-data-dst.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := ioutil.ReadAll(r)
+	r.Close()
+	if string(content) != "copy-data" {
+		t.Errorf("Wrong content '%s'", content)
+	}
+}
+
+func TestCp(t *testing.T) {
+	s := storeForTesting()
+	fs := NewSwiftFS(s, defaultConfigForTesting())
+
+	if err := s.Put("cp-test/a.txt", bytes.NewReader([]byte("a"))); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Delete("cp-test/a.txt")
+	if err := fs.Filecmd(sftp.NewRequest("Mkdir", "/cp-test/dir")); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Delete("cp-test/dir/")
+	defer s.Delete("cp-test/dir/a.txt")
+	defer s.Delete("cp-test/b.txt")
+
+	stderr := new(bytes.Buffer)
+	if !runCp(fs, &cpCommand{sources: []string{"/cp-test/a.txt"}, target: "/cp-test/b.txt"}, stderr) {
+		t.Errorf("Copy failed [%s]", stderr)
+	}
+	if !runCp(fs, &cpCommand{sources: []string{"/cp-test/a.txt", "/cp-test/b.txt"}, target: "/cp-test/dir"}, stderr) {
+		t.Errorf("Copy to the directory failed [%s]", stderr)
+	}
+	for _, name := range []string{"cp-test/b.txt", "cp-test/dir/a.txt", "cp-test/dir/b.txt"} {
+		if _, err := s.Get(name); err != nil {
+			t.Errorf("'%s' should be copied [%v]", name, err)
+		}
+	}
+	s.Delete("cp-test/dir/b.txt")
+
+	// errors
+	for _, cmd := range []*cpCommand{
+		{sources: []string{"/cp-test/a.txt", "/cp-test/b.txt"}, target: "/cp-test/c.txt"},
+		{sources: []string{"/cp-test/missing.txt"}, target: "/cp-test/c.txt"},
+		{sources: []string{"/cp-test/dir"}, target: "/cp-test/c.txt"},
+	} {
+		stderr.Reset()
+		if runCp(fs, cmd, stderr) || !strings.HasPrefix(stderr.String(), "cp: ") {
+			t.Errorf("Copy should fail %+v [%s]", cmd, stderr)
+		}
+	}
+	if _, err := s.Get("cp-test/c.txt"); err != ErrObjectNotFound {
+		t.Errorf("Nothing should be copied [%v]", err)
+	}
+
+	fs.SetAccessMode(AccessReadOnly)
+	if runCp(fs, &cpCommand{sources: []string{"/cp-test/a.txt"}, target: "/cp-test/c.txt"}, stderr) {
+		t.Errorf("Read-only user should not copy the file")
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path"
+
+	"github.com/pkg/sftp"
+)
+
+// splitCommand splits the command line of the exec request into the arguments like shell does.
+// The clients quote the paths with single quotes, double quotes or backslashes.
+func splitCommand(command string) ([]string, error) {
+	args := []string{}
+	var arg []rune
+	inArg := false
+	var quote rune
+
+	runes := []rune(command)
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+		switch {
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				arg = append(arg, c)
+			}
+		case c == '\\' && quote != '\'':
+			if i+1 >= len(runes) {
+				return nil, errors.New("Unexpected end of the command")
+			}
+			i++
+			arg = append(arg, runes[i])
+			inArg = true
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+			} else {
+				arg = append(arg, c)
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			inArg = true
+		case c == ' ' || c == '\t':
+			if inArg {
+				args = append(args, string(arg))
+				arg = arg[:0]
+				inArg = false
+			}
+		default:
+			arg = append(arg, c)
+			inArg = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, errors.New("Unterminated quote in the command")
+	} else if inArg {
+		args = append(args, string(arg))
+	}
+	return args, nil
+}
+
+// commandName returns the name of the command without the directory (e.g. "scp" for "/usr/bin/scp -t /").
+// It's empty if the command line is broken.
+func commandName(command string) string {
+	args, err := splitCommand(command)
+	if err != nil || len(args) == 0 {
+		return ""
+	}
+	return path.Base(args[0])
+}
+
+// stat returns the file through Stat request, so that the commands follow the same access mode and ACL as SFTP.
+func (fs *SwiftFS) stat(p string) (os.FileInfo, error) {
+	l, err := fs.Filelist(sftp.NewRequest("Stat", p))
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]os.FileInfo, 1)
+	if n, _ := l.ListAt(list, 0); n == 0 {
+		return nil, sftp.ErrSshFxNoSuchFile
+	}
+	return list[0], nil
+}
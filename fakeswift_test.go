@@ -0,0 +1,855 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	fakeSwiftAccount = "AUTH_test"
+	fakeSwiftToken   = "fake-swift-token"
+	fakeSwiftUser    = "test"
+	fakeSwiftPass    = "test"
+	fakeSwiftDomain  = "Default"
+	fakeSwiftTenant  = "test"
+)
+
+// fakeSwift is an in-process fake of Keystone v3 and Swift API.
+// The tests run against it unless TEST_REAL_SWIFT is set.
+type fakeSwift struct {
+	*httptest.Server
+
+	// Max number of entries in one listing page (Swift's default is 10,000)
+	listLimit int
+
+	lock            sync.Mutex
+	containers      map[string]*fakeContainer
+	accountMetadata map[string]string
+
+	// status codes that are returned for the objects ("container/object")
+	faults map[string]int
+
+	// number of the tokens that have been issued
+	tokens int
+
+	// number of HEAD requests for the objects
+	heads int
+}
+
+type fakeContainer struct {
+	metadata map[string]string
+	objects  map[string]*fakeObject
+}
+
+type fakeObject struct {
+	data         []byte
+	contentType  string
+	lastModified time.Time
+	metadata     map[string]string
+
+	// "container/object" that the symlink points to
+	symlinkTarget string
+
+	// Static Large Object
+	segments []fakeSegment
+	sloEtag  string
+}
+
+// fakeSegment is an entry of SLO manifest
+type fakeSegment struct {
+	Path string `json:"path"`
+	Etag string `json:"etag"`
+	Size int64  `json:"size_bytes"`
+}
+
+func newFakeSwift() *fakeSwift {
+	fs := &fakeSwift{
+		listLimit:       10000,
+		containers:      map[string]*fakeContainer{},
+		accountMetadata: map[string]string{},
+		faults:          map[string]int{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v3/auth/tokens", fs.handleToken)
+	mux.HandleFunc("/v1/", fs.handleSwift)
+	fs.Server = httptest.NewServer(mux)
+
+	return fs
+}
+
+// IdentityEndpoint returns the URL to be set to os_identity_endpoint.
+func (fs *fakeSwift) IdentityEndpoint() string {
+	return fs.URL + "/v3"
+}
+
+// countObjects returns the number of the objects in the container.
+func (fs *fakeSwift) countObjects(container string) int {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	c, ok := fs.containers[container]
+	if !ok {
+		return 0
+	}
+	return len(c.objects)
+}
+
+// setMetadata sets the metadata of the container like quotas. If container is empty, it's set to the account.
+func (fs *fakeSwift) setMetadata(container string, metadata map[string]string) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	target := fs.accountMetadata
+	if container != "" {
+		target = fs.containers[container].metadata
+	}
+	for k, v := range metadata {
+		if v == "" {
+			delete(target, k)
+		} else {
+			target[k] = v
+		}
+	}
+}
+
+// issuedTokens returns the number of the tokens that have been issued.
+func (fs *fakeSwift) issuedTokens() int {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	return fs.tokens
+}
+
+// headRequests returns the number of HEAD requests for the objects.
+func (fs *fakeSwift) headRequests() int {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	return fs.heads
+}
+
+// setFault makes all requests for the object fail with the status code. 0 clears it.
+func (fs *fakeSwift) setFault(container, name string, status int) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	if status == 0 {
+		delete(fs.faults, container+"/"+name)
+	} else {
+		fs.faults[container+"/"+name] = status
+	}
+}
+
+func (fs *fakeSwift) handleToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Auth struct {
+			Identity struct {
+				Password struct {
+					User struct {
+						Name     string `json:"name"`
+						Password string `json:"password"`
+					} `json:"user"`
+				} `json:"password"`
+			} `json:"identity"`
+		} `json:"auth"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	user := req.Auth.Identity.Password.User
+	if user.Name != fakeSwiftUser || user.Password != fakeSwiftPass {
+		http.Error(w, "The request you have made requires authentication.", http.StatusUnauthorized)
+		return
+	}
+
+	token := map[string]interface{}{
+		"token": map[string]interface{}{
+			"methods":    []string{"password"},
+			"expires_at": time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+			"issued_at":  time.Now().UTC().Format(time.RFC3339),
+			"user": map[string]interface{}{
+				"id":   "fake-user-id",
+				"name": fakeSwiftUser,
+				"domain": map[string]string{
+					"id":   "default",
+					"name": fakeSwiftDomain,
+				},
+			},
+			"project": map[string]interface{}{
+				"id":   "fake-project-id",
+				"name": fakeSwiftTenant,
+				"domain": map[string]string{
+					"id":   "default",
+					"name": fakeSwiftDomain,
+				},
+			},
+			"catalog": []interface{}{
+				map[string]interface{}{
+					"id":   "fake-swift",
+					"name": "swift",
+					"type": "object-store",
+					"endpoints": []interface{}{
+						map[string]string{
+							"id":        "fake-swift-public",
+							"interface": "public",
+							"region":    "RegionOne",
+							"region_id": "RegionOne",
+							"url":       fs.URL + "/v1/" + fakeSwiftAccount,
+						},
+					},
+				},
+			},
+		},
+	}
+
+	fs.lock.Lock()
+	fs.tokens++
+	fs.lock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Subject-Token", fakeSwiftToken)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(token)
+}
+
+func (fs *fakeSwift) handleSwift(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Trans-Id", fmt.Sprintf("tx%x", time.Now().UnixNano()))
+
+	if r.Header.Get("X-Auth-Token") != fakeSwiftToken {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// /v1/{account}/{container}/{object}
+	parts := strings.SplitN(r.URL.Path, "/", 5)
+	if len(parts) < 3 || parts[2] != fakeSwiftAccount {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Read the body before locking not to block the other requests during streaming uploads
+	if r.Method == http.MethodPut {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	switch {
+	case len(parts) == 3 || parts[3] == "":
+		fs.handleAccount(w, r)
+	case len(parts) == 4 || parts[4] == "":
+		fs.handleContainer(w, r, parts[3])
+	default:
+		fs.handleObject(w, r, parts[3], parts[4])
+	}
+}
+
+func (fs *fakeSwift) handleAccount(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		for k, v := range fakeMetadata(r.Header, "X-Account-Meta-") {
+			fs.accountMetadata[k] = v
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	} else if r.Method != "GET" && r.Method != "HEAD" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	names := make([]string, 0, len(fs.containers))
+	for name := range fs.containers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	entries := make([]fakeListEntry, 0, len(names))
+	for _, n := range fs.filterNames(names, r.URL.Query()) {
+		c := fs.containers[n.name]
+		entries = append(entries, fakeListEntry{
+			Name:  n.name,
+			Count: int64(len(c.objects)),
+			Bytes: c.bytesUsed(),
+		})
+	}
+
+	var bytesUsed int64
+	for _, c := range fs.containers {
+		bytesUsed += c.bytesUsed()
+	}
+	for k, v := range fs.accountMetadata {
+		w.Header().Set("X-Account-Meta-"+k, v)
+	}
+	w.Header().Set("X-Account-Container-Count", strconv.Itoa(len(fs.containers)))
+	w.Header().Set("X-Account-Bytes-Used", strconv.FormatInt(bytesUsed, 10))
+	fs.writeListing(w, r, entries)
+}
+
+func (fs *fakeSwift) handleContainer(w http.ResponseWriter, r *http.Request, container string) {
+	c, exists := fs.containers[container]
+
+	switch r.Method {
+	case "PUT":
+		if exists {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		fs.containers[container] = &fakeContainer{
+			metadata: fakeMetadata(r.Header, "X-Container-Meta-"),
+			objects:  map[string]*fakeObject{},
+		}
+		w.WriteHeader(http.StatusCreated)
+		return
+
+	case "POST":
+		if !exists {
+			http.NotFound(w, r)
+			return
+		}
+		for k, v := range fakeMetadata(r.Header, "X-Container-Meta-") {
+			c.metadata[k] = v
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+
+	case "DELETE":
+		if !exists {
+			http.NotFound(w, r)
+			return
+		} else if len(c.objects) > 0 {
+			http.Error(w, "There was a conflict when trying to complete your request.", http.StatusConflict)
+			return
+		}
+		delete(fs.containers, container)
+		w.WriteHeader(http.StatusNoContent)
+		return
+
+	case "HEAD", "GET":
+		if !exists {
+			http.NotFound(w, r)
+			return
+		}
+		for k, v := range c.metadata {
+			w.Header().Set("X-Container-Meta-"+k, v)
+		}
+		w.Header().Set("X-Container-Object-Count", strconv.Itoa(len(c.objects)))
+		w.Header().Set("X-Container-Bytes-Used", strconv.FormatInt(c.bytesUsed(), 10))
+		if r.Method == "HEAD" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// object listing
+	names := make([]string, 0, len(c.objects))
+	for name := range c.objects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	entries := make([]fakeListEntry, 0, len(names))
+	for _, n := range fs.filterNames(names, r.URL.Query()) {
+		if n.subdir {
+			entries = append(entries, fakeListEntry{Subdir: n.name})
+			continue
+		}
+		obj := c.objects[n.name]
+		entries = append(entries, fakeListEntry{
+			Name:         n.name,
+			Bytes:        int64(len(obj.data)),
+			Hash:         obj.etag(),
+			ContentType:  obj.contentType,
+			LastModified: obj.lastModified.UTC().Format("2006-01-02T15:04:05.000000"),
+		})
+	}
+	fs.writeListing(w, r, entries)
+}
+
+func (fs *fakeSwift) handleObject(w http.ResponseWriter, r *http.Request, container, name string) {
+	if r.Method == http.MethodHead {
+		fs.heads++
+	}
+	if status, ok := fs.faults[container+"/"+name]; ok {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	c, ok := fs.containers[container]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	obj, exists := c.objects[name]
+
+	switch r.Method {
+	case "PUT":
+		if r.Header.Get("If-None-Match") == "*" && exists {
+			http.Error(w, "Precondition Failed", http.StatusPreconditionFailed)
+			return
+		}
+
+		var newObj *fakeObject
+		if target := r.Header.Get("X-Symlink-Target"); target != "" {
+			target, err := url.PathUnescape(target)
+			if err != nil || !strings.Contains(target, "/") || r.ContentLength > 0 {
+				http.Error(w, "Bad Request", http.StatusBadRequest)
+				return
+			}
+			newObj = &fakeObject{
+				data:          []byte{},
+				contentType:   "application/symlink",
+				metadata:      map[string]string{},
+				symlinkTarget: target,
+			}
+		} else if src := r.Header.Get("X-Copy-From"); src != "" {
+			var status int
+			if r.ContentLength > 0 {
+				http.Error(w, "Bad Request", http.StatusBadRequest)
+				return
+			} else if newObj, status = fs.sourceObject(src); newObj == nil {
+				w.WriteHeader(status)
+				return
+			} else if etag := r.Header.Get("Etag"); etag != "" && etag != newObj.etag() {
+				// The ETag is checked with the copied content.
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				return
+			}
+		} else if r.URL.Query().Get("multipart-manifest") == "put" {
+			var status int
+			if newObj, status = fs.manifestObject(r); newObj == nil {
+				w.WriteHeader(status)
+				return
+			}
+		} else {
+			data, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			newObj = &fakeObject{
+				data:        data,
+				contentType: r.Header.Get("Content-Type"),
+				metadata:    map[string]string{},
+			}
+			if etag := r.Header.Get("Etag"); etag != "" && etag != newObj.etag() {
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				return
+			}
+		}
+		for k, v := range fakeMetadata(r.Header, "X-Object-Meta-") {
+			newObj.metadata[k] = v
+		}
+		fs.store(c, name, newObj)
+
+		w.Header().Set("Etag", newObj.etag())
+		w.WriteHeader(http.StatusCreated)
+
+	case "COPY":
+		if !exists {
+			http.NotFound(w, r)
+			return
+		} else if obj, exists = fs.follow(obj, r); !exists {
+			http.NotFound(w, r)
+			return
+		}
+
+		dest, err := url.PathUnescape(r.Header.Get("Destination"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		dparts := strings.SplitN(strings.TrimPrefix(dest, "/"), "/", 2)
+		if len(dparts) != 2 || dparts[1] == "" {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		dc, ok := fs.containers[dparts[0]]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		newObj := obj.clone()
+		for k, v := range fakeMetadata(r.Header, "X-Object-Meta-") {
+			newObj.metadata[k] = v
+		}
+		fs.store(dc, dparts[1], newObj)
+
+		w.Header().Set("Etag", newObj.etag())
+		w.WriteHeader(http.StatusCreated)
+
+	case "POST":
+		if !exists {
+			http.NotFound(w, r)
+			return
+		} else if obj.symlinkTarget != "" {
+			// Swift redirects POST request for the symlink to the target
+			w.Header().Set("Location", "/v1/"+fakeSwiftAccount+"/"+obj.symlinkTarget)
+			w.WriteHeader(http.StatusTemporaryRedirect)
+			return
+		}
+		obj.metadata = fakeMetadata(r.Header, "X-Object-Meta-")
+		w.WriteHeader(http.StatusAccepted)
+
+	case "DELETE":
+		if !exists {
+			http.NotFound(w, r)
+			return
+		}
+		delete(c.objects, name)
+
+		if r.URL.Query().Get("multipart-manifest") == "delete" {
+			for _, seg := range obj.segments {
+				sparts := strings.SplitN(strings.TrimPrefix(seg.Path, "/"), "/", 2)
+				if sc, ok := fs.containers[sparts[0]]; ok && len(sparts) == 2 {
+					delete(sc.objects, sparts[1])
+				}
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case "HEAD", "GET":
+		if !exists {
+			http.NotFound(w, r)
+			return
+		} else if obj, exists = fs.follow(obj, r); !exists {
+			http.NotFound(w, r)
+			return
+		}
+		fs.writeObject(w, r, obj)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (fs *fakeSwift) writeObject(w http.ResponseWriter, r *http.Request, obj *fakeObject) {
+	h := w.Header()
+	for k, v := range obj.metadata {
+		h.Set("X-Object-Meta-"+k, v)
+	}
+	h.Set("Content-Type", obj.contentType)
+	h.Set("Etag", obj.etag())
+	h.Set("Last-Modified", obj.lastModified.UTC().Format(http.TimeFormat))
+	h.Set("Accept-Ranges", "bytes")
+	if obj.symlinkTarget != "" {
+		h.Set("X-Symlink-Target", obj.symlinkTarget)
+	}
+	if obj.segments != nil {
+		h.Set("X-Static-Large-Object", "True")
+	}
+
+	if obj.segments != nil && r.Method == "GET" && r.URL.Query().Get("multipart-manifest") == "get" {
+		manifest := make([]map[string]interface{}, 0, len(obj.segments))
+		for _, seg := range obj.segments {
+			manifest = append(manifest, map[string]interface{}{
+				"name":  seg.Path,
+				"hash":  seg.Etag,
+				"bytes": seg.Size,
+			})
+		}
+		h.Set("Content-Type", "application/json; charset=utf-8")
+		h.Del("X-Static-Large-Object")
+		json.NewEncoder(w).Encode(manifest)
+		return
+	}
+
+	size := int64(len(obj.data))
+	if r.Method == "HEAD" {
+		h.Set("Content-Length", strconv.FormatInt(size, 10))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	rng := r.Header.Get("Range")
+	if rng == "" {
+		h.Set("Content-Length", strconv.FormatInt(size, 10))
+		w.WriteHeader(http.StatusOK)
+		w.Write(obj.data)
+		return
+	}
+
+	start, end, ok := fakeParseRange(rng, size)
+	if !ok {
+		h.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+	h.Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	w.WriteHeader(http.StatusPartialContent)
+	w.Write(obj.data[start : end+1])
+}
+
+// sourceObject returns a copy of the object specified by X-Copy-From header.
+func (fs *fakeSwift) sourceObject(src string) (*fakeObject, int) {
+	src, err := url.PathUnescape(src)
+	if err != nil {
+		return nil, http.StatusBadRequest
+	}
+	sparts := strings.SplitN(strings.TrimPrefix(src, "/"), "/", 2)
+	if len(sparts) != 2 {
+		return nil, http.StatusPreconditionFailed
+	}
+
+	sc, ok := fs.containers[sparts[0]]
+	if !ok {
+		return nil, http.StatusNotFound
+	}
+	obj, ok := sc.objects[sparts[1]]
+	if !ok {
+		return nil, http.StatusNotFound
+	} else if obj, ok = fs.follow(obj, nil); !ok {
+		return nil, http.StatusNotFound
+	}
+	return obj.clone(), 0
+}
+
+// follow returns the object that the symlink points to, unless "symlink=get" is given.
+// Swift follows at most 2 symlinks by default.
+func (fs *fakeSwift) follow(obj *fakeObject, r *http.Request) (*fakeObject, bool) {
+	if r != nil && r.URL.Query().Get("symlink") == "get" {
+		return obj, true
+	}
+
+	for hops := 0; obj.symlinkTarget != ""; hops++ {
+		if hops >= 2 {
+			return nil, false
+		}
+		tparts := strings.SplitN(obj.symlinkTarget, "/", 2)
+		c, ok := fs.containers[tparts[0]]
+		if !ok {
+			return nil, false
+		}
+		if obj, ok = c.objects[tparts[1]]; !ok {
+			return nil, false
+		}
+	}
+	return obj, true
+}
+
+// manifestObject returns the object that concatenates the segments in SLO manifest.
+func (fs *fakeSwift) manifestObject(r *http.Request) (*fakeObject, int) {
+	var segments []fakeSegment
+	if err := json.NewDecoder(r.Body).Decode(&segments); err != nil || len(segments) == 0 {
+		return nil, http.StatusBadRequest
+	}
+
+	obj := &fakeObject{
+		data:        []byte{},
+		contentType: r.Header.Get("Content-Type"),
+		metadata:    map[string]string{},
+		segments:    segments,
+	}
+
+	etags := ""
+	for _, seg := range segments {
+		sobj, status := fs.sourceObject(seg.Path)
+		if sobj == nil {
+			return nil, status
+		} else if (seg.Etag != "" && seg.Etag != sobj.etag()) || (seg.Size != 0 && seg.Size != int64(len(sobj.data))) {
+			return nil, http.StatusBadRequest
+		}
+		obj.data = append(obj.data, sobj.data...)
+		etags += sobj.etag()
+	}
+
+	h := md5.Sum([]byte(etags))
+	obj.sloEtag = `"` + hex.EncodeToString(h[:]) + `"`
+	return obj, 0
+}
+
+func (fs *fakeSwift) store(c *fakeContainer, name string, obj *fakeObject) {
+	if obj.contentType == "" {
+		obj.contentType = "application/octet-stream"
+	}
+	obj.lastModified = time.Now()
+	c.objects[name] = obj
+}
+
+type fakeName struct {
+	name   string
+	subdir bool
+}
+
+// filterNames applies the query parameters of the listing (prefix, delimiter, marker, end_marker and limit).
+// The names must be sorted. Pseudo-directories are returned with a trailing delimiter.
+func (fs *fakeSwift) filterNames(names []string, q url.Values) []fakeName {
+	prefix := q.Get("prefix")
+	delimiter := q.Get("delimiter")
+	marker := q.Get("marker")
+	endMarker := q.Get("end_marker")
+
+	limit := fs.listLimit
+	if l, err := strconv.Atoi(q.Get("limit")); err == nil && l > 0 && l < limit {
+		limit = l
+	}
+
+	result := make([]fakeName, 0, len(names))
+	for _, name := range names {
+		if len(result) >= limit {
+			break
+		} else if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+
+		n := fakeName{name: name}
+		if delimiter != "" {
+			rest := name[len(prefix):]
+			if pos := strings.Index(rest, delimiter); pos >= 0 {
+				n = fakeName{name: prefix + rest[:pos+len(delimiter)], subdir: true}
+			}
+		}
+
+		if n.name <= marker || (endMarker != "" && n.name >= endMarker) {
+			continue
+		} else if n.subdir && len(result) > 0 && result[len(result)-1] == n {
+			// pseudo-directory that is already listed
+			continue
+		}
+		result = append(result, n)
+	}
+	return result
+}
+
+type fakeListEntry struct {
+	Name         string `json:"name,omitempty"`
+	Subdir       string `json:"subdir,omitempty"`
+	Count        int64  `json:"count,omitempty"`
+	Bytes        int64  `json:"bytes"`
+	Hash         string `json:"hash,omitempty"`
+	ContentType  string `json:"content_type,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+func (fs *fakeSwift) writeListing(w http.ResponseWriter, r *http.Request, entries []fakeListEntry) {
+	if r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		if r.Method == "GET" {
+			json.NewEncoder(w).Encode(entries)
+		}
+		return
+	}
+
+	if len(entries) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	buf := &bytes.Buffer{}
+	for _, e := range entries {
+		if e.Subdir != "" {
+			buf.WriteString(e.Subdir + "\n")
+		} else {
+			buf.WriteString(e.Name + "\n")
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	if r.Method == "GET" {
+		w.Write(buf.Bytes())
+	}
+}
+
+func (c *fakeContainer) bytesUsed() (n int64) {
+	for _, obj := range c.objects {
+		n += int64(len(obj.data))
+	}
+	return n
+}
+
+func (obj *fakeObject) etag() string {
+	if obj.sloEtag != "" {
+		return obj.sloEtag
+	}
+	h := md5.Sum(obj.data)
+	return hex.EncodeToString(h[:])
+}
+
+func (obj *fakeObject) clone() *fakeObject {
+	newObj := &fakeObject{
+		data:        obj.data,
+		contentType: obj.contentType,
+		metadata:    map[string]string{},
+	}
+	for k, v := range obj.metadata {
+		newObj.metadata[k] = v
+	}
+	return newObj
+}
+
+func fakeMetadata(h http.Header, prefix string) map[string]string {
+	meta := map[string]string{}
+	for k := range h {
+		if strings.HasPrefix(k, prefix) && len(k) > len(prefix) {
+			meta[k[len(prefix):]] = h.Get(k)
+		}
+	}
+	return meta
+}
+
+// fakeParseRange parses the single range in Range header. The end of the range is inclusive.
+func fakeParseRange(rng string, size int64) (start, end int64, ok bool) {
+	if !strings.HasPrefix(rng, "bytes=") || strings.Contains(rng, ",") {
+		return 0, 0, false
+	}
+	spec := strings.SplitN(rng[len("bytes="):], "-", 2)
+	if len(spec) != 2 {
+		return 0, 0, false
+	}
+
+	var err error
+	if spec[0] == "" {
+		// suffix range: the last N bytes
+		n, err := strconv.ParseInt(spec[1], 10, 64)
+		if err != nil || n <= 0 || size == 0 {
+			return 0, 0, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, size - 1, true
+	}
+
+	if start, err = strconv.ParseInt(spec[0], 10, 64); err != nil || start >= size {
+		return 0, 0, false
+	}
+	end = size - 1
+	if spec[1] != "" {
+		if end, err = strconv.ParseInt(spec[1], 10, 64); err != nil || end < start {
+			return 0, 0, false
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return start, end, true
+}
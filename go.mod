@@ -0,0 +1,26 @@
+module github.com/hironobu-s/swift-sftp
+
+go 1.20
+
+require (
+	github.com/BurntSushi/toml v1.3.2
+	github.com/go-asn1-ber/asn1-ber v1.5.5
+	github.com/go-ldap/ldap/v3 v3.4.8
+	github.com/gophercloud/gophercloud v1.14.1
+	github.com/pkg/sftp v1.13.6
+	github.com/pquerna/otp v1.4.0
+	github.com/sirupsen/logrus v1.9.3
+	github.com/urfave/cli v1.22.14
+	golang.org/x/crypto v0.31.0
+)
+
+require (
+	github.com/Azure/go-ntlmssp v0.0.0-20221128193559-754e69321358 // indirect
+	github.com/boombuler/barcode v1.0.1-0.20190219062509-6c824513bacc // indirect
+	github.com/cpuguy83/go-md2man/v2 v2.0.2 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	github.com/kr/fs v0.1.0 // indirect
+	github.com/russross/blackfriday/v2 v2.1.0 // indirect
+	golang.org/x/sys v0.28.0 // indirect
+	golang.org/x/term v0.27.0 // indirect
+)
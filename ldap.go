@@ -0,0 +1,431 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"golang.org/x/crypto/ssh"
+)
+
+// LDAPConfig is the configuration of LDAP or Active Directory for the authentication.
+//
+// The password is checked with bind-as-user if UserDN is set, or search-then-bind otherwise.
+// The groups of the user are read from GroupAttribute (memberOf) of the entry, or searched with GroupFilter.
+type LDAPConfig struct {
+	// URL of the server (ldap://host:389 or ldaps://host:636)
+	URL string `toml:"url"`
+
+	// Upgrade the connection of ldap:// with StartTLS
+	StartTLS bool `toml:"start_tls"`
+
+	// CA certificate file to verify the server. If empty, the system roots are used.
+	CACertPath string `toml:"ca_cert"`
+
+	// Skip the verification of the server certificate (for testing only)
+	InsecureSkipVerify bool `toml:"insecure_skip_verify"`
+
+	// Timeout of the connection and the requests (sec)
+	Timeout int `toml:"timeout"`
+
+	// Bind-as-user: the name to bind as the user. "%u" is replaced with the username.
+	// e.g. "uid=%u,ou=people,dc=example,dc=com", or "%u@example.com" for Active Directory
+	UserDN string `toml:"user_dn"`
+
+	// Search-then-bind: the service account to search the user. If empty, anonymous bind is used.
+	BindDN       string `toml:"bind_dn"`
+	BindPassword string `toml:"bind_password"`
+
+	// Base DN and filter to search the user. "%u" is replaced with the username.
+	// e.g. "(uid=%u)", or "(sAMAccountName=%u)" for Active Directory
+	BaseDN     string `toml:"base_dn"`
+	UserFilter string `toml:"user_filter"`
+
+	// Attribute of the user entry that holds the groups (default: memberOf)
+	GroupAttribute string `toml:"group_attribute"`
+
+	// Filter to search the groups of the user instead of GroupAttribute.
+	// "%u" is replaced with the username and "%d" with the DN of the user. e.g. "(member=%d)"
+	GroupBaseDN        string `toml:"group_base_dn"`
+	GroupFilter        string `toml:"group_filter"`
+	GroupNameAttribute string `toml:"group_name_attribute"`
+
+	// Attribute of the user entry that holds the SSH public keys (e.g. sshPublicKey)
+	// If empty, the public keys are not read from LDAP.
+	SSHPublicKeyAttribute string `toml:"ssh_public_key_attribute"`
+}
+
+// Default values of LDAPConfig
+const (
+	DefaultLDAPTimeout            = 10
+	DefaultLDAPUserFilter         = "(uid=%u)"
+	DefaultLDAPGroupAttribute     = "memberOf"
+	DefaultLDAPGroupNameAttribute = "cn"
+)
+
+// Init validates the configuration and sets the default values.
+func (c *LDAPConfig) Init() error {
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+		return fmt.Errorf("LDAP URL must be ldap://host[:port] or ldaps://host[:port] [%s]", c.URL)
+	} else if c.StartTLS && u.Scheme == "ldaps" {
+		return errors.New("LDAP StartTLS can't be used with ldaps://")
+	}
+
+	if c.UserDN == "" && c.BaseDN == "" {
+		return errors.New("LDAP 'user_dn' or 'base_dn' is required")
+	} else if c.BaseDN == "" {
+		// The entry of the user is read from UserDN without BaseDN, so it must be a DN.
+		if dn, err := ldap.ParseDN(strings.Replace(c.UserDN, "%u", "user", -1)); err != nil || len(dn.RDNs) == 0 {
+			return fmt.Errorf("LDAP 'base_dn' is required because 'user_dn' is not a DN [%s]", c.UserDN)
+		}
+	}
+
+	if c.Timeout == 0 {
+		c.Timeout = DefaultLDAPTimeout
+	}
+	if c.UserFilter == "" {
+		c.UserFilter = DefaultLDAPUserFilter
+	}
+	if c.GroupAttribute == "" {
+		c.GroupAttribute = DefaultLDAPGroupAttribute
+	}
+	if c.GroupNameAttribute == "" {
+		c.GroupNameAttribute = DefaultLDAPGroupNameAttribute
+	}
+	if c.GroupBaseDN == "" {
+		c.GroupBaseDN = c.BaseDN
+	}
+	if c.GroupFilter != "" && c.GroupBaseDN == "" {
+		return errors.New("LDAP 'group_base_dn' is required for 'group_filter'")
+	}
+
+	// Check the certificate in advance
+	_, err = c.tlsConfig()
+	return err
+}
+
+func (c *LDAPConfig) tlsConfig() (*tls.Config, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	conf := &tls.Config{
+		ServerName:         u.Hostname(),
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+	if c.CACertPath != "" {
+		pem, err := ioutil.ReadFile(c.CACertPath)
+		if err != nil {
+			return nil, err
+		}
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificate in LDAP CA file '%s'", c.CACertPath)
+		}
+	}
+	return conf, nil
+}
+
+// LDAP authenticates the users with LDAP or Active Directory.
+type LDAP struct {
+	conf LDAPConfig
+}
+
+// ldapUser is the entry of the authenticated user.
+type ldapUser struct {
+	DN     string
+	Groups []string
+	Keys   []authorizedKey
+}
+
+func NewLDAP(conf LDAPConfig) *LDAP {
+	return &LDAP{
+		conf: conf,
+	}
+}
+
+func (l *LDAP) dial() (*ldap.Conn, error) {
+	tlsConf, err := l.conf.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := time.Duration(l.conf.Timeout) * time.Second
+	conn, err := ldap.DialURL(l.conf.URL, ldap.DialWithDialer(&net.Dialer{Timeout: timeout}), ldap.DialWithTLSConfig(tlsConf))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(timeout)
+
+	if l.conf.StartTLS {
+		if err = conn.StartTLS(tlsConf); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// bindService binds as the service account, or anonymously if it's not set.
+func (l *LDAP) bindService(conn *ldap.Conn) error {
+	if l.conf.BindDN == "" {
+		return conn.UnauthenticatedBind("")
+	}
+	return conn.Bind(l.conf.BindDN, l.conf.BindPassword)
+}
+
+// Authenticate checks the password of the user and returns the entry.
+func (l *LDAP) Authenticate(username, password string) (*ldapUser, error) {
+	// The server accepts the empty password as the anonymous bind.
+	if password == "" {
+		return nil, errors.New("empty password")
+	}
+
+	conn, err := l.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var user *ldapUser
+	if l.conf.UserDN != "" {
+		// bind-as-user, and read the entry as the user
+		if err = conn.Bind(l.replaceUsername(l.conf.UserDN, username, ldap.EscapeDN), password); err != nil {
+			return nil, err
+		}
+		if user, err = l.lookup(conn, username); err != nil {
+			return nil, err
+		}
+
+	} else {
+		// search-then-bind
+		if err = l.bindService(conn); err != nil {
+			return nil, fmt.Errorf("bind as the service account failed [%v]", err)
+		}
+		if user, err = l.lookup(conn, username); err != nil {
+			return nil, err
+		}
+		if err = conn.Bind(user.DN, password); err != nil {
+			return nil, err
+		}
+	}
+
+	if user.Groups, err = l.groups(conn, username, user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// Lookup returns the entry of the user with the service account. It's used for the public keys.
+func (l *LDAP) Lookup(username string) (*ldapUser, error) {
+	conn, err := l.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err = l.bindService(conn); err != nil {
+		return nil, fmt.Errorf("bind as the service account failed [%v]", err)
+	}
+
+	user, err := l.lookup(conn, username)
+	if err != nil {
+		return nil, err
+	}
+	if user.Groups, err = l.groups(conn, username, user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// lookup searches the entry of the user with BaseDN and UserFilter, or reads the entry of UserDN.
+func (l *LDAP) lookup(conn *ldap.Conn, username string) (*ldapUser, error) {
+	attrs := []string{l.conf.GroupAttribute}
+	if l.conf.SSHPublicKeyAttribute != "" {
+		attrs = append(attrs, l.conf.SSHPublicKeyAttribute)
+	}
+
+	var req *ldap.SearchRequest
+	if l.conf.BaseDN != "" {
+		filter := l.replaceUsername(l.conf.UserFilter, username, ldap.EscapeFilter)
+		req = ldap.NewSearchRequest(l.conf.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, l.conf.Timeout, false, filter, attrs, nil)
+	} else {
+		dn := l.replaceUsername(l.conf.UserDN, username, ldap.EscapeDN)
+		req = ldap.NewSearchRequest(dn, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 1, l.conf.Timeout, false, "(objectClass=*)", attrs, nil)
+	}
+
+	res, err := conn.Search(req)
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return nil, err
+	} else if res == nil || len(res.Entries) != 1 {
+		return nil, fmt.Errorf("user %q is not found or not unique in LDAP", username)
+	}
+
+	entry := res.Entries[0]
+	user := &ldapUser{DN: entry.DN}
+	if l.conf.SSHPublicKeyAttribute != "" {
+		for _, value := range entry.GetEqualFoldAttributeValues(l.conf.SSHPublicKeyAttribute) {
+			key, _, options, _, err := ssh.ParseAuthorizedKey([]byte(value))
+			if err != nil {
+				log.Warnf("Invalid SSH public key of '%s' in LDAP [%v]", entry.DN, err)
+				continue
+			}
+			user.Keys = append(user.Keys, authorizedKey{key: key, options: options})
+		}
+	}
+
+	if l.conf.GroupFilter == "" {
+		// The names of the groups are the first values of the DNs like "CN=sftp-users,OU=Groups,DC=example,DC=com".
+		for _, value := range entry.GetEqualFoldAttributeValues(l.conf.GroupAttribute) {
+			user.Groups = append(user.Groups, ldapGroupName(value))
+		}
+	}
+	return user, nil
+}
+
+// groups returns the groups of the user, which are sorted by name.
+func (l *LDAP) groups(conn *ldap.Conn, username string, user *ldapUser) ([]string, error) {
+	groups := user.Groups
+	if l.conf.GroupFilter != "" {
+		filter := l.replaceUsername(l.conf.GroupFilter, username, ldap.EscapeFilter)
+		filter = strings.Replace(filter, "%d", ldap.EscapeFilter(user.DN), -1)
+
+		req := ldap.NewSearchRequest(l.conf.GroupBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, l.conf.Timeout, false, filter, []string{l.conf.GroupNameAttribute}, nil)
+		res, err := conn.Search(req)
+		if err != nil {
+			return nil, err
+		}
+
+		groups = nil
+		for _, entry := range res.Entries {
+			if name := entry.GetEqualFoldAttributeValue(l.conf.GroupNameAttribute); name != "" {
+				groups = append(groups, name)
+			}
+		}
+	}
+
+	sort.Strings(groups)
+	return groups, nil
+}
+
+func (l *LDAP) replaceUsername(template, username string, escape func(string) string) string {
+	return strings.Replace(template, "%u", escape(username), -1)
+}
+
+// ldapGroupName returns the value of the first RDN of the group DN. It returns the value itself if it's not DN.
+func ldapGroupName(value string) string {
+	dn, err := ldap.ParseDN(value)
+	if err != nil || len(dn.RDNs) == 0 || len(dn.RDNs[0].Attributes) == 0 {
+		return value
+	}
+	return dn.RDNs[0].Attributes[0].Value
+}
+
+// Names of the extensions of ssh.Permissions that hold the groups of the user (separated with newlines) and the DN
+const (
+	permGroups = "groups"
+	permLDAPDN = "ldap-dn"
+)
+
+// ldapPermissions returns the permissions with the groups of the user.
+func ldapPermissions(user *ldapUser) *ssh.Permissions {
+	return &ssh.Permissions{
+		Extensions: map[string]string{
+			permGroups: strings.Join(user.Groups, "\n"),
+			permLDAPDN: user.DN,
+		},
+	}
+}
+
+// authLDAPPassword returns the password callback that checks the local password file first (if it's set), and then LDAP.
+func authLDAPPassword(l *LDAP, local func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error)) func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+	return func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+		if local != nil {
+			if perms, err := local(c, password); err == nil {
+				return perms, nil
+			}
+		}
+
+		user, err := l.Authenticate(c.User(), string(password))
+		if err != nil {
+			return nil, fmt.Errorf("LDAP password rejected for %q [%v]", c.User(), err)
+		}
+		return ldapPermissions(user), nil
+	}
+}
+
+// authLDAPPkey returns the public key callback that checks the other keys first, and then the keys in LDAP.
+func authLDAPPkey(l *LDAP, other func(c ssh.ConnMetadata, pkey ssh.PublicKey) (*ssh.Permissions, error)) func(c ssh.ConnMetadata, pkey ssh.PublicKey) (*ssh.Permissions, error) {
+	return func(c ssh.ConnMetadata, pkey ssh.PublicKey) (*ssh.Permissions, error) {
+		perms, err := other(c, pkey)
+		if err == nil {
+			return perms, nil
+		}
+
+		user, lerr := l.Lookup(c.User())
+		if lerr != nil {
+			log.Debugf("LDAP lookup of %q failed [%v]", c.User(), lerr)
+			return nil, err
+		}
+
+		for _, k := range user.Keys {
+			if string(k.key.Marshal()) != string(pkey.Marshal()) {
+				continue
+			}
+			if perr := k.permit(c.RemoteAddr(), time.Now()); perr != nil {
+				err = fmt.Errorf("%v for %q", perr, c.User())
+				continue
+			}
+
+			perms = ldapPermissions(user)
+			perms.Extensions["pubkey-fp"] = ssh.FingerprintSHA256(pkey)
+			if container := authorizedKeyContainer(k.options); container != "" {
+				perms.Extensions[permContainer] = container
+			}
+			if command, ok := k.option("command"); ok {
+				perms.CriticalOptions = map[string]string{permForceCommand: command}
+			}
+			return perms, nil
+		}
+		return nil, err
+	}
+}
+
+// authLDAPGroups returns the function that adds the groups in LDAP to the permissions,
+// so that the users who are authenticated with the other methods get their groups as well.
+// The lookup is best-effort. The users who are not in LDAP, or can't be looked up (e.g. LDAP is down
+// or rejects the anonymous bind), are still authenticated without the groups.
+func authLDAPGroups(l *LDAP) func(c ssh.ConnMetadata, perms *ssh.Permissions) (*ssh.Permissions, error) {
+	return func(c ssh.ConnMetadata, perms *ssh.Permissions) (*ssh.Permissions, error) {
+		if perms != nil && perms.Extensions[permLDAPDN] != "" {
+			// authenticated with LDAP
+			return perms, nil
+		}
+
+		user, err := l.Lookup(c.User())
+		if err != nil {
+			log.Warnf("Couldn't resolve the LDAP groups of %q, the user has no groups [%v]", c.User(), err)
+			return perms, nil
+		}
+
+		if perms == nil {
+			perms = &ssh.Permissions{}
+		}
+		if perms.Extensions == nil {
+			perms.Extensions = map[string]string{}
+		}
+		perms.Extensions[permGroups] = strings.Join(user.Groups, "\n")
+		perms.Extensions[permLDAPDN] = user.DN
+		return perms, nil
+	}
+}
@@ -0,0 +1,536 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"golang.org/x/crypto/ssh"
+)
+
+// ldapStubEntry is the entry of the LDAP stub. The password is "userPassword" attribute.
+type ldapStubEntry struct {
+	dn    string
+	attrs map[string][]string
+}
+
+func (e *ldapStubEntry) values(name string) []string {
+	for n, v := range e.attrs {
+		if strings.EqualFold(n, name) {
+			return v
+		}
+	}
+	return nil
+}
+
+// ldapStub is the in-process LDAP server that supports bind, search and StartTLS.
+type ldapStub struct {
+	listener   net.Listener
+	entries    []ldapStubEntry
+	tlsConfig  *tls.Config
+	requireTLS bool // reject the bind with the password on the plain connection
+}
+
+// newLDAPStubForTesting starts the LDAP stub. The server certificate is written to the CA file for the clients.
+func newLDAPStubForTesting(t *testing.T, ldaps bool, caFile string, entries ...ldapStubEntry) *ldapStub {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ldap-stub"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &ldapStub{
+		entries:   entries,
+		tlsConfig: &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}},
+	}
+	if s.listener, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	if ldaps {
+		s.listener = tls.NewListener(s.listener, s.tlsConfig)
+	}
+
+	go func() {
+		for {
+			conn, err := s.listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *ldapStub) URL(scheme string) string {
+	return scheme + "://" + s.listener.Addr().String()
+}
+
+func (s *ldapStub) Close() {
+	s.listener.Close()
+}
+
+func (s *ldapStub) serve(conn net.Conn) {
+	defer func() { conn.Close() }()
+
+	_, secure := conn.(*tls.Conn)
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		id := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			name := op.Children[1].Data.String()
+			password := op.Children[2].Data.String()
+			code := s.bind(name, password)
+			if code == ldap.LDAPResultSuccess && password != "" && s.requireTLS && !secure {
+				code = ldap.LDAPResultConfidentialityRequired
+			}
+			conn.Write(ldapStubResult(id, ldap.ApplicationBindResponse, code).Bytes())
+
+		case ldap.ApplicationSearchRequest:
+			for _, p := range s.search(id, op) {
+				conn.Write(p.Bytes())
+			}
+
+		case ldap.ApplicationExtendedRequest:
+			if op.Children[0].Data.String() != "1.3.6.1.4.1.1466.20037" || secure {
+				conn.Write(ldapStubResult(id, ldap.ApplicationExtendedResponse, ldap.LDAPResultProtocolError).Bytes())
+				continue
+			}
+			conn.Write(ldapStubResult(id, ldap.ApplicationExtendedResponse, ldap.LDAPResultSuccess).Bytes())
+			conn = tls.Server(conn, s.tlsConfig)
+			secure = true
+
+		case ldap.ApplicationUnbindRequest:
+			return
+
+		default:
+			conn.Write(ldapStubResult(id, ldap.ApplicationExtendedResponse, ldap.LDAPResultUnwillingToPerform).Bytes())
+		}
+	}
+}
+
+// bind checks the DN (or userPrincipalName of Active Directory) and the password.
+func (s *ldapStub) bind(name, password string) uint16 {
+	if name == "" && password == "" {
+		return ldap.LDAPResultSuccess
+	}
+	for _, e := range s.entries {
+		if !strings.EqualFold(e.dn, name) && !reflect.DeepEqual(e.values("userPrincipalName"), []string{name}) {
+			continue
+		}
+		if password != "" && reflect.DeepEqual(e.values("userPassword"), []string{password}) {
+			return ldap.LDAPResultSuccess
+		}
+	}
+	return ldap.LDAPResultInvalidCredentials
+}
+
+func (s *ldapStub) search(id int64, op *ber.Packet) []*ber.Packet {
+	base := strings.ToLower(op.Children[0].Data.String())
+	scope := op.Children[1].Value.(int64)
+	sizeLimit := op.Children[3].Value.(int64)
+	filter := op.Children[6]
+
+	var attrs []string
+	for _, a := range op.Children[7].Children {
+		attrs = append(attrs, a.Data.String())
+	}
+
+	var packets []*ber.Packet
+	for _, e := range s.entries {
+		dn := strings.ToLower(e.dn)
+		if dn != base && (scope == ldap.ScopeBaseObject || !strings.HasSuffix(dn, ","+base)) {
+			continue
+		}
+		if !ldapStubMatch(&e, filter) {
+			continue
+		}
+		if sizeLimit > 0 && int64(len(packets)) >= sizeLimit {
+			return append(packets, ldapStubResult(id, ldap.ApplicationSearchResultDone, ldap.LDAPResultSizeLimitExceeded))
+		}
+
+		entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+		entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.dn, ""))
+		list := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+		for _, name := range attrs {
+			values := e.values(name)
+			if len(values) == 0 {
+				continue
+			}
+			attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+			attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, ""))
+			set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+			for _, v := range values {
+				set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, ""))
+			}
+			attr.AppendChild(set)
+			list.AppendChild(attr)
+		}
+		entry.AppendChild(list)
+		packets = append(packets, ldapStubMessage(id, entry))
+	}
+	return append(packets, ldapStubResult(id, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess))
+}
+
+// ldapStubMatch evaluates and, or, not, equality and present of the filter.
+func ldapStubMatch(e *ldapStubEntry, f *ber.Packet) bool {
+	switch f.Tag {
+	case ldap.FilterAnd:
+		for _, c := range f.Children {
+			if !ldapStubMatch(e, c) {
+				return false
+			}
+		}
+		return true
+	case ldap.FilterOr:
+		for _, c := range f.Children {
+			if ldapStubMatch(e, c) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterNot:
+		return !ldapStubMatch(e, f.Children[0])
+	case ldap.FilterEqualityMatch:
+		for _, v := range e.values(f.Children[0].Data.String()) {
+			if strings.EqualFold(v, f.Children[1].Data.String()) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterPresent:
+		return strings.EqualFold(f.Data.String(), "objectClass") || len(e.values(f.Data.String())) > 0
+	}
+	return false
+}
+
+func ldapStubMessage(id int64, op *ber.Packet) *ber.Packet {
+	p := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+	p.AppendChild(op)
+	return p
+}
+
+func ldapStubResult(id int64, tag ber.Tag, code uint16) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	return ldapStubMessage(id, op)
+}
+
+// ldapEntriesForTesting returns the users, the service account and the groups of the directory.
+func ldapEntriesForTesting(aliceKey ssh.PublicKey) []ldapStubEntry {
+	return []ldapStubEntry{
+		{"cn=svc,dc=example,dc=com", map[string][]string{"userPassword": {"svc-secret"}}},
+		{"uid=alice,ou=people,dc=example,dc=com", map[string][]string{
+			"uid":               {"alice"},
+			"userPrincipalName": {"alice@example.com"},
+			"userPassword":      {"alice-secret"},
+			"memberOf":          {"cn=sftp-users,ou=groups,dc=example,dc=com", "cn=sftp-admins,ou=groups,dc=example,dc=com"},
+			"sshPublicKey":      {"broken-key", `environment="SWIFT_SFTP_CONTAINER=tenant-a" ` + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(aliceKey)))},
+		}},
+		{"uid=bob,ou=people,dc=example,dc=com", map[string][]string{
+			"uid":          {"bob"},
+			"userPassword": {"bob-secret"},
+		}},
+		{"cn=sftp-users,ou=groups,dc=example,dc=com", map[string][]string{
+			"cn":     {"sftp-users"},
+			"member": {"uid=alice,ou=people,dc=example,dc=com", "uid=bob,ou=people,dc=example,dc=com"},
+		}},
+		{"cn=sftp-admins,ou=groups,dc=example,dc=com", map[string][]string{
+			"cn":     {"sftp-admins"},
+			"member": {"uid=alice,ou=people,dc=example,dc=com"},
+		}},
+	}
+}
+
+func TestLDAPConfigInit(t *testing.T) {
+	tests := map[string]LDAPConfig{
+		"no URL":          {BaseDN: "dc=example,dc=com"},
+		"wrong scheme":    {URL: "http://127.0.0.1", BaseDN: "dc=example,dc=com"},
+		"StartTLS ldaps":  {URL: "ldaps://127.0.0.1", StartTLS: true, BaseDN: "dc=example,dc=com"},
+		"no DN":           {URL: "ldap://127.0.0.1"},
+		"no group base":   {URL: "ldap://127.0.0.1", UserDN: "uid=%u,dc=example,dc=com", GroupFilter: "(member=%d)"},
+		"AD without base": {URL: "ldap://127.0.0.1", UserDN: "%u@example.com"},
+		"missing CA file": {URL: "ldaps://127.0.0.1", BaseDN: "dc=example,dc=com", CACertPath: "./not-found"},
+	}
+	for name, c := range tests {
+		if err := c.Init(); err == nil {
+			t.Errorf("LDAP config should be rejected (%s)", name)
+		}
+	}
+
+	c := LDAPConfig{URL: "ldap://127.0.0.1", BaseDN: "dc=example,dc=com"}
+	if err := c.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if c.UserFilter != DefaultLDAPUserFilter || c.GroupAttribute != DefaultLDAPGroupAttribute || c.GroupBaseDN != c.BaseDN || c.Timeout != DefaultLDAPTimeout {
+		t.Errorf("Wrong default values %v", c)
+	}
+}
+
+func TestLDAPAuthenticate(t *testing.T) {
+	caFile := "./ldap_ca_test.pem"
+	defer os.Remove(caFile)
+
+	// search-then-bind with StartTLS
+	stub := newLDAPStubForTesting(t, false, caFile, ldapEntriesForTesting(signerForTesting(t).PublicKey())...)
+	defer stub.Close()
+	stub.requireTLS = true
+
+	c := LDAPConfig{
+		URL:          stub.URL("ldap"),
+		StartTLS:     true,
+		CACertPath:   caFile,
+		BindDN:       "cn=svc,dc=example,dc=com",
+		BindPassword: "svc-secret",
+		BaseDN:       "ou=people,dc=example,dc=com",
+	}
+	if err := c.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	l := NewLDAP(c)
+	user, err := l.Authenticate("alice", "alice-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.DN != "uid=alice,ou=people,dc=example,dc=com" || !reflect.DeepEqual(user.Groups, []string{"sftp-admins", "sftp-users"}) {
+		t.Errorf("Wrong user %v", user)
+	}
+
+	for _, test := range []struct{ username, password string }{
+		{"alice", "wrong"},
+		{"alice", ""},
+		{"carol", "alice-secret"},
+		{"*", "alice-secret"},
+		{"alice)(uid=*", "alice-secret"},
+	} {
+		if _, err = l.Authenticate(test.username, test.password); err == nil {
+			t.Errorf("'%s' with '%s' should be rejected", test.username, test.password)
+		}
+	}
+
+	// wrong service account
+	c.BindPassword = "wrong"
+	if _, err = NewLDAP(c).Authenticate("alice", "alice-secret"); err == nil {
+		t.Errorf("Wrong service account should be rejected")
+	}
+
+	// The password is not sent without TLS.
+	c.BindPassword = "svc-secret"
+	c.StartTLS = false
+	if _, err = NewLDAP(c).Authenticate("alice", "alice-secret"); err == nil {
+		t.Errorf("The stub should require TLS")
+	}
+
+	// anonymous search-then-bind
+	stub.requireTLS = false
+	c.BindDN, c.BindPassword = "", ""
+	if user, err = NewLDAP(c).Authenticate("bob", "bob-secret"); err != nil || len(user.Groups) != 0 {
+		t.Errorf("Wrong user %v [%v]", user, err)
+	}
+}
+
+func TestLDAPBindAsUser(t *testing.T) {
+	caFile := "./ldap_ca_test.pem"
+	defer os.Remove(caFile)
+
+	stub := newLDAPStubForTesting(t, true, caFile, ldapEntriesForTesting(signerForTesting(t).PublicKey())...)
+	defer stub.Close()
+
+	// bind-as-user with ldaps, and the groups are searched with the filter
+	c := LDAPConfig{
+		URL:         stub.URL("ldaps"),
+		CACertPath:  caFile,
+		UserDN:      "uid=%u,ou=people,dc=example,dc=com",
+		GroupBaseDN: "ou=groups,dc=example,dc=com",
+		GroupFilter: "(member=%d)",
+	}
+	if err := c.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := NewLDAP(c).Authenticate("bob", "bob-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(user.Groups, []string{"sftp-users"}) {
+		t.Errorf("Wrong groups %v", user.Groups)
+	}
+	if _, err = NewLDAP(c).Authenticate("bob", "alice-secret"); err == nil {
+		t.Errorf("Wrong password should be rejected")
+	}
+
+	// Active Directory style with userPrincipalName
+	c.UserDN = "%u@example.com"
+	c.BaseDN = "ou=people,dc=example,dc=com"
+	c.UserFilter = "(userPrincipalName=%u@example.com)"
+	c.GroupFilter = ""
+	if user, err = NewLDAP(c).Authenticate("alice", "alice-secret"); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(user.Groups, []string{"sftp-admins", "sftp-users"}) {
+		t.Errorf("Wrong groups %v", user.Groups)
+	}
+
+	// The server certificate is verified.
+	c.CACertPath = ""
+	if _, err = NewLDAP(c).Authenticate("alice", "alice-secret"); err == nil {
+		t.Errorf("Unknown server certificate should be rejected")
+	}
+}
+
+func TestAuthLDAP(t *testing.T) {
+	caFile := "./ldap_ca_test.pem"
+	defer os.Remove(caFile)
+
+	signer := signerForTesting(t)
+	stub := newLDAPStubForTesting(t, false, caFile, ldapEntriesForTesting(signer.PublicKey())...)
+	defer stub.Close()
+
+	c := defaultConfigForTesting()
+	c.LDAP = LDAPConfig{
+		URL:                   stub.URL("ldap"),
+		StartTLS:              true,
+		CACertPath:            caFile,
+		BaseDN:                "ou=people,dc=example,dc=com",
+		SSHPublicKeyAttribute: "sshPublicKey",
+	}
+	if err := c.LDAP.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	sConf, err := initServer(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// password
+	perms, err := sshAuthForTesting(t, sConf, ssh.Password("alice-secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perms.Extensions[permGroups] != "sftp-admins\nsftp-users" {
+		t.Errorf("Wrong groups '%s'", perms.Extensions[permGroups])
+	}
+	if _, err = sshAuthForTesting(t, sConf, ssh.Password("wrong")); err == nil {
+		t.Errorf("Wrong password should be rejected")
+	}
+
+	// public key in the attribute
+	if perms, err = sshAuthForTesting(t, sConf, ssh.PublicKeys(signer)); err != nil {
+		t.Fatal(err)
+	}
+	if perms.Extensions[permContainer] != "tenant-a" || perms.Extensions[permGroups] != "sftp-admins\nsftp-users" {
+		t.Errorf("Wrong extensions %v", perms.Extensions)
+	}
+	if _, err = sshAuthForTesting(t, sConf, ssh.PublicKeys(signerForTesting(t))); err == nil {
+		t.Errorf("Unknown public key should be rejected")
+	}
+}
+
+func TestAuthLDAPGroups(t *testing.T) {
+	caFile := "./ldap_ca_test.pem"
+	defer os.Remove(caFile)
+
+	stub := newLDAPStubForTesting(t, false, caFile, ldapEntriesForTesting(signerForTesting(t).PublicKey())...)
+	defer stub.Close()
+
+	dir, err := ioutil.TempDir("", "authorized_keys_dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	signer := signerForTesting(t)
+	if err = ioutil.WriteFile(filepath.Join(dir, "alice"), ssh.MarshalAuthorizedKey(signer.PublicKey()), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c := defaultConfigForTesting()
+	c.AuthorizedKeysPath = ""
+	c.AuthorizedKeysDir = dir
+	c.LDAP = LDAPConfig{
+		URL:        stub.URL("ldap"),
+		StartTLS:   true,
+		CACertPath: caFile,
+		BaseDN:     "ou=people,dc=example,dc=com",
+	}
+	if err = c.LDAP.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	sConf, err := initServer(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The key in authorized_keys gets the groups in LDAP.
+	perms, err := sshAuthForTesting(t, sConf, ssh.PublicKeys(signer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perms.Extensions[permGroups] != "sftp-admins\nsftp-users" || perms.Extensions["pubkey-fp"] == "" {
+		t.Errorf("Wrong extensions %v", perms.Extensions)
+	}
+
+	// The user who is not in LDAP is authenticated without the groups.
+	if err = ioutil.WriteFile(filepath.Join(dir, "carol"), ssh.MarshalAuthorizedKey(signer.PublicKey()), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if perms, err = sConf.PublicKeyCallback(testConnMetadata{user: "carol"}, signer.PublicKey()); err != nil {
+		t.Fatalf("The key of the user not in LDAP should be accepted [%v]", err)
+	}
+	if perms.Extensions[permGroups] != "" || perms.Extensions["pubkey-fp"] == "" {
+		t.Errorf("Wrong extensions %v", perms.Extensions)
+	}
+
+	// The key is accepted without the groups if LDAP is down.
+	stub.Close()
+	if perms, err = sshAuthForTesting(t, sConf, ssh.PublicKeys(signer)); err != nil {
+		t.Fatalf("The key should be accepted without LDAP [%v]", err)
+	}
+	if perms.Extensions[permGroups] != "" || perms.Extensions["pubkey-fp"] == "" {
+		t.Errorf("Wrong extensions %v", perms.Extensions)
+	}
+}
@@ -42,6 +42,11 @@ func main() {
 					Name:  "create-container",
 					Usage: "Create container if not exist",
 				},
+				cli.StringFlag{
+					Name:  "backend",
+					Usage: "Set storage backend (swift or memory)",
+					Value: "swift",
+				},
 				cli.StringFlag{
 					Name:  "config-file,f",
 					Usage: "Set configuration file",
@@ -67,11 +72,83 @@ func main() {
 					Usage: "Set authorized_keys file",
 					Value: "~/.ssh/authorized_keys",
 				},
+				cli.StringFlag{
+					Name:  "authorized-keys-dir",
+					Usage: "Set directory of authorized_keys files of the users (the file name is the username)",
+					Value: "",
+				},
+				cli.StringFlag{
+					Name:  "trusted-user-ca-keys",
+					Usage: "Set CA public keys file to accept the user certificates signed by them",
+					Value: "",
+				},
+				cli.StringFlag{
+					Name:  "revoked-keys",
+					Usage: "Set revoked certificates and keys file (KRL or serial numbers)",
+					Value: "",
+				},
 				cli.IntFlag{
 					Name:  "swift-timeout",
 					Usage: "Set timeout for Swift (sec).",
 					Value: 180,
 				},
+				cli.IntFlag{
+					Name:  "segment-size",
+					Usage: "Upload files larger than this size as Static Large Object (MiB).",
+					Value: DefaultSegmentSize,
+				},
+				cli.StringFlag{
+					Name:  "segment-container",
+					Usage: "Set container name for the segments of large objects (default: [container]_segments)",
+					Value: "",
+				},
+				cli.Int64Flag{
+					Name:  "storage-capacity",
+					Usage: "Set capacity of the storage for statvfs if no quota is set (GiB).",
+					Value: 0,
+				},
+				cli.IntFlag{
+					Name:  "list-metadata-limit",
+					Usage: "Read the mode and mtime of the files in the directory listings that have up to this number of objects (a HEAD request per file).",
+					Value: 0,
+				},
+				cli.StringSliceFlag{
+					Name:  "user-container",
+					Usage: "Set container for the user (USER=CONTAINER). It can be specified multiple times.",
+				},
+				cli.BoolFlag{
+					Name:  "create-user-containers",
+					Usage: "Create the containers for the users if not exist.",
+				},
+				cli.StringFlag{
+					Name:  "home-directory",
+					Usage: "Set home directory of the users in the container. \"%u\" is replaced with the username.",
+					Value: "",
+				},
+				cli.StringFlag{
+					Name:  "access-mode",
+					Usage: "Set access mode of the users (read-write, read-only or write-only)",
+					Value: "read-write",
+				},
+				cli.StringSliceFlag{
+					Name:  "user-access-mode",
+					Usage: "Set access mode for the user (USER=MODE). It can be specified multiple times.",
+				},
+				cli.StringFlag{
+					Name:  "acl-file",
+					Usage: "Set ACL rules file",
+					Value: "",
+				},
+				cli.StringFlag{
+					Name:  "totp-file",
+					Usage: "Set TOTP seeds file to require a verification code after the password or the public key",
+					Value: "",
+				},
+				cli.StringFlag{
+					Name:  "totp-unenrolled",
+					Usage: "Set rule for the users who don't have the TOTP seed (deny or allow)",
+					Value: TOTPUnenrolledDeny,
+				},
 			},
 
 			HideHelp: true,
@@ -91,6 +168,30 @@ func main() {
 				},
 			},
 		},
+		cli.Command{
+			Name:      "totp-enroll",
+			ShortName: "t",
+			Usage:     "Enroll user in TOTP and print otpauth:// URI",
+			Action:    enrollTOTP,
+			ArgsUsage: "[username]",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "totp-file,t",
+					Usage: "Set TOTP seeds file. It's created if not exist.",
+					Value: "",
+				},
+				cli.StringFlag{
+					Name:  "config-file,f",
+					Usage: "Use TOTP seeds file in configuration file",
+					Value: "",
+				},
+				cli.StringFlag{
+					Name:  "issuer,i",
+					Usage: "Set issuer of the URI that is shown in the authenticator app",
+					Value: DefaultTOTPIssuer,
+				},
+			},
+		},
 		cli.Command{
 			Name:      "container",
 			ShortName: "c",
@@ -191,3 +292,31 @@ func genPassword(c *cli.Context) (err error) {
 	fmt.Println()
 	return nil
 }
+
+func enrollTOTP(c *cli.Context) (err error) {
+	if c.NArg() != 1 {
+		return errors.New("Parameter 'username' required")
+	}
+	username := c.Args()[0]
+
+	path := c.String("totp-file")
+	if c.String("config-file") != "" {
+		conf := Config{}
+		if err = conf.LoadFromFile(c.String("config-file")); err != nil {
+			return err
+		}
+		path = conf.TOTPFilePath
+	}
+	if path == "" {
+		return errors.New("TOTP file is required")
+	}
+
+	key, err := NewTOTP(path).Enroll(username, c.String("issuer"))
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stdout, "%s", key.URL())
+	fmt.Println()
+	return nil
+}
@@ -0,0 +1,539 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore implements ObjectStore interface on memory.
+// It is useful for testing SFTP workflows without OpenStack account.
+type MemoryStore struct {
+	config Config
+
+	// shared with the stores returned by ForContainer()
+	lock       *sync.Mutex
+	containers map[string]map[string]*memoryObject
+}
+
+type memoryObject struct {
+	data         []byte
+	lastModified time.Time
+	metadata     map[string]string
+
+	// the object name that the symlink points to
+	symlinkTarget string
+
+	// segments of the large object
+	segments []Segment
+}
+
+func NewMemoryStore(c Config) *MemoryStore {
+	return &MemoryStore{
+		config:     c,
+		lock:       &sync.Mutex{},
+		containers: map[string]map[string]*memoryObject{},
+	}
+}
+
+func (s *MemoryStore) ForContainer(container string) (ObjectStore, error) {
+	c := s.config
+	c.Container = container
+
+	return &MemoryStore{
+		config:     c,
+		lock:       s.lock,
+		containers: s.containers,
+	}, nil
+}
+
+func (s *MemoryStore) Init() error {
+	return nil
+}
+
+func (s *MemoryStore) ListContainer() (list []ContainerInfo, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	list = make([]ContainerInfo, 0, len(s.containers))
+	for name, objs := range s.containers {
+		info := ContainerInfo{
+			Name:  name,
+			Count: int64(len(objs)),
+		}
+		for _, obj := range objs {
+			info.Bytes += int64(len(obj.data))
+		}
+		list = append(list, info)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list, nil
+}
+
+func (s *MemoryStore) ExistsContainer() (exists bool, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	_, exists = s.containers[s.config.Container]
+	return exists, nil
+}
+
+func (s *MemoryStore) CreateContainer() (err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.containers[s.config.Container]; !ok {
+		s.containers[s.config.Container] = map[string]*memoryObject{}
+	}
+	return nil
+}
+
+// Usage returns the usage without quotas. The account usage is the sum of all containers.
+func (s *MemoryStore) Usage() (*StorageUsage, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	objs, ok := s.containers[s.config.Container]
+	if !ok {
+		return nil, ErrContainerNotFound
+	}
+
+	u := &StorageUsage{
+		Count: int64(len(objs)),
+	}
+	for name, c := range s.containers {
+		for _, obj := range c {
+			if name == s.config.Container {
+				u.Bytes += int64(len(obj.data))
+			}
+			u.AccountBytes += int64(len(obj.data))
+		}
+	}
+	return u, nil
+}
+
+func (s *MemoryStore) DeleteContainer() (err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.containers[s.config.Container]; !ok {
+		return ErrContainerNotFound
+	}
+	delete(s.containers, s.config.Container)
+	return nil
+}
+
+func (s *MemoryStore) List(prefix, delimiter string, limit int) (ls []ObjectInfo, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	objs, ok := s.containers[s.config.Container]
+	if !ok {
+		return nil, ErrContainerNotFound
+	}
+
+	ls = make([]ObjectInfo, 0, len(objs))
+	subdirs := map[string]bool{}
+	for name, obj := range objs {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+
+		// roll up the names into pseudo-directory like Swift does
+		if delimiter != "" {
+			if pos := strings.Index(name[len(prefix):], delimiter); pos >= 0 {
+				dir := name[:len(prefix)+pos+len(delimiter)]
+				if !subdirs[dir] {
+					subdirs[dir] = true
+					ls = append(ls, ObjectInfo{Name: dir, Subdir: true})
+				}
+				continue
+			}
+		}
+
+		ls = append(ls, *obj.info(name))
+	}
+
+	// Swift returns the objects in lexical order
+	sort.Slice(ls, func(i, j int) bool {
+		return ls[i].Name < ls[j].Name
+	})
+	if limit > 0 && len(ls) > limit {
+		ls = ls[:limit]
+	}
+	return ls, nil
+}
+
+func (s *MemoryStore) Get(name string) (info *ObjectInfo, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	obj, err := s.object(name)
+	if err != nil {
+		return nil, err
+	}
+	return obj.info(name), nil
+}
+
+func (s *MemoryStore) Download(name string) (content io.ReadCloser, size int64, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	obj, err := s.follow(name)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// obj.data is never modified after Put(), so it's safe to share it with the reader.
+	return ioutil.NopCloser(bytes.NewReader(obj.data)), int64(len(obj.data)), nil
+}
+
+func (s *MemoryStore) DownloadRange(name string, offset, length int64) (content io.ReadCloser, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	obj, err := s.follow(name)
+	if err != nil {
+		return nil, err
+	}
+
+	size := int64(len(obj.data))
+	if offset < 0 || offset >= size {
+		return nil, fmt.Errorf("Invalid range (offset=%d, size=%d)", offset, size)
+	}
+
+	end := size
+	if length >= 0 && offset+length < size {
+		end = offset + length
+	}
+	return ioutil.NopCloser(bytes.NewReader(obj.data[offset:end])), nil
+}
+
+func (s *MemoryStore) Put(name string, content io.Reader) error {
+	return s.put(name, content, false)
+}
+
+func (s *MemoryStore) PutExclusive(name string, content io.Reader) error {
+	return s.put(name, content, true)
+}
+
+func (s *MemoryStore) put(name string, content io.Reader, exclusive bool) error {
+	data, err := ioutil.ReadAll(content)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	objs, ok := s.containers[s.config.Container]
+	if !ok {
+		return ErrContainerNotFound
+	} else if _, exists := objs[name]; exists && exclusive {
+		return ErrObjectExists
+	}
+
+	s.replace(objs, name, &memoryObject{
+		data:         data,
+		lastModified: time.Now(),
+	})
+	return nil
+}
+
+func (s *MemoryStore) Delete(name string) (err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	obj, err := s.object(name)
+	if err != nil {
+		return err
+	}
+	delete(s.containers[s.config.Container], name)
+
+	// The segments of the large object are deleted with it.
+	s.deleteSegments(obj.segments)
+	return nil
+}
+
+func (s *MemoryStore) Rename(oldName, newName string) (err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	obj, err := s.object(oldName)
+	if err != nil {
+		return err
+	} else if oldName == newName {
+		return nil
+	}
+
+	objs := s.containers[s.config.Container]
+	s.replace(objs, newName, &memoryObject{
+		data:         obj.data,
+		lastModified: time.Now(),
+		metadata:     obj.metadata,
+		segments:     obj.segments,
+
+		symlinkTarget: obj.symlinkTarget,
+	})
+	delete(objs, oldName)
+	return nil
+}
+
+func (s *MemoryStore) Copy(src, dst string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// COPY request copies the object that the symlink points to.
+	obj, err := s.follow(src)
+	if err != nil {
+		return err
+	} else if src == dst {
+		return nil
+	}
+
+	metadata := map[string]string{}
+	for k, v := range obj.metadata {
+		metadata[k] = v
+	}
+
+	objs := s.containers[s.config.Container]
+	s.replace(objs, dst, &memoryObject{
+		data:         obj.data,
+		lastModified: time.Now(),
+		metadata:     metadata,
+	})
+	return nil
+}
+
+func (s *MemoryStore) SetMetadata(name string, metadata map[string]string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	obj, err := s.object(name)
+	if err != nil {
+		return err
+	}
+
+	obj.metadata = map[string]string{}
+	for k, v := range metadata {
+		obj.metadata[http.CanonicalHeaderKey(k)] = v
+	}
+	return nil
+}
+
+func (s *MemoryStore) PutSymlink(name, target string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	objs, ok := s.containers[s.config.Container]
+	if !ok {
+		return ErrContainerNotFound
+	}
+
+	s.replace(objs, name, &memoryObject{
+		data:          []byte{},
+		lastModified:  time.Now(),
+		symlinkTarget: target,
+	})
+	return nil
+}
+
+func (s *MemoryStore) PutSegment(name string, content io.Reader) (seg Segment, err error) {
+	data, err := ioutil.ReadAll(content)
+	if err != nil {
+		return seg, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	objs, ok := s.containers[s.config.SegmentContainerName()]
+	if !ok {
+		objs = map[string]*memoryObject{}
+		s.containers[s.config.SegmentContainerName()] = objs
+	}
+
+	obj := &memoryObject{
+		data:         data,
+		lastModified: time.Now(),
+	}
+	objs[name] = obj
+
+	seg = Segment{
+		Path: Delimiter + s.config.SegmentContainerName() + Delimiter + name,
+		ETag: obj.info(name).Hash,
+		Size: int64(len(data)),
+	}
+	return seg, nil
+}
+
+func (s *MemoryStore) PutManifest(name string, segments []Segment) error {
+	return s.putManifest(name, segments, false)
+}
+
+func (s *MemoryStore) PutManifestExclusive(name string, segments []Segment) error {
+	return s.putManifest(name, segments, true)
+}
+
+func (s *MemoryStore) putManifest(name string, segments []Segment, exclusive bool) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	objs, ok := s.containers[s.config.Container]
+	if !ok {
+		return ErrContainerNotFound
+	} else if _, exists := objs[name]; exists && exclusive {
+		return ErrObjectExists
+	}
+
+	// concatenate the segments
+	data := make([]byte, 0)
+	for _, seg := range segments {
+		container, segname := splitSegmentPath(seg.Path)
+		sobj, ok := s.containers[container][segname]
+		if !ok {
+			return fmt.Errorf("Segment '%s' not found", seg.Path)
+		} else if sobj.info(segname).Hash != seg.ETag {
+			return fmt.Errorf("Etag of segment '%s' mismatched", seg.Path)
+		}
+		data = append(data, sobj.data...)
+	}
+
+	// A single segment becomes a normal object
+	if len(segments) == 1 {
+		s.replace(objs, name, &memoryObject{
+			data:         data,
+			lastModified: time.Now(),
+		})
+		s.deleteSegments(segments)
+		return nil
+	}
+
+	s.replace(objs, name, &memoryObject{
+		data:         data,
+		lastModified: time.Now(),
+		segments:     segments,
+	})
+	return nil
+}
+
+func (s *MemoryStore) DeleteSegments(segments []Segment) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.deleteSegments(segments)
+	return nil
+}
+
+func (s *MemoryStore) GetSegments(name string) ([]Segment, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	obj, err := s.object(name)
+	if err != nil {
+		return nil, err
+	} else if obj.segments == nil {
+		return nil, nil
+	}
+	return append([]Segment{}, obj.segments...), nil
+}
+
+func (s *MemoryStore) CopyToSegment(name, segname string) (seg Segment, err error) {
+	s.lock.Lock()
+	obj, err := s.object(name)
+	s.lock.Unlock()
+	if err != nil {
+		return seg, err
+	}
+	return s.PutSegment(segname, bytes.NewReader(obj.data))
+}
+
+// replace stores the object, and deletes the segments of the replaced large object
+// that the new object doesn't use. The caller must hold s.lock.
+func (s *MemoryStore) replace(objs map[string]*memoryObject, name string, obj *memoryObject) {
+	if old, ok := objs[name]; ok {
+		s.deleteSegments(unusedSegments(old.segments, obj.segments))
+	}
+	objs[name] = obj
+}
+
+// deleteSegments deletes the segments. The caller must hold s.lock.
+func (s *MemoryStore) deleteSegments(segments []Segment) {
+	for _, seg := range segments {
+		container, segname := splitSegmentPath(seg.Path)
+		if objs, ok := s.containers[container]; ok {
+			delete(objs, segname)
+		}
+	}
+}
+
+// object returns the object in the container. The caller must hold s.lock.
+func (s *MemoryStore) object(name string) (*memoryObject, error) {
+	objs, ok := s.containers[s.config.Container]
+	if !ok {
+		return nil, ErrContainerNotFound
+	}
+
+	obj, ok := objs[name]
+	if !ok {
+		return nil, ErrObjectNotFound
+	}
+	return obj, nil
+}
+
+// Max number of the symlinks that follow() goes through (the default of Swift)
+const maxSymlinkHops = 2
+
+// follow returns the object that the symlink points to like Swift does on GET request.
+// The caller must hold s.lock.
+func (s *MemoryStore) follow(name string) (*memoryObject, error) {
+	obj, err := s.object(name)
+	for hops := 0; err == nil && obj.symlinkTarget != ""; hops++ {
+		if hops >= maxSymlinkHops {
+			return nil, fmt.Errorf("Too many levels of symlinks '%s'", name)
+		}
+
+		target := obj.symlinkTarget
+		if !strings.HasPrefix(target, Delimiter) {
+			obj, err = s.object(target)
+			continue
+		}
+
+		// the symlink to the other container
+		container, tname := splitSegmentPath(target)
+		if obj = s.containers[container][tname]; obj == nil {
+			err = ErrObjectNotFound
+		}
+	}
+	return obj, err
+}
+
+func (obj *memoryObject) info(name string) *ObjectInfo {
+	metadata := map[string]string{}
+	for k, v := range obj.metadata {
+		metadata[k] = v
+	}
+
+	h := md5.Sum(obj.data)
+	return &ObjectInfo{
+		Name:         name,
+		Bytes:        int64(len(obj.data)),
+		LastModified: obj.lastModified,
+		ContentType:  "application/octet-stream",
+		Hash:         hex.EncodeToString(h[:]),
+		Metadata:     metadata,
+
+		SymlinkTarget: obj.symlinkTarget,
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestMemoryStore(t *testing.T) {
+	c := defaultConfigForTesting()
+	s := NewMemoryStore(c)
+
+	if err := s.Put("foo.dat", bytes.NewReader([]byte("foo"))); err != ErrContainerNotFound {
+		t.Errorf("Put() should fail without container [%v]", err)
+	}
+
+	if err := s.CreateContainer(); err != nil {
+		t.Fatal(err)
+	}
+
+	if exists, _ := s.ExistsContainer(); !exists {
+		t.Errorf("Container '%s' does not exist", c.Container)
+	}
+
+	data := []byte("This is test data.")
+	if err := s.Put("foo.dat", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Rename("foo.dat", "bar.dat"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Get("foo.dat"); err != ErrObjectNotFound {
+		t.Errorf("Renamed object should not exist [%v]", err)
+	}
+
+	r, size, err := s.Download("bar.dat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	downloaded, _ := ioutil.ReadAll(r)
+	if !bytes.Equal(downloaded, data) || size != int64(len(data)) {
+		t.Errorf("Wrong downloaded data")
+	}
+
+	list, err := s.ListContainer()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(list) != 1 || list[0].Count != 1 || list[0].Bytes != int64(len(data)) {
+		t.Errorf("Wrong container info %v", list)
+	}
+
+	if err = s.DeleteContainer(); err != nil {
+		t.Error(err)
+	}
+	if _, err = s.List("", "", 0); err != ErrContainerNotFound {
+		t.Errorf("List() should fail after deleting container [%v]", err)
+	}
+}
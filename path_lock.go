@@ -0,0 +1,67 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// pathLocks serializes the operations on the same object names.
+// The operations on the other names run concurrently.
+type pathLocks struct {
+	m     sync.Mutex
+	locks map[string]*pathLock
+}
+
+type pathLock struct {
+	sync.Mutex
+	refs int // number of the goroutines that hold or wait for the lock
+}
+
+// Lock locks the names and returns the function to unlock them.
+// The names are locked in sorted order to avoid deadlock.
+func (l *pathLocks) Lock(names ...string) (unlock func()) {
+	names = append([]string{}, names...)
+	sort.Strings(names)
+
+	held := make([]string, 0, len(names))
+	for i, name := range names {
+		if i > 0 && name == names[i-1] {
+			continue
+		}
+		l.get(name).Lock()
+		held = append(held, name)
+	}
+
+	return func() {
+		for i := len(held) - 1; i >= 0; i-- {
+			l.release(held[i])
+		}
+	}
+}
+
+func (l *pathLocks) get(name string) *pathLock {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if l.locks == nil {
+		l.locks = map[string]*pathLock{}
+	}
+	pl, ok := l.locks[name]
+	if !ok {
+		pl = &pathLock{}
+		l.locks[name] = pl
+	}
+	pl.refs++
+	return pl
+}
+
+func (l *pathLocks) release(name string) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	pl := l.locks[name]
+	pl.Unlock()
+	if pl.refs--; pl.refs == 0 {
+		delete(l.locks, name)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPathLocks(t *testing.T) {
+	var l pathLocks
+
+	// the same name is serialized
+	unlock := l.Lock("a", "b")
+	locked := make(chan struct{})
+	go func() {
+		u := l.Lock("b", "c")
+		close(locked)
+		u()
+	}()
+
+	select {
+	case <-locked:
+		t.Fatal("The name was locked twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// the other names are not blocked
+	done := make(chan struct{})
+	go func() {
+		l.Lock("c", "d", "d")()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("The other name was blocked")
+	}
+
+	unlock()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("The name wasn't unlocked")
+	}
+
+	// no deadlock with the reversed order
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(2)
+		go func() {
+			l.Lock("x", "y")()
+			wg.Done()
+		}()
+		go func() {
+			l.Lock("y", "x")()
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+
+	if len(l.locks) != 0 {
+		t.Errorf("The locks are left %v", l.locks)
+	}
+}
@@ -0,0 +1,537 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// scpCommand is the command line of "scp -t" (sink) or "scp -f" (source) that
+// the scp client runs on the server in the legacy SCP mode.
+type scpCommand struct {
+	sink        bool // -t: the client uploads the files
+	source      bool // -f: the client downloads the files
+	recursive   bool // -r
+	preserve    bool // -p: modification times and modes
+	targetIsDir bool // -d: the target must be a directory
+	paths       []string
+}
+
+// parseScpCommand parses the command of the exec request.
+func parseScpCommand(command string) (*scpCommand, error) {
+	args, err := splitCommand(command)
+	if err != nil {
+		return nil, err
+	} else if len(args) == 0 || path.Base(args[0]) != "scp" {
+		return nil, fmt.Errorf("Unsupported command '%s'", command)
+	}
+
+	cmd := &scpCommand{}
+	i := 1
+	for ; i < len(args) && strings.HasPrefix(args[i], "-"); i++ {
+		if args[i] == "--" {
+			i++
+			break
+		}
+
+		for _, c := range args[i][1:] {
+			switch c {
+			case 't':
+				cmd.sink = true
+			case 'f':
+				cmd.source = true
+			case 'r':
+				cmd.recursive = true
+			case 'p':
+				cmd.preserve = true
+			case 'd':
+				cmd.targetIsDir = true
+			case 'v', 'q':
+				// verbose and quiet are ignored
+			default:
+				return nil, fmt.Errorf("Unsupported option '-%c' of scp", c)
+			}
+		}
+	}
+	cmd.paths = args[i:]
+
+	if cmd.sink == cmd.source {
+		return nil, errors.New("Either -t or -f is required for scp")
+	} else if len(cmd.paths) == 0 || (cmd.sink && len(cmd.paths) != 1) {
+		return nil, errors.New("Invalid paths for scp")
+	}
+	return cmd, nil
+}
+
+// StartScpSession runs the SCP protocol on the channel for "exec scp" request.
+// The files are read and written through SwiftFS like SFTP sessions.
+// It returns the exit status for the client.
+func StartScpSession(conf Config, store ObjectStore, channel ssh.Channel, client *Client, cmd *scpCommand) (status int, err error) {
+	// logger with client
+	clog := log.WithFields(logrus.Fields{
+		"client": client,
+	})
+
+	clog.Debug("Starting SCP session.")
+
+	fs, err := newSessionFS(conf, store, client, clog)
+	if err != nil {
+		return 1, err
+	}
+
+	s := &scpSession{
+		fs:      fs,
+		log:     clog,
+		cmd:     cmd,
+		channel: channel,
+		r:       bufio.NewReader(channel),
+	}
+
+	if cmd.sink {
+		err = s.sink(cmd.paths[0])
+	} else {
+		err = s.source(cmd.paths)
+	}
+
+	if err == io.EOF {
+		err = nil
+	}
+	if err != nil || s.failed {
+		status = 1
+	}
+	clog.Debugf("End scp session (status=%d)", status)
+	return status, err
+}
+
+type scpSession struct {
+	fs      *SwiftFS
+	log     *logrus.Entry
+	cmd     *scpCommand
+	channel io.Writer
+	r       *bufio.Reader
+
+	failed bool // some files couldn't be transferred
+}
+
+// Modification and access times of "T" message
+type scpTimes struct {
+	mtime int64
+	atime int64
+}
+
+// scpError is the error message from the other side
+type scpError struct {
+	msg   string
+	fatal bool
+}
+
+func (e *scpError) Error() string {
+	return e.msg
+}
+
+// Size of the buffer to transfer the files
+const scpBufferSize = 32 * 1024
+
+func (s *scpSession) ack() error {
+	_, err := s.channel.Write([]byte{0})
+	return err
+}
+
+// warn sends the error of the file to the client. The client shows it and continues.
+func (s *scpSession) warn(p string, err error) error {
+	s.failed = true
+	s.log.Warnf("SCP %s %v", p, err)
+	_, werr := fmt.Fprintf(s.channel, "\x01scp: %s: %v\n", p, err)
+	return werr
+}
+
+// fatal sends the error to the client and stops the session.
+func (s *scpSession) fatal(msg string) error {
+	s.failed = true
+	s.log.Warnf("SCP %s", msg)
+	fmt.Fprintf(s.channel, "\x02scp: %s\n", msg)
+	return errors.New(msg)
+}
+
+// readAck reads the response of the client. The error message from it is returned as *scpError.
+func (s *scpSession) readAck() error {
+	c, err := s.r.ReadByte()
+	if err != nil {
+		return err
+	} else if c == 0 {
+		return nil
+	}
+
+	msg, err := s.r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	return &scpError{
+		msg:   strings.TrimSuffix(msg, "\n"),
+		fatal: c != 1,
+	}
+}
+
+// sink receives the files from the client (scp -t).
+func (s *scpSession) sink(target string) error {
+	targetIsDir := false
+	if fi, err := s.fs.stat(target); err == nil {
+		targetIsDir = fi.IsDir()
+	}
+	if s.cmd.targetIsDir && !targetIsDir {
+		return s.fatal(fmt.Sprintf("%s: Not a directory", target))
+	}
+
+	// The files are written into the directory at the top of the stack.
+	// The empty name means the target itself.
+	dirs := []string{""}
+	if targetIsDir {
+		dirs[0] = target
+	}
+
+	if err := s.ack(); err != nil {
+		return err
+	}
+
+	var times *scpTimes
+	for {
+		line, err := s.r.ReadString('\n')
+		if err != nil {
+			return err
+		} else if len(line) < 2 {
+			return s.fatal("Protocol error: unexpected message")
+		}
+		msg := line[1 : len(line)-1]
+
+		switch line[0] {
+		case 'T':
+			var musec, ausec int64
+			times = &scpTimes{}
+			if _, err = fmt.Sscanf(msg, "%d %d %d %d", &times.mtime, &musec, &times.atime, &ausec); err != nil {
+				return s.fatal("Protocol error: invalid times")
+			}
+			if err = s.ack(); err != nil {
+				return err
+			}
+
+		case 'C', 'D':
+			mode, size, name, err := parseScpEntry(msg)
+			if err != nil {
+				return s.fatal(fmt.Sprintf("Protocol error: %v", err))
+			}
+
+			p := dirs[len(dirs)-1]
+			if p == "" {
+				p = target
+			} else {
+				p = path.Join(p, name)
+			}
+
+			if line[0] == 'C' {
+				err = s.receiveFile(p, size, mode, times)
+			} else if !s.cmd.recursive {
+				return s.fatal("Received directory without -r")
+			} else if err = s.receiveDir(p); err == nil {
+				dirs = append(dirs, p)
+			}
+			times = nil
+
+			if err != nil {
+				if err = s.warn(p, err); err != nil {
+					return err
+				}
+			} else if err = s.ack(); err != nil {
+				return err
+			}
+
+		case 'E':
+			if len(dirs) == 1 {
+				return s.fatal("Protocol error: unexpected end of directory")
+			}
+			dirs = dirs[:len(dirs)-1]
+			if err = s.ack(); err != nil {
+				return err
+			}
+
+		case 1, 2:
+			s.log.Warnf("SCP client error: %s", line[1:len(line)-1])
+			s.failed = true
+			if line[0] == 2 {
+				return nil
+			}
+
+		default:
+			return s.fatal("Protocol error: unexpected message")
+		}
+	}
+}
+
+// parseScpEntry parses "C" or "D" message ("[mode] [size] [name]").
+func parseScpEntry(msg string) (mode os.FileMode, size int64, name string, err error) {
+	fields := strings.SplitN(msg, " ", 3)
+	if len(fields) != 3 {
+		return 0, 0, "", errors.New("invalid entry")
+	}
+
+	m, err := strconv.ParseUint(fields[0], 8, 32)
+	if err != nil {
+		return 0, 0, "", errors.New("invalid mode")
+	}
+	if size, err = strconv.ParseInt(fields[1], 10, 64); err != nil || size < 0 {
+		return 0, 0, "", errors.New("invalid size")
+	}
+
+	name = fields[2]
+	if name == "" || name == "." || name == ".." || strings.Contains(name, Delimiter) {
+		return 0, 0, "", fmt.Errorf("invalid name '%s'", name)
+	}
+	return os.FileMode(m) & os.ModePerm, size, name, nil
+}
+
+// receiveFile writes the content from the client to the file.
+// The content is always read to the end to keep the protocol in sync.
+func (s *scpSession) receiveFile(p string, size int64, mode os.FileMode, times *scpTimes) error {
+	req := sftp.NewRequest("Put", p)
+	req.Flags = 0x02 | 0x08 | 0x10 // SSH_FXF_WRITE | SSH_FXF_CREAT | SSH_FXF_TRUNC
+	w, err := s.fs.Filewrite(req)
+
+	if err := s.ack(); err != nil {
+		return err
+	}
+
+	buf := make([]byte, scpBufferSize)
+	for offset := int64(0); offset < size; {
+		n := int64(len(buf))
+		if size-offset < n {
+			n = size - offset
+		}
+		if _, rerr := io.ReadFull(s.r, buf[:n]); rerr != nil {
+			// The stream is dropped. Don't replace the file with the partial content.
+			if w != nil {
+				w.(*swiftWriter).Abort()
+			}
+			return rerr
+		}
+
+		if err == nil {
+			_, err = w.WriteAt(buf[:n], offset)
+		}
+		offset += n
+	}
+
+	// The client sends the status after the content.
+	if rerr := s.readAck(); rerr != nil {
+		if _, ok := rerr.(*scpError); !ok {
+			return rerr
+		}
+		s.log.Warnf("SCP client error: %v", rerr)
+		err = rerr
+	}
+
+	if w != nil && err != nil {
+		// The content may be broken. Keep the original file.
+		w.(*swiftWriter).Abort()
+	} else if w != nil {
+		err = w.(io.Closer).Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	if s.cmd.preserve {
+		return s.fs.Filecmd(scpSetstatRequest(p, mode, times))
+	}
+	return nil
+}
+
+// receiveDir creates the directory if it doesn't exist.
+func (s *scpSession) receiveDir(p string) error {
+	if fi, err := s.fs.stat(p); err == nil {
+		if !fi.IsDir() {
+			return errors.New("Not a directory")
+		}
+		return nil
+	}
+	return s.fs.Filecmd(sftp.NewRequest("Mkdir", p))
+}
+
+// scpSetstatRequest creates Setstat request for the mode and the times of -p option.
+func scpSetstatRequest(p string, mode os.FileMode, times *scpTimes) *sftp.Request {
+	buf := new(bytes.Buffer)
+	flags := uint32(0x04) // SSH_FILEXFER_ATTR_PERMISSIONS
+	binary.Write(buf, binary.BigEndian, uint32(mode))
+	if times != nil {
+		flags |= 0x08 // SSH_FILEXFER_ATTR_ACMODTIME
+		binary.Write(buf, binary.BigEndian, uint32(times.atime))
+		binary.Write(buf, binary.BigEndian, uint32(times.mtime))
+	}
+
+	req := sftp.NewRequest("Setstat", p)
+	req.Flags = flags
+	req.Attrs = buf.Bytes()
+	return req
+}
+
+// source sends the files to the client (scp -f).
+func (s *scpSession) source(paths []string) error {
+	// The client is ready
+	if err := s.readAck(); err != nil {
+		return err
+	}
+
+	for _, p := range paths {
+		fi, err := s.fs.stat(p)
+		if err != nil {
+			err = s.warn(p, err)
+		} else {
+			err = s.send(p, fi)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// send sends the file or the directory. The errors of the file are sent to the client as warnings.
+func (s *scpSession) send(p string, fi os.FileInfo) error {
+	if fi.IsDir() {
+		if !s.cmd.recursive {
+			return s.warn(p, errors.New("not a regular file"))
+		}
+		return s.sendDir(p, fi)
+	}
+	return s.sendFile(p, fi)
+}
+
+func (s *scpSession) sendFile(p string, fi os.FileInfo) error {
+	r, err := s.fs.Fileread(sftp.NewRequest("Get", p))
+	if err != nil {
+		return s.warn(p, err)
+	}
+	defer r.(io.Closer).Close()
+
+	if err = s.sendHeader(fmt.Sprintf("C%04o %d %s\n", fi.Mode()&os.ModePerm, fi.Size(), scpName(p)), fi); err != nil {
+		return s.skipped(p, err)
+	}
+
+	n, err := io.CopyBuffer(s.channel, io.NewSectionReader(r, 0, fi.Size()), make([]byte, scpBufferSize))
+	if err == nil && n < fi.Size() {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		// Fill the rest to keep the protocol in sync, and then send the error instead of the status.
+		zero := make([]byte, scpBufferSize)
+		for rest := fi.Size() - n; rest > 0; rest -= int64(len(zero)) {
+			if rest < int64(len(zero)) {
+				zero = zero[:rest]
+			}
+			if _, werr := s.channel.Write(zero); werr != nil {
+				return werr
+			}
+		}
+		if err = s.warn(p, err); err != nil {
+			return err
+		}
+	} else if err = s.ack(); err != nil {
+		return err
+	}
+
+	return s.skipped(p, s.readAck())
+}
+
+func (s *scpSession) sendDir(p string, fi os.FileInfo) error {
+	l, err := s.fs.Filelist(sftp.NewRequest("List", p))
+	if err != nil {
+		return s.warn(p, err)
+	}
+
+	if err = s.sendHeader(fmt.Sprintf("D%04o 0 %s\n", fi.Mode()&os.ModePerm, scpName(p)), fi); err != nil {
+		return s.skipped(p, err)
+	}
+
+	list := make([]os.FileInfo, 100)
+	for offset := int64(0); ; {
+		n, lerr := l.ListAt(list, offset)
+		for _, child := range list[:n] {
+			cp := path.Join(p, child.Name())
+			if child.Mode()&os.ModeSymlink != 0 || s.cmd.preserve {
+				// The symlink is sent as the file that it points to, and the listing
+				// may not have the modes and the modification times.
+				if child, err = s.fs.stat(cp); err != nil {
+					if err = s.warn(cp, err); err != nil {
+						return err
+					}
+					continue
+				}
+			}
+
+			if err = s.send(cp, child); err != nil {
+				return err
+			}
+		}
+		offset += int64(n)
+
+		if lerr != nil || n == 0 {
+			break
+		}
+	}
+
+	if _, err = s.channel.Write([]byte("E\n")); err != nil {
+		return err
+	}
+	return s.skipped(p, s.readAck())
+}
+
+// sendHeader sends "T" message if -p is given, and then the message of the file or the directory.
+func (s *scpSession) sendHeader(header string, fi os.FileInfo) error {
+	if s.cmd.preserve {
+		mtime := fi.ModTime().Unix()
+		if mtime < 0 {
+			mtime = time.Now().Unix()
+		}
+		if _, err := fmt.Fprintf(s.channel, "T%d 0 %d 0\n", mtime, mtime); err != nil {
+			return err
+		} else if err = s.readAck(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := s.channel.Write([]byte(header)); err != nil {
+		return err
+	}
+	return s.readAck()
+}
+
+// skipped logs the error message from the client that skipped the file.
+// The other errors are returned to stop the session.
+func (s *scpSession) skipped(p string, err error) error {
+	if serr, ok := err.(*scpError); ok && !serr.fatal {
+		s.failed = true
+		s.log.Warnf("SCP %s client error: %s", p, serr.msg)
+		return nil
+	}
+	return err
+}
+
+// scpName returns the name of the file in the messages.
+func scpName(p string) string {
+	name := path.Base(path.Clean(Delimiter + p))
+	if name == Delimiter {
+		return "."
+	}
+	return name
+}
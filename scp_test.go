@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pkg/sftp"
+)
+
+func TestParseScpCommand(t *testing.T) {
+	tests := map[string]*scpCommand{
+		"scp -t /upload":                {sink: true, paths: []string{"/upload"}},
+		"scp -r -p -d -t -- /upload":    {sink: true, recursive: true, preserve: true, targetIsDir: true, paths: []string{"/upload"}},
+		"/usr/bin/scp -v -rpf a.txt b":  {source: true, recursive: true, preserve: true, paths: []string{"a.txt", "b"}},
+		`scp -f 'my files/a b.txt'`:     {source: true, paths: []string{"my files/a b.txt"}},
+		`scp -f "it's.txt" with\ space`: {source: true, paths: []string{"it's.txt", "with space"}},
+		"scp -t /a /b":                  nil,
+		"scp -x -t /upload":             nil,
+		"scp -t -f /upload":             nil,
+		"scp -t":                        nil,
+		"ls -l":                         nil,
+		"scp -f 'unterminated":          nil,
+		"rm -rf /; scp -t /upload":      nil,
+		"scp -t /upload; rm -rf /":      nil,
+		"scp -t -- -upload":             {sink: true, paths: []string{"-upload"}},
+		"":                              nil,
+		"scp -t \\":                     nil,
+		"scp -f -- a":                   {source: true, paths: []string{"a"}},
+		"scp -q -t 'quoted \"double\"'": {sink: true, paths: []string{`quoted "double"`}},
+	}
+
+	for command, expected := range tests {
+		cmd, err := parseScpCommand(command)
+		if expected == nil {
+			if err == nil {
+				t.Errorf("'%s' should be rejected", command)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("'%s' should be accepted [%v]", command, err)
+		} else if !reflect.DeepEqual(cmd, expected) {
+			t.Errorf("'%s' was parsed wrongly %+v", command, cmd)
+		}
+	}
+}
+
+// scpClientForTesting runs the SCP session and returns the pipes to talk with it as the client.
+func scpClientForTesting(t *testing.T, fs *SwiftFS, cmd *scpCommand) (*bufio.Reader, io.WriteCloser, <-chan error) {
+	serverIn, clientOut := io.Pipe()
+	clientIn, serverOut := io.Pipe()
+
+	s := &scpSession{
+		fs:      fs,
+		log:     log,
+		cmd:     cmd,
+		channel: serverOut,
+		r:       bufio.NewReader(serverIn),
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		var err error
+		if cmd.sink {
+			err = s.sink(cmd.paths[0])
+		} else {
+			err = s.source(cmd.paths)
+		}
+		if err == io.EOF {
+			err = nil
+		}
+		serverOut.Close()
+		done <- err
+	}()
+
+	return bufio.NewReader(clientIn), clientOut, done
+}
+
+func scpExpect(t *testing.T, r *bufio.Reader, expected string) {
+	buf := make([]byte, len(expected))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatalf("Couldn't read '%q' [%v]", expected, err)
+	} else if string(buf) != expected {
+		t.Fatalf("Wrong response %q (expected=%q)", buf, expected)
+	}
+}
+
+func TestScpSinkAndSource(t *testing.T) {
+	s := storeForTesting()
+	fs := NewSwiftFS(s, defaultConfigForTesting())
+
+	if err := fs.Filecmd(sftp.NewRequest("Mkdir", "/scp-test")); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Delete("scp-test/")
+	defer s.Delete("scp-test/upload/")
+	defer s.Delete("scp-test/upload/a.txt")
+
+	// scp -r -p upload host:/scp-test
+	r, w, done := scpClientForTesting(t, fs, &scpCommand{sink: true, recursive: true, preserve: true, paths: []string{"/scp-test"}})
+	scpExpect(t, r, "\x00")
+	for _, msg := range []string{"D0755 0 upload\n", "T1500000000 0 1500000000 0\n", "C0600 5 a.txt\n"} {
+		io.WriteString(w, msg)
+		scpExpect(t, r, "\x00")
+	}
+	io.WriteString(w, "hello\x00")
+	scpExpect(t, r, "\x00")
+	io.WriteString(w, "E\n")
+	scpExpect(t, r, "\x00")
+	w.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	body, _, err := s.Download("scp-test/upload/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := ioutil.ReadAll(body)
+	body.Close()
+	if string(content) != "hello" {
+		t.Errorf("Wrong content '%s'", content)
+	}
+
+	info, err := s.Get("scp-test/upload/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	} else if info.Metadata[MetaMode] != "600" || info.Metadata[MetaMtime] != "1500000000" {
+		t.Errorf("Mode and times should be preserved %v", info.Metadata)
+	}
+
+	// scp -r -p host:/scp-test/upload .
+	r, w, done = scpClientForTesting(t, fs, &scpCommand{source: true, recursive: true, preserve: true, paths: []string{"/scp-test/upload"}})
+	io.WriteString(w, "\x00")
+	for _, prefix := range []string{"T", "D0755 0 upload\n", "T1500000000 0 1500000000 0\n", "C0600 5 a.txt\n", "hello\x00", "E\n"} {
+		if prefix == "T" {
+			line, err := r.ReadString('\n')
+			if err != nil || !strings.HasPrefix(line, "T") {
+				t.Fatalf("Wrong times '%s' [%v]", line, err)
+			}
+		} else {
+			scpExpect(t, r, prefix)
+		}
+		io.WriteString(w, "\x00")
+	}
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+}
+
+func TestScpErrors(t *testing.T) {
+	s := storeForTesting()
+	fs := NewSwiftFS(s, defaultConfigForTesting())
+	fs.SetAccessMode(AccessReadOnly)
+
+	// Upload is denied, but the content is read to the end.
+	r, w, done := scpClientForTesting(t, fs, &scpCommand{sink: true, paths: []string{"/scp-denied.txt"}})
+	scpExpect(t, r, "\x00")
+	io.WriteString(w, "C0644 5 scp-denied.txt\n")
+	scpExpect(t, r, "\x00")
+	io.WriteString(w, "hello\x00")
+	line, err := r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "\x01scp: /scp-denied.txt: ") {
+		t.Errorf("Upload should be denied %q [%v]", line, err)
+	}
+	w.Close()
+	<-done
+
+	if _, err = s.Get("scp-denied.txt"); err != ErrObjectNotFound {
+		t.Errorf("The file should not be uploaded [%v]", err)
+	}
+
+	// The missing file and the directory without -r
+	if err = fs.Filecmd(sftp.NewRequest("Mkdir", "/scp-dir")); err == nil {
+		t.Fatal("Mkdir should be denied")
+	}
+	r, w, done = scpClientForTesting(t, fs, &scpCommand{source: true, paths: []string{"/scp-missing.txt", "/"}})
+	io.WriteString(w, "\x00")
+	for _, p := range []string{"/scp-missing.txt", "/"} {
+		line, err = r.ReadString('\n')
+		if err != nil || !strings.HasPrefix(line, "\x01scp: "+p+": ") {
+			t.Errorf("Error should be sent for '%s' %q [%v]", p, line, err)
+		}
+	}
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+}
+
+func TestScpInterrupted(t *testing.T) {
+	s := storeForTesting()
+	fs := NewSwiftFS(s, defaultConfigForTesting())
+
+	if err := s.Put("scp-original.txt", bytes.NewReader([]byte("original"))); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Delete("scp-original.txt")
+
+	tests := map[string]string{
+		"Dropped stream": "hel",
+		"Client error":   "hello world\x01scp: read error\n",
+	}
+	for name, content := range tests {
+		r, w, done := scpClientForTesting(t, fs, &scpCommand{sink: true, paths: []string{"/"}})
+		scpExpect(t, r, "\x00")
+		io.WriteString(w, "C0644 11 scp-original.txt\n")
+		scpExpect(t, r, "\x00")
+		go io.Copy(ioutil.Discard, r)
+
+		io.WriteString(w, content)
+		w.Close()
+		<-done
+
+		body, _, err := s.Download("scp-original.txt")
+		if err != nil {
+			t.Errorf("%s: The original file should be left [%v]", name, err)
+			continue
+		}
+		b, _ := ioutil.ReadAll(body)
+		body.Close()
+		if string(b) != "original" {
+			t.Errorf("%s: The original file should be unchanged '%s'", name, b)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/subtle"
 	"fmt"
 	"io"
@@ -9,6 +10,7 @@ import (
 	"net"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -23,30 +25,24 @@ func StartServer(conf Config) error {
 		return err
 	}
 
-	// swift
-	swift := NewSwift(conf)
-	if err = swift.Init(); err != nil {
+	// object storage
+	store, err := NewObjectStore(conf)
+	if err != nil {
 		return err
 	}
-
-	exists, err := swift.ExistsContainer()
-	if err != nil {
+	if err = store.Init(); err != nil {
 		return err
 	}
 
-	if !exists {
-		if conf.CreateContainerIfNotExists {
-			if err = swift.CreateContainer(); err != nil {
-				return fmt.Errorf("Couldn't create container. [%s]", err)
-			}
-			log.Infof("Create container '%s'", conf.Container)
-
-		} else {
-			return fmt.Errorf("Container '%s' does not exist.", conf.Container)
-		}
+	if err = prepareContainer(store, conf.Container, conf.CreateContainerIfNotExists); err != nil {
+		return err
 	}
 
-	log.Infof("Use container '%s%s'", swift.SwiftClient.Endpoint, conf.Container)
+	if swift, ok := store.(*Swift); ok {
+		log.Infof("Use container '%s%s'", swift.SwiftClient.Endpoint, conf.Container)
+	} else {
+		log.Infof("Use container '%s' on %s backend", conf.Container, conf.Backend)
+	}
 
 	// Start server
 	listener, err := net.Listen("tcp", conf.BindAddress)
@@ -87,7 +83,7 @@ func StartServer(conf Config) error {
 				log.Infof("Disconnect from %s port %s", addr, port)
 			}()
 
-			err := handleClient(conf, sConf, swift, nConn)
+			err := handleClient(conf, sConf, store, nConn)
 			if err == nil || err == io.EOF {
 				return
 			}
@@ -105,6 +101,27 @@ func StartServer(conf Config) error {
 	}
 }
 
+// Make sure that the container exists. If create is true, the container is created if not exists.
+func prepareContainer(store ObjectStore, container string, create bool) error {
+	exists, err := store.ExistsContainer()
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		if create {
+			if err = store.CreateContainer(); err != nil {
+				return fmt.Errorf("Couldn't create container. [%s]", err)
+			}
+			log.Infof("Create container '%s'", container)
+
+		} else {
+			return fmt.Errorf("Container '%s' does not exist.", container)
+		}
+	}
+	return nil
+}
+
 func initServer(conf Config) (sConf *ssh.ServerConfig, err error) {
 	sConf = &ssh.ServerConfig{
 		PublicKeyCallback: authPkey(conf),
@@ -116,6 +133,60 @@ func initServer(conf Config) (sConf *ssh.ServerConfig, err error) {
 		sConf.PasswordCallback = authPassword(conf)
 	}
 
+	// LDAP checks the password, and the public keys in the attribute of the user
+	if conf.LDAP.URL != "" {
+		l := NewLDAP(conf.LDAP)
+		sConf.PasswordCallback = authLDAPPassword(l, sConf.PasswordCallback)
+		if conf.LDAP.SSHPublicKeyAttribute != "" {
+			sConf.PublicKeyCallback = authLDAPPkey(l, sConf.PublicKeyCallback)
+		}
+
+		// The groups are read from LDAP for the local passwords, the authorized keys and the certificates as well.
+		groups := authLDAPGroups(l)
+
+		pkeyCallback := sConf.PublicKeyCallback
+		sConf.PublicKeyCallback = func(c ssh.ConnMetadata, pkey ssh.PublicKey) (*ssh.Permissions, error) {
+			perms, err := pkeyCallback(c, pkey)
+			if err != nil {
+				return nil, err
+			}
+			return groups(c, perms)
+		}
+
+		passwordCallback := sConf.PasswordCallback
+		sConf.PasswordCallback = func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			perms, err := passwordCallback(c, password)
+			if err != nil {
+				return nil, err
+			}
+			return groups(c, perms)
+		}
+	}
+
+	// Ask the TOTP code with keyboard-interactive authentication after the password or the public key
+	if conf.TOTPFilePath != "" {
+		second := authTOTP(conf, NewTOTP(conf.TOTPFilePath))
+
+		pkeyCallback := sConf.PublicKeyCallback
+		sConf.PublicKeyCallback = func(c ssh.ConnMetadata, pkey ssh.PublicKey) (*ssh.Permissions, error) {
+			perms, err := pkeyCallback(c, pkey)
+			if err != nil {
+				return nil, err
+			}
+			return second(c, perms)
+		}
+
+		if passwordCallback := sConf.PasswordCallback; passwordCallback != nil {
+			sConf.PasswordCallback = func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+				perms, err := passwordCallback(c, password)
+				if err != nil {
+					return nil, err
+				}
+				return second(c, perms)
+			}
+		}
+	}
+
 	// host private key
 	pkeyBytes, err := ioutil.ReadFile(conf.ServerKeyPath)
 	if err != nil {
@@ -133,32 +204,60 @@ func initServer(conf Config) (sConf *ssh.ServerConfig, err error) {
 
 func authPkey(conf Config) func(c ssh.ConnMetadata, pkey ssh.PublicKey) (*ssh.Permissions, error) {
 	return func(c ssh.ConnMetadata, pkey ssh.PublicKey) (*ssh.Permissions, error) {
-		authorizedKeysBytes, err := ioutil.ReadFile(conf.AuthorizedKeysPath)
+		if cert, ok := pkey.(*ssh.Certificate); ok && conf.TrustedUserCAKeysPath != "" {
+			return authCert(conf, c, cert)
+		}
+		keys, err := userAuthorizedKeys(conf, c.User())
 		if err != nil {
 			return nil, err
 		}
 
-		authorizedKeysMap := map[string]bool{}
-		for len(authorizedKeysBytes) > 0 {
-			pubKey, _, _, rest, err := ssh.ParseAuthorizedKey(authorizedKeysBytes)
-			if err != nil {
-				return nil, err
+		// The same key may be listed with the different options.
+		err = fmt.Errorf("unknown public key for %q", c.User())
+		for _, k := range keys {
+			if !bytes.Equal(k.key.Marshal(), pkey.Marshal()) {
+				continue
+			}
+			if err = k.permit(c.RemoteAddr(), time.Now()); err != nil {
+				err = fmt.Errorf("%v for %q", err, c.User())
+				continue
 			}
 
-			authorizedKeysMap[string(pubKey.Marshal())] = true
-			authorizedKeysBytes = rest
-		}
-
-		if authorizedKeysMap[string(pkey.Marshal())] {
-			return &ssh.Permissions{
+			perms := &ssh.Permissions{
+				CriticalOptions: map[string]string{},
 				// Record the public key used for authentication.
 				Extensions: map[string]string{
 					"pubkey-fp": ssh.FingerprintSHA256(pkey),
 				},
-			}, nil
+			}
+
+			// The container can be set to the key with environment="SWIFT_SFTP_CONTAINER=name" option.
+			if container := authorizedKeyContainer(k.options); container != "" {
+				perms.Extensions[permContainer] = container
+			}
+
+			// command="..." replaces the commands that the client requests.
+			if command, ok := k.option("command"); ok {
+				perms.CriticalOptions[permForceCommand] = command
+			}
+			return perms, nil
+		}
+		return nil, err
+	}
+}
+
+// Name of the extension of ssh.Permissions that holds the container for the client
+const permContainer = "container"
+
+// Return the container in environment option of authorized_keys.
+func authorizedKeyContainer(options []string) string {
+	prefix := `environment="SWIFT_SFTP_CONTAINER=`
+	for _, opt := range options {
+		if strings.HasPrefix(opt, prefix) && strings.HasSuffix(opt, `"`) {
+			return opt[len(prefix) : len(opt)-1]
 		}
-		return nil, fmt.Errorf("unknown public key for %q", c.User())
 	}
+	return ""
 }
 
 func authPassword(conf Config) func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
@@ -201,6 +300,41 @@ func authPassword(conf Config) func(c ssh.ConnMetadata, password []byte) (*ssh.P
 	}
 }
 
+// authTOTP returns the function that is called after the first factor succeeds.
+// It requires the TOTP code of the user with keyboard-interactive authentication,
+// and the permissions of the first factor are used when the code is verified.
+func authTOTP(conf Config, t *TOTP) func(c ssh.ConnMetadata, perms *ssh.Permissions) (*ssh.Permissions, error) {
+	return func(c ssh.ConnMetadata, perms *ssh.Permissions) (*ssh.Permissions, error) {
+		seed, err := t.Seed(c.User())
+		if err != nil {
+			return nil, err
+		}
+
+		if seed == "" {
+			if conf.TOTPUnenrolled == TOTPUnenrolledAllow {
+				return perms, nil
+			}
+			return nil, fmt.Errorf("TOTP is not enrolled for %q", c.User())
+		}
+
+		return nil, &ssh.PartialSuccessError{
+			Next: ssh.ServerAuthCallbacks{
+				KeyboardInteractiveCallback: func(c ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+					answers, err := client("", "", []string{"Verification code: "}, []bool{false})
+					if err != nil {
+						return nil, err
+					}
+
+					if len(answers) == 1 && t.Verify(c.User(), seed, strings.TrimSpace(answers[0]), time.Now()) {
+						return perms, nil
+					}
+					return nil, fmt.Errorf("verification code rejected for %q", c.User())
+				},
+			},
+		}
+	}
+}
+
 func generateHashedPassword(username string, plainPassword []byte) (hashed []byte, err error) {
 	return bcrypt.GenerateFromPassword([]byte(plainPassword), bcrypt.DefaultCost)
 }
@@ -209,19 +343,34 @@ func comparePasswords(hashedPassword, plainPassword []byte) error {
 	return bcrypt.CompareHashAndPassword(hashedPassword, plainPassword)
 }
 
-func handleClient(conf Config, sConf *ssh.ServerConfig, swift *Swift, nConn net.Conn) error {
+func handleClient(conf Config, sConf *ssh.ServerConfig, store ObjectStore, nConn net.Conn) error {
 	conn, chans, reqs, err := ssh.NewServerConn(nConn, sConf)
 	if err != nil {
 		return err
 	}
 
+	// groups of the user given by LDAP
+	var groups []string
+	if conn.Permissions != nil && conn.Permissions.Extensions[permGroups] != "" {
+		groups = strings.Split(conn.Permissions.Extensions[permGroups], "\n")
+	}
+
 	// create client
 	client := &Client{
 		SessionID:  fmt.Sprintf("%x", conn.SessionID()),
 		Username:   conn.User(),
+		Groups:     groups,
+		Container:  conf.UserContainer(conn.User(), groups...),
+		AccessMode: conf.UserAccessMode(conn.User(), groups...),
 		RemoteAddr: conn.RemoteAddr(),
 		StartedAt:  time.Now(),
 	}
+	if conn.Permissions != nil && conn.Permissions.Extensions[permContainer] != "" {
+		client.Container = conn.Permissions.Extensions[permContainer]
+	}
+	if conn.Permissions != nil {
+		client.ForceCommand = conn.Permissions.CriticalOptions[permForceCommand]
+	}
 
 	// logger with client
 	clog := log.WithFields(logrus.Fields{
@@ -232,6 +381,9 @@ func handleClient(conf Config, sConf *ssh.ServerConfig, swift *Swift, nConn net.
 
 	go ssh.DiscardRequests(reqs)
 
+	// Each channel is served in its own goroutine, because the clients like rclone open
+	// the other channels (e.g. "exec md5sum") while the SFTP channel is still open.
+	var wg sync.WaitGroup
 	for nchan := range chans {
 		if nchan.ChannelType() != "session" {
 			msg := fmt.Sprintf("The request was rejected because of unknown channel type. [%s]", nchan.ChannelType())
@@ -246,26 +398,120 @@ func handleClient(conf Config, sConf *ssh.ServerConfig, swift *Swift, nConn net.
 			return err
 		}
 
+		// The channel starts the session by the first request of "subsystem sftp",
+		// "exec scp -t/-f", "exec cp" or the checksum commands like "exec md5sum".
+		sessions := make(chan func() error, 1)
 		go func(in <-chan *ssh.Request) {
+			defer close(sessions)
+
+			var start func() error
 			for req := range in {
 				clog.Debugf("Handling request [type=%s]", req.Type)
 
-				// We only handle the request that has type of "subsystem".
-				ok := false
-				if req.Type == "subsystem" && string(req.Payload[4:]) == "sftp" {
-					ok = true
+				var session func() error
+				if start == nil {
+					session = newSession(conf, store, channel, client, req, clog)
+				}
+				req.Reply(session != nil, nil)
+
+				if session != nil {
+					start = session
+					sessions <- start
 				}
-				req.Reply(ok, nil)
 			}
 		}(requests)
 
-		// sftp
-		if err = StartSftpSession(swift, channel, client); err != nil {
-			return err
-		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			start, ok := <-sessions
+			if !ok {
+				channel.Close()
+				return
+			}
+			if err := start(); err != nil {
+				clog.Warnf("Session failed [%v]", err)
+				channel.Close()
+			}
+		}()
 	}
+	wg.Wait()
 
 	clog.Infof("Session closed for %s@%s", client.Username, client.RemoteAddr)
 
 	return nil
 }
+
+// newSession returns the function that runs the session for the request of the channel.
+// It returns nil if the request is not supported.
+func newSession(conf Config, store ObjectStore, channel ssh.Channel, client *Client, req *ssh.Request, clog *logrus.Entry) func() error {
+	if client.ForceCommand != "" {
+		if req = forcedRequest(req, client.ForceCommand); req == nil {
+			return nil
+		}
+	}
+
+	switch req.Type {
+	case "subsystem":
+		if len(req.Payload) < 4 || string(req.Payload[4:]) != "sftp" {
+			return nil
+		}
+		return func() error {
+			return StartSftpSession(conf, store, channel, client)
+		}
+
+	case "exec":
+		var payload struct{ Command string }
+		if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+			return nil
+		}
+
+		var run func() (int, error)
+		switch name := commandName(payload.Command); {
+		case name == "scp":
+			cmd, err := parseScpCommand(payload.Command)
+			if err != nil {
+				clog.Warnf("%s", err.Error())
+				return nil
+			}
+			run = func() (int, error) {
+				return StartScpSession(conf, store, channel, client, cmd)
+			}
+
+		case name == "cp":
+			cmd, err := parseCpCommand(payload.Command)
+			if err != nil {
+				clog.Warnf("%s", err.Error())
+				return nil
+			}
+			run = func() (int, error) {
+				return StartCpSession(conf, store, channel, client, cmd)
+			}
+
+		case checksumCommands[name] != nil:
+			cmd, err := parseChecksumCommand(payload.Command)
+			if err != nil {
+				clog.Warnf("%s", err.Error())
+				return nil
+			}
+			run = func() (int, error) {
+				return StartChecksumSession(conf, store, channel, client, cmd)
+			}
+
+		default:
+			clog.Warnf("Unsupported command '%s'", payload.Command)
+			return nil
+		}
+
+		return func() error {
+			status, err := run()
+
+			// Send the exit status to finish the command.
+			channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(status)}))
+			channel.Close()
+			return err
+		}
+	}
+	return nil
+}
@@ -1,12 +1,21 @@
 package main
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/pem"
 	"io/ioutil"
+	"net"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
 )
 
 func TestMain(m *testing.M) {
@@ -14,14 +23,14 @@ func TestMain(m *testing.M) {
 	l.SetLevel(logrus.DebugLevel)
 	log = logrus.NewEntry(l)
 
-	// config
-	c := defaultConfigForTesting()
+	// The tests run against the fake Swift unless TEST_REAL_SWIFT is set.
+	// In that case, OS_* environment variables are used to access the real one.
+	if os.Getenv("TEST_REAL_SWIFT") == "" {
+		testFakeSwift = newFakeSwift()
+	}
 
 	// First, delete the container for testing
-	s := NewSwift(c)
-	if err := s.Init(); err != nil {
-		panic(err)
-	}
+	s := storeForTesting()
 	s.DeleteContainer()
 	s.CreateContainer()
 
@@ -30,10 +39,15 @@ func TestMain(m *testing.M) {
 
 	// after testing
 	s.DeleteContainer()
+	if testFakeSwift != nil {
+		testFakeSwift.Close()
+	}
 
 	os.Exit(code)
 }
 
+var testFakeSwift *fakeSwift
+
 func defaultConfigForTesting() Config {
 	c := Config{}
 	c.LoadFromFile("./misc/testing/test.toml")
@@ -52,6 +66,19 @@ func defaultConfigForTesting() Config {
 	c.OsTenantName = ""
 	c.OsRegion = ""
 
+	if testFakeSwift != nil {
+		c.OsIdentityEndpoint = testFakeSwift.IdentityEndpoint()
+		c.OsUsername = fakeSwiftUser
+		c.OsPassword = fakeSwiftPass
+		c.OsDomainName = fakeSwiftDomain
+		c.OsTenantName = fakeSwiftTenant
+	}
+
+	// TEST_BACKEND=memory runs the tests without OpenStack account
+	if backend := os.Getenv("TEST_BACKEND"); backend != "" {
+		c.Backend = backend
+	}
+
 	if err := c.Init(); err != nil {
 		panic(err)
 	}
@@ -60,16 +87,20 @@ func defaultConfigForTesting() Config {
 	return c
 }
 
-var _swiftCache *Swift
+var _storeCache ObjectStore
 
-func swiftForTesting() *Swift {
-	if _swiftCache == nil {
-		_swiftCache = NewSwift(defaultConfigForTesting())
-		if err := _swiftCache.Init(); err != nil {
+func storeForTesting() ObjectStore {
+	if _storeCache == nil {
+		s, err := NewObjectStore(defaultConfigForTesting())
+		if err != nil {
+			panic(err)
+		}
+		if err = s.Init(); err != nil {
 			panic(err)
 		}
+		_storeCache = s
 	}
-	return _swiftCache
+	return _storeCache
 }
 
 // -----------------------------------------------------
@@ -130,3 +161,126 @@ func TestInitServerPasswordAuth(t *testing.T) {
 		t.Fatal("Password authentication should be enabled")
 	}
 }
+
+type testConnMetadata struct {
+	ssh.ConnMetadata
+	user string
+	addr string
+}
+
+func (c testConnMetadata) User() string {
+	return c.user
+}
+
+func (c testConnMetadata) RemoteAddr() net.Addr {
+	if c.addr == "" {
+		return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50022}
+	}
+	addr, _ := net.ResolveTCPAddr("tcp", c.addr)
+	return addr
+}
+
+func TestAuthPkeyContainer(t *testing.T) {
+	c := defaultConfigForTesting()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filename := "./authorized_keys_test"
+	line := `environment="SWIFT_SFTP_CONTAINER=tenant-a" ` + string(ssh.MarshalAuthorizedKey(pub))
+	if err = ioutil.WriteFile(filename, []byte(line), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(filename)
+	c.AuthorizedKeysPath = filename
+
+	perms, err := authPkey(c)(testConnMetadata{user: "alice"}, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perms.Extensions[permContainer] != "tenant-a" {
+		t.Errorf("Wrong container '%s'", perms.Extensions[permContainer])
+	}
+}
+
+func TestHandleClientChannels(t *testing.T) {
+	c := defaultConfigForTesting()
+	s := storeForTesting()
+	sConf, err := initServer(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sConf.NoClientAuth = true
+
+	data := []byte("channels test\n")
+	if err = s.Put("channels.txt", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Delete("channels.txt")
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		nConn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer nConn.Close()
+		handleClient(c, sConf, s, nConn)
+	}()
+
+	client, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+		User:            "alice",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// SFTP channel stays open while the checksum is taken on the other channel.
+	sftpSession, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sftpSession.Close()
+	if err = sftpSession.RequestSubsystem("sftp"); err != nil {
+		t.Fatal(err)
+	}
+
+	result := make(chan string, 1)
+	go func() {
+		session, err := client.NewSession()
+		if err != nil {
+			result <- err.Error()
+			return
+		}
+		defer session.Close()
+		out, err := session.Output("md5sum /channels.txt")
+		if err != nil {
+			result <- err.Error()
+			return
+		}
+		result <- string(out)
+	}()
+
+	h := md5.Sum(data)
+	select {
+	case out := <-result:
+		if expected := hex.EncodeToString(h[:]) + "  /channels.txt\n"; out != expected {
+			t.Errorf("Wrong output of md5sum '%s' (expected=%s)", out, expected)
+		}
+	case <-time.After(10 * time.Second):
+		t.Errorf("The channel should be served while the SFTP channel is open")
+	}
+}
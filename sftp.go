@@ -1,6 +1,8 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"io"
 
 	"github.com/pkg/sftp"
@@ -8,7 +10,7 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
-func StartSftpSession(swift *Swift, channel ssh.Channel, client *Client) (err error) {
+func StartSftpSession(conf Config, store ObjectStore, channel ssh.Channel, client *Client) (err error) {
 	// logger with client
 	clog := log.WithFields(logrus.Fields{
 		"client": client,
@@ -16,17 +18,28 @@ func StartSftpSession(swift *Swift, channel ssh.Channel, client *Client) (err er
 
 	clog.Debug("Starting SFTP session.")
 
-	fs := NewSwiftFS(swift)
-	fs.SetLogger(clog)
-	handler := sftp.Handlers{fs, fs, fs, fs}
+	fs, err := newSessionFS(conf, store, client, clog)
+	if err != nil {
+		return err
+	}
 
-	server := sftp.NewRequestServer(channel, handler)
+	handler := sftp.Handlers{
+		FileGet:  fs,
+		FilePut:  fs,
+		FileCmd:  fs,
+		FileList: fs,
+	}
+
+	// copy-data extension is handled outside of pkg/sftp
+	server := sftp.NewRequestServer(newCopyDataChannel(channel, fs, clog), handler)
 
 	log.Debug("Initialized sftp server")
 
 	if err = server.Serve(); err == io.EOF {
 		log.Debug("End sftp session")
 
+		// The clients like scp wait for the exit status before closing the channel.
+		channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
 		return server.Close()
 
 	} else if err != nil {
@@ -34,3 +47,96 @@ func StartSftpSession(swift *Swift, channel ssh.Channel, client *Client) (err er
 	}
 	return nil
 }
+
+// newSessionFS prepares SwiftFS for the session of the client.
+// SFTP and SCP sessions use it, so that they follow the same home directory, access mode and ACL.
+func newSessionFS(conf Config, store ObjectStore, client *Client, clog *logrus.Entry) (*SwiftFS, error) {
+	home, err := conf.UserHomeDirectory(client.Username, client.Groups...)
+	if err != nil {
+		clog.Warnf("%s", err.Error())
+		return nil, err
+	}
+
+	// Each session has its own client for the container of the user
+	sstore, err := store.ForContainer(client.Container)
+	if err != nil {
+		clog.Warnf("%s", err.Error())
+		return nil, err
+	}
+
+	create := conf.CreateContainerIfNotExists
+	if client.Container != conf.Container {
+		create = conf.CreateUserContainers
+	}
+	if err = prepareContainer(sstore, client.Container, create); err != nil {
+		clog.Warnf("%s", err.Error())
+		return nil, err
+	}
+	clog.Debugf("Use container '%s'", client.Container)
+
+	fs := NewSwiftFS(sstore, conf)
+	fs.SetLogger(clog)
+	fs.SetHomeDirectory(home)
+	if home != "" {
+		clog.Debugf("Home directory is '%s'", home)
+	}
+	fs.SetAccessMode(client.AccessMode)
+	clog.Debugf("Access mode is %s", client.AccessMode)
+
+	if conf.ACLFilePath != "" {
+		acl := NewACL(conf.ACLFilePath)
+		if err = acl.Load(); err != nil {
+			clog.Warnf("%s", err.Error())
+			return nil, err
+		}
+		acl.SetUserGroups(client.Username, client.Groups)
+		fs.SetACL(acl, client.Username)
+	}
+	return fs, nil
+}
+
+// pkg/sftp doesn't export the error for SSH_FX_FILE_ALREADY_EXISTS (11), which is defined in the later
+// drafts of SFTP. The error is derived from the exported one, because it's sent as its value.
+const errFileAlreadyExists = sftp.ErrSSHFxOk + 11
+
+// statusError converts the error of ObjectStore to the status that is returned to the SFTP client.
+// The errors that are not from the backend become SSH_FX_FAILURE without the detail,
+// because they may contain the object names outside of the home directory.
+func statusError(err error) error {
+	if err == nil {
+		return nil
+	} else if err == ErrObjectNotFound || err == ErrContainerNotFound {
+		return sftp.ErrSshFxNoSuchFile
+	} else if err == ErrObjectExists {
+		return errFileAlreadyExists
+	}
+
+	serr, ok := err.(*StoreError)
+	if !ok {
+		switch err {
+		case sftp.ErrSshFxNoSuchFile, sftp.ErrSshFxPermissionDenied, sftp.ErrSshFxOpUnsupported, errFileAlreadyExists:
+			// already converted
+			return err
+		}
+		return sftp.ErrSshFxFailure
+	}
+
+	switch code := serr.StatusCode; {
+	case code == 0:
+		return errors.New("Object storage didn't respond")
+	case code == 401 || code == 403:
+		return sftp.ErrSshFxPermissionDenied
+	case code == 404:
+		return sftp.ErrSshFxNoSuchFile
+	case code == 409:
+		return errors.New("Conflicted with the other request")
+	case code == 413:
+		return errors.New("Quota exceeded or the file is too large")
+	case code == 429 || code == 498:
+		return errors.New("Too many requests to object storage")
+	case code >= 500:
+		return fmt.Errorf("Object storage is unavailable (status=%d)", code)
+	default:
+		return fmt.Errorf("Object storage rejected the request (status=%d)", code)
+	}
+}
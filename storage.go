@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	BackendSwift  = "swift"  // OpenStack Swift (default)
+	BackendMemory = "memory" // In-memory storage. All objects are lost when the process exits.
+)
+
+const (
+	DefaultSegmentSize = 1024 // 1 GiB
+	MaxSegmentSize     = 5120 // Swift's limit for a single object (5 GiB)
+)
+
+var (
+	ErrObjectNotFound    = errors.New("Object not found")
+	ErrContainerNotFound = errors.New("Container not found")
+	ErrObjectExists      = errors.New("Object already exists")
+)
+
+// StoreError is the error that the backend returned for the request.
+type StoreError struct {
+	StatusCode int    // HTTP status code. It's 0 if no response was returned (e.g. timeout).
+	RequestID  string // ID of the request to find it in the logs of the backend (X-Trans-Id on Swift)
+	Err        error
+}
+
+func (e *StoreError) Error() string {
+	if e.RequestID == "" {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s [request-id=%s]", e.Err.Error(), e.RequestID)
+}
+
+// ObjectStore is the interface to the storage backend that keeps the objects.
+// SwiftFS and the container subcommands only work through this interface,
+// so that the backend can be swapped out.
+type ObjectStore interface {
+	Init() error
+
+	// ForContainer returns a new ObjectStore that works on the other container.
+	// It is used to give each SFTP session its own client.
+	ForContainer(container string) (ObjectStore, error)
+
+	// Operations for the container that is set in Config
+	ListContainer() ([]ContainerInfo, error)
+	ExistsContainer() (bool, error)
+	CreateContainer() error
+	DeleteContainer() error
+	// Usage returns the usage and the quotas of the container and the account.
+	Usage() (*StorageUsage, error)
+
+	// Operations for the objects in the container
+	//
+	// List returns all objects whose names begin with prefix.
+	// If delimiter is given, the names that contain the delimiter after the prefix are
+	// rolled up into a pseudo-directory entry (ObjectInfo.Subdir is true).
+	// If limit is positive, no more than limit entries are returned.
+	List(prefix, delimiter string, limit int) ([]ObjectInfo, error)
+	// Get doesn't follow the symlink. It returns the symlink itself with ObjectInfo.SymlinkTarget.
+	Get(name string) (*ObjectInfo, error)
+	Download(name string) (content io.ReadCloser, size int64, err error)
+	// DownloadRange returns the content from offset. If length is negative, it continues to the end.
+	DownloadRange(name string, offset, length int64) (content io.ReadCloser, err error)
+	Put(name string, content io.Reader) error
+	// PutExclusive is the same as Put, but it fails with ErrObjectExists if the object already exists.
+	PutExclusive(name string, content io.Reader) error
+	Delete(name string) error
+	Rename(oldName, newName string) error
+	// Copy copies the object with the server-side copy, including the metadata.
+	// The copy of the large object has its own segments, so that it doesn't depend on the original.
+	Copy(src, dst string) error
+	// SetMetadata replaces all metadata of the object.
+	SetMetadata(name string, metadata map[string]string) error
+	// PutSymlink creates the symlink to the target object in the same container.
+	// The target doesn't need to exist.
+	PutSymlink(name, target string) error
+
+	// Operations for the large objects.
+	// The segments are stored in the segment container, and then PutManifest creates
+	// the object that concatenates them. Deleting the object also deletes its segments, and
+	// replacing it (Put, PutManifest, Rename, Copy or PutSymlink) deletes the segments that
+	// the new object doesn't use.
+	// If only one segment is given, PutManifest moves it to a normal object.
+	PutSegment(name string, content io.Reader) (Segment, error)
+	PutManifest(name string, segments []Segment) error
+	// PutManifestExclusive is the same as PutManifest, but it fails with ErrObjectExists if the object already exists.
+	PutManifestExclusive(name string, segments []Segment) error
+	DeleteSegments(segments []Segment) error
+	// GetSegments returns the segments of the large object. It returns nil for the normal object.
+	GetSegments(name string) ([]Segment, error)
+	// CopyToSegment copies the normal object to the segment container with server-side copy.
+	CopyToSegment(name, segname string) (Segment, error)
+}
+
+// Segment is a part of the large object.
+type Segment struct {
+	Path string `json:"path"` // "/[segment container]/[name]"
+	ETag string `json:"etag"`
+	Size int64  `json:"size_bytes"`
+}
+
+// ContainerInfo holds the attributes of a container.
+type ContainerInfo struct {
+	Name  string
+	Count int64
+	Bytes int64
+}
+
+// StorageUsage holds the usage and the quotas of the container and the account.
+// The quotas are 0 if they are not set.
+type StorageUsage struct {
+	Bytes      int64 // X-Container-Bytes-Used
+	Count      int64 // X-Container-Object-Count
+	QuotaBytes int64 // X-Container-Meta-Quota-Bytes
+	QuotaCount int64 // X-Container-Meta-Quota-Count
+
+	AccountBytes      int64 // X-Account-Bytes-Used
+	AccountQuotaBytes int64 // X-Account-Meta-Quota-Bytes
+}
+
+// ObjectInfo holds the attributes of an object.
+type ObjectInfo struct {
+	Name         string
+	Bytes        int64
+	LastModified time.Time
+	ContentType  string
+	Hash         string
+
+	// User metadata of the object (X-Object-Meta-*). The keys are canonicalized like "Mtime".
+	// It's nil if the backend doesn't return the metadata in the listing.
+	Metadata map[string]string
+
+	// SymlinkTarget is the name of the object that the symlink points to. It's empty if the object
+	// is not a symlink. The target in the other container starts with the delimiter like "/container/name".
+	SymlinkTarget string
+
+	// Subdir is true if the entry is a pseudo-directory returned by List() with delimiter.
+	// Name has a trailing delimiter in that case.
+	Subdir bool
+}
+
+// splitSegmentPath splits Segment.Path into the container name and the object name.
+func splitSegmentPath(path string) (container, name string) {
+	parts := strings.SplitN(strings.TrimPrefix(path, Delimiter), Delimiter, 2)
+	if len(parts) != 2 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// unusedSegments returns the segments of the replaced large object that the new object doesn't use.
+func unusedSegments(old, current []Segment) []Segment {
+	used := map[string]bool{}
+	for _, seg := range current {
+		used[seg.Path] = true
+	}
+
+	var unused []Segment
+	for _, seg := range old {
+		if !used[seg.Path] {
+			unused = append(unused, seg)
+		}
+	}
+	return unused
+}
+
+// NewObjectStore returns the ObjectStore for the backend set in the config.
+func NewObjectStore(c Config) (ObjectStore, error) {
+	switch c.Backend {
+	case "", BackendSwift:
+		return NewSwift(c), nil
+	case BackendMemory:
+		return NewMemoryStore(c), nil
+	default:
+		return nil, fmt.Errorf("Unknown backend '%s'", c.Backend)
+	}
+}
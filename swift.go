@@ -1,9 +1,20 @@
 package main
 
 import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gophercloud/gophercloud"
 	"github.com/gophercloud/gophercloud/openstack"
@@ -12,12 +23,16 @@ import (
 	"github.com/gophercloud/gophercloud/pagination"
 )
 
+// Swift implements ObjectStore interface on OpenStack Swift.
 type Swift struct {
 	config     Config
 	authClient *gophercloud.ProviderClient
 
 	// Need to be exported
 	SwiftClient *gophercloud.ServiceClient
+
+	segmentLock           sync.Mutex
+	segmentContainerReady bool
 }
 
 func NewSwift(c Config) *Swift {
@@ -38,22 +53,47 @@ func (s *Swift) Init() (err error) {
 	return nil
 }
 
-func (s *Swift) ListContainer() (list []containers.Container, err error) {
+// ForContainer shares the authenticated client and its token with s, so that the sessions
+// don't authenticate with Keystone every time. Only the container and the segment container differ.
+func (s *Swift) ForContainer(container string) (ObjectStore, error) {
+	c := s.config
+	c.Container = container
+
+	store := NewSwift(c)
+	if s.SwiftClient == nil {
+		if err := store.Init(); err != nil {
+			return nil, err
+		}
+		return store, nil
+	}
+
+	store.authClient = s.authClient
+	store.SwiftClient = s.SwiftClient
+	return store, nil
+}
+
+func (s *Swift) ListContainer() (list []ContainerInfo, err error) {
 	opts := containers.ListOpts{
 		Full: true,
 	}
 
-	list = make([]containers.Container, 0, 10)
-	containers.List(s.SwiftClient, opts).EachPage(func(page pagination.Page) (bool, error) {
+	list = make([]ContainerInfo, 0, 10)
+	err = containers.List(s.SwiftClient, opts).EachPage(func(page pagination.Page) (bool, error) {
 		cs, err := containers.ExtractInfo(page)
 		if err != nil {
 			return false, err
 		}
-		list = append(list, cs...)
+		for _, c := range cs {
+			list = append(list, ContainerInfo{
+				Name:  c.Name,
+				Count: c.Count,
+				Bytes: c.Bytes,
+			})
+		}
 		return true, nil
 	})
 
-	return list, nil
+	return list, swiftError(err)
 }
 
 func (s *Swift) ExistsContainer() (exists bool, err error) {
@@ -74,65 +114,207 @@ func (s *Swift) ExistsContainer() (exists bool, err error) {
 		return true, nil
 	})
 
-	return exists, err
+	return exists, swiftError(err)
 }
 
 func (s *Swift) CreateContainer() (err error) {
 	rs := containers.Create(s.SwiftClient, s.config.Container, containers.CreateOpts{})
-	return rs.Err
+	return swiftError(rs.Err)
+}
+
+func (s *Swift) Usage() (*StorageUsage, error) {
+	opts := &gophercloud.RequestOpts{
+		OkCodes: []int{200, 204},
+	}
+
+	resp, err := s.SwiftClient.Head(s.SwiftClient.ServiceURL(url.PathEscape(s.config.Container)), opts)
+	if err != nil {
+		return nil, swiftError(err)
+	} else if resp.Body != nil {
+		resp.Body.Close()
+	}
+
+	u := &StorageUsage{
+		Bytes:      headerInt(resp.Header, "X-Container-Bytes-Used"),
+		Count:      headerInt(resp.Header, "X-Container-Object-Count"),
+		QuotaBytes: headerInt(resp.Header, "X-Container-Meta-Quota-Bytes"),
+		QuotaCount: headerInt(resp.Header, "X-Container-Meta-Quota-Count"),
+	}
+
+	// The usage of the account
+	resp, err = s.SwiftClient.Head(s.SwiftClient.ServiceURL(), opts)
+	if err != nil {
+		return nil, swiftError(err)
+	} else if resp.Body != nil {
+		resp.Body.Close()
+	}
+
+	u.AccountBytes = headerInt(resp.Header, "X-Account-Bytes-Used")
+	u.AccountQuotaBytes = headerInt(resp.Header, "X-Account-Meta-Quota-Bytes")
+	return u, nil
+}
+
+// headerInt returns the integer in the header. It returns 0 if the header is missing or invalid.
+func headerInt(h http.Header, key string) int64 {
+	n, err := strconv.ParseInt(h.Get(key), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return n
 }
 
 func (s *Swift) DeleteContainer() (err error) {
-	ls, err := s.List()
+	ls, err := s.List("", "", 0)
 	if err != nil {
 		return err
 	}
 
 	// Recursive deletion for all objects in the container
 	for _, obj := range ls {
-		drs := objects.Delete(s.SwiftClient, s.config.Container, obj.Name, objects.DeleteOpts{})
-		if drs.Err != nil {
-			return drs.Err
+		if err = s.Delete(obj.Name); err != nil {
+			return err
 		}
 	}
 
 	rs := containers.Delete(s.SwiftClient, s.config.Container)
-	return rs.Err
+	return swiftError(rs.Err)
 }
 
-func (s *Swift) List() (ls []objects.Object, err error) {
-	ls = make([]objects.Object, 0, 10)
-	err = objects.List(s.SwiftClient, s.config.Container, objects.ListOpts{
-		Full: true,
-	}).EachPage(func(p pagination.Page) (bool, error) {
-		ls, err = objects.ExtractInfo(p)
+func (s *Swift) List(prefix, delimiter string, limit int) (ls []ObjectInfo, err error) {
+	opts := objects.ListOpts{
+		Full:      true,
+		Prefix:    prefix,
+		Delimiter: delimiter,
+		Limit:     limit,
+	}
+
+	// Swift returns 10,000 objects per page by default, so all pages need to be collected.
+	// With the limit, the pages are collected until the limit is reached.
+	ls = make([]ObjectInfo, 0, 10)
+	err = objects.List(s.SwiftClient, s.config.Container, opts).EachPage(func(p pagination.Page) (bool, error) {
+		objs, err := objects.ExtractInfo(p)
 		if err != nil {
 			return false, err
 		}
-		return true, nil
+
+		for _, obj := range objs {
+			if obj.Subdir != "" {
+				ls = append(ls, ObjectInfo{
+					Name:   obj.Subdir,
+					Subdir: true,
+				})
+				continue
+			}
+
+			ls = append(ls, ObjectInfo{
+				Name:         obj.Name,
+				Bytes:        obj.Bytes,
+				LastModified: obj.LastModified,
+				ContentType:  obj.ContentType,
+				Hash:         obj.Hash,
+			})
+		}
+		return limit <= 0 || len(ls) < limit, nil
 	})
 
-	return ls, err
+	if limit > 0 && len(ls) > limit {
+		ls = ls[:limit]
+	}
+	return ls, swiftError(err)
 }
 
-func (s *Swift) Get(name string) (header *objects.GetHeader, err error) {
-	return objects.Get(s.SwiftClient, s.config.Container, name, objects.GetOpts{}).Extract()
+func (s *Swift) Get(name string) (info *ObjectInfo, err error) {
+	rs := s.head(name)
+	header, err := rs.Extract()
+	if err != nil {
+		return nil, swiftError(err)
+	}
+
+	metadata, err := rs.ExtractMetadata()
+	if err != nil {
+		return nil, swiftError(err)
+	}
+
+	info = &ObjectInfo{
+		Name:         name,
+		Bytes:        header.ContentLength,
+		LastModified: header.LastModified,
+		ContentType:  header.ContentType,
+		Hash:         header.ETag,
+		Metadata:     metadata,
+	}
+
+	if target := rs.Header.Get("X-Symlink-Target"); target != "" {
+		if t, err := url.PathUnescape(target); err == nil {
+			target = t
+		}
+		if strings.HasPrefix(target, s.config.Container+Delimiter) {
+			info.SymlinkTarget = target[len(s.config.Container+Delimiter):]
+		} else {
+			info.SymlinkTarget = Delimiter + target
+		}
+	}
+	return info, nil
+}
+
+// head sends HEAD request for the object. Swift follows the symlink unless "symlink=get" is given,
+// so the symlink itself is returned.
+func (s *Swift) head(name string) (rs objects.GetResult) {
+	resp, err := s.SwiftClient.Head(s.objectURL(name)+"?symlink=get", &gophercloud.RequestOpts{
+		OkCodes: []int{200, 204},
+	})
+	if resp != nil {
+		rs.Header = resp.Header
+		if resp.Body != nil {
+			resp.Body.Close()
+		}
+	}
+	rs.Err = err
+	return rs
+}
+
+func (s *Swift) objectURL(name string) string {
+	return s.SwiftClient.ServiceURL(url.PathEscape(s.config.Container), escapeObjectName(name))
+}
+
+// escapeObjectName escapes the object name for the URL. The delimiters are kept.
+func escapeObjectName(name string) string {
+	parts := strings.Split(name, Delimiter)
+	for i := range parts {
+		parts[i] = url.PathEscape(parts[i])
+	}
+	return strings.Join(parts, Delimiter)
 }
 
 func (s *Swift) Download(name string) (content io.ReadCloser, size int64, err error) {
 	rs := objects.Download(s.SwiftClient, s.config.Container, name, objects.DownloadOpts{})
 	if rs.Err != nil {
-		return nil, 0, rs.Err
+		return nil, 0, swiftError(rs.Err)
 	}
 
 	info, err := rs.Extract()
 	if err != nil {
-		return nil, 0, err
+		return nil, 0, swiftError(err)
 	}
 
 	return rs.Body, info.ContentLength, nil
 }
 
+func (s *Swift) DownloadRange(name string, offset, length int64) (content io.ReadCloser, err error) {
+	rng := fmt.Sprintf("bytes=%d-", offset)
+	if length >= 0 {
+		rng += fmt.Sprintf("%d", offset+length-1)
+	}
+
+	rs := objects.Download(s.SwiftClient, s.config.Container, name, objects.DownloadOpts{
+		Range: rng,
+	})
+	if rs.Err != nil {
+		return nil, swiftError(rs.Err)
+	}
+	return rs.Body, nil
+}
+
 func (s *Swift) Put(name string, content io.Reader) error {
 	// temporary object name
 	tmpname := "tmp_" + name
@@ -147,36 +329,441 @@ func (s *Swift) Put(name string, content io.Reader) error {
 	}
 	rCreate := objects.Create(s.SwiftClient, s.config.Container, tmpname, cOpts)
 	if rCreate.Err != nil {
-		return rCreate.Err
+		return swiftError(rCreate.Err)
 	}
 
-	dest := fmt.Sprintf("%s%s%s", s.config.Container, Delimiter, name)
-	rCopy := objects.Copy(s.SwiftClient, s.config.Container, tmpname, objects.CopyOpts{
-		Destination: dest,
+	return s.replaceObject(name, nil, func() error {
+		dest := fmt.Sprintf("%s%s%s", s.config.Container, Delimiter, name)
+		rCopy := objects.Copy(s.SwiftClient, s.config.Container, tmpname, objects.CopyOpts{
+			Destination: dest,
+		})
+		return swiftError(rCopy.Err)
 	})
-	if rCopy.Err != nil {
-		return rCopy.Err
+}
+
+// replaceObject runs put that replaces the object with the new one using the segments.
+// The segments of the old Static Large Object are deleted after that, except for the ones
+// that the new object still uses (e.g. appending to the object). Otherwise they would be
+// left in the segment container.
+func (s *Swift) replaceObject(name string, segments []Segment, put func() error) error {
+	old, err := s.GetSegments(name)
+	if err != nil && err != ErrObjectNotFound {
+		return err
 	}
 
-	return nil
+	if err = put(); err != nil {
+		return err
+	}
+	return s.DeleteSegments(unusedSegments(old, segments))
+}
+
+func (s *Swift) PutExclusive(name string, content io.Reader) error {
+	rs := objects.Create(s.SwiftClient, s.config.Container, name, objects.CreateOpts{
+		Content:     content,
+		IfNoneMatch: "*",
+	})
+	return existsError(swiftError(rs.Err))
 }
 
 func (s *Swift) Delete(name string) (err error) {
-	return objects.Delete(s.SwiftClient, s.config.Container, name, objects.DeleteOpts{}).Err
+	header, err := s.head(name).Extract()
+	if err != nil {
+		return swiftError(err)
+	}
+
+	// The segments of Static Large Object are deleted with the manifest.
+	opts := objects.DeleteOpts{}
+	if header.StaticLargeObject {
+		opts.MultipartManifest = "delete"
+	}
+
+	return swiftError(objects.Delete(s.SwiftClient, s.config.Container, name, opts).Err)
 }
 
 func (s *Swift) Rename(oldName, newName string) (err error) {
-	dest := fmt.Sprintf("%s%s%s", s.config.Container, Delimiter, newName)
-	rCopy := objects.Copy(s.SwiftClient, s.config.Container, oldName, objects.CopyOpts{
-		Destination: dest,
+	if oldName == newName {
+		return nil
+	}
+
+	rs := s.head(oldName)
+	header, err := rs.Extract()
+	if err != nil {
+		return swiftError(err)
+	}
+
+	// COPY request copies the target of the symlink. Create a new symlink instead.
+	if target := rs.Header.Get("X-Symlink-Target"); target != "" {
+		if err = s.replaceObject(newName, nil, func() error { return s.putSymlink(newName, target) }); err != nil {
+			return err
+		}
+		return s.Delete(oldName)
+	}
+
+	// COPY request concatenates the segments of Static Large Object into a new object,
+	// and it fails if the object is larger than 5 GiB. Move only the manifest instead.
+	if header.StaticLargeObject {
+		metadata, _ := rs.ExtractMetadata()
+		segments, err := s.getManifest(oldName)
+		if err != nil {
+			return err
+		}
+		return s.replaceObject(newName, segments, func() error {
+			return s.renameManifest(oldName, newName, segments, metadata)
+		})
+	}
+
+	err = s.replaceObject(newName, nil, func() error {
+		dest := fmt.Sprintf("%s%s%s", s.config.Container, Delimiter, newName)
+		rCopy := objects.Copy(s.SwiftClient, s.config.Container, oldName, objects.CopyOpts{
+			Destination: dest,
+		})
+		return swiftError(rCopy.Err)
 	})
-	if rCopy.Err != nil {
-		return rCopy.Err
+	if err != nil {
+		return err
 	}
 
 	return s.Delete(oldName)
 }
 
+func (s *Swift) Copy(src, dst string) (err error) {
+	if src == dst {
+		return nil
+	}
+
+	segments, err := s.GetSegments(src)
+	if err != nil {
+		return err
+	} else if segments != nil {
+		return s.copyManifest(src, dst, segments)
+	}
+
+	return s.replaceObject(dst, nil, func() error {
+		rCopy := objects.Copy(s.SwiftClient, s.config.Container, src, objects.CopyOpts{
+			Destination: fmt.Sprintf("%s%s%s", s.config.Container, Delimiter, dst),
+		})
+		return swiftError(rCopy.Err)
+	})
+}
+
+// copyManifest copies the segments of Static Large Object one by one, and creates the new manifest.
+// COPY request for the manifest would concatenate the segments, which fails for the objects larger than 5 GiB.
+func (s *Swift) copyManifest(src, dst string, segments []Segment) (err error) {
+	if err = s.prepareSegmentContainer(); err != nil {
+		return err
+	}
+
+	info, err := s.Get(src)
+	if err != nil {
+		return err
+	}
+
+	prefix := fmt.Sprintf("%s/slo/%d", dst, time.Now().UnixNano())
+	copied := make([]Segment, 0, len(segments))
+	for i, seg := range segments {
+		container, name := splitSegmentPath(seg.Path)
+		segname := fmt.Sprintf("%s/%08d", prefix, i)
+
+		rCopy := objects.Copy(s.SwiftClient, container, name, objects.CopyOpts{
+			Destination: fmt.Sprintf("%s%s%s", s.config.SegmentContainerName(), Delimiter, segname),
+		})
+		if rCopy.Err != nil {
+			s.DeleteSegments(copied)
+			return swiftError(rCopy.Err)
+		}
+
+		copied = append(copied, Segment{
+			Path: Delimiter + s.config.SegmentContainerName() + Delimiter + segname,
+			ETag: seg.ETag,
+			Size: seg.Size,
+		})
+	}
+
+	if err = s.PutManifest(dst, copied); err != nil {
+		s.DeleteSegments(copied)
+		return err
+	}
+	if len(info.Metadata) > 0 {
+		return s.SetMetadata(dst, info.Metadata)
+	}
+	return nil
+}
+
+func (s *Swift) SetMetadata(name string, metadata map[string]string) (err error) {
+	rs := objects.Update(s.SwiftClient, s.config.Container, name, objects.UpdateOpts{
+		Metadata: metadata,
+	})
+	return swiftError(rs.Err)
+}
+
+func (s *Swift) PutSymlink(name, target string) (err error) {
+	return s.replaceObject(name, nil, func() error {
+		return s.putSymlink(name, url.PathEscape(s.config.Container)+Delimiter+escapeObjectName(target))
+	})
+}
+
+// putSymlink creates the symlink with the value of X-Symlink-Target header ("container/object").
+func (s *Swift) putSymlink(name, target string) (err error) {
+	_, err = s.SwiftClient.Put(s.objectURL(name), nil, nil, &gophercloud.RequestOpts{
+		MoreHeaders: map[string]string{
+			"X-Symlink-Target": target,
+		},
+		OkCodes: []int{201},
+	})
+	return swiftError(err)
+}
+
+func (s *Swift) renameManifest(oldName, newName string, segments []Segment, metadata map[string]string) (err error) {
+	if err = s.putManifest(newName, segments, ""); err != nil {
+		return err
+	}
+	if len(metadata) > 0 {
+		if err = s.SetMetadata(newName, metadata); err != nil {
+			return err
+		}
+	}
+
+	// The segments are kept for the new manifest.
+	return swiftError(objects.Delete(s.SwiftClient, s.config.Container, oldName, objects.DeleteOpts{}).Err)
+}
+
+// getManifest returns the segments in the manifest of Static Large Object.
+func (s *Swift) getManifest(name string) (segments []Segment, err error) {
+	rs := objects.Download(s.SwiftClient, s.config.Container, name, objects.DownloadOpts{
+		MultipartManifest: "get",
+	})
+	content, err := rs.ExtractContent()
+	if err != nil {
+		return nil, swiftError(err)
+	}
+
+	// The format of the manifest that GET request returns is different from PUT request.
+	var entries []struct {
+		Name  string `json:"name"`
+		Hash  string `json:"hash"`
+		Bytes int64  `json:"bytes"`
+	}
+	if err = json.Unmarshal(content, &entries); err != nil {
+		return nil, err
+	}
+
+	segments = make([]Segment, 0, len(entries))
+	for _, e := range entries {
+		segments = append(segments, Segment{
+			Path: e.Name,
+			ETag: e.Hash,
+			Size: e.Bytes,
+		})
+	}
+	return segments, nil
+}
+
+func (s *Swift) PutSegment(name string, content io.Reader) (seg Segment, err error) {
+	if err = s.prepareSegmentContainer(); err != nil {
+		return seg, err
+	}
+
+	r := &segmentReader{
+		r:    content,
+		hash: md5.New(),
+	}
+	rs := objects.Create(s.SwiftClient, s.config.SegmentContainerName(), name, objects.CreateOpts{
+		Content: r,
+	})
+	if rs.Err != nil {
+		return seg, swiftError(rs.Err)
+	}
+
+	seg = Segment{
+		Path: Delimiter + s.config.SegmentContainerName() + Delimiter + name,
+		ETag: hex.EncodeToString(r.hash.Sum(nil)),
+		Size: r.size,
+	}
+	return seg, nil
+}
+
+func (s *Swift) PutManifest(name string, segments []Segment) (err error) {
+	return s.replaceObject(name, segments, func() error {
+		return s.putLargeObject(name, segments, "")
+	})
+}
+
+func (s *Swift) PutManifestExclusive(name string, segments []Segment) (err error) {
+	return existsError(s.putLargeObject(name, segments, "*"))
+}
+
+// putLargeObject creates the object that concatenates the segments with If-None-Match header.
+func (s *Swift) putLargeObject(name string, segments []Segment, ifNoneMatch string) (err error) {
+	// A single segment becomes a normal object by server-side copy.
+	// The request has no body, so the ETag of the empty content must not be sent.
+	if len(segments) == 1 {
+		rs := objects.Create(s.SwiftClient, s.config.Container, name, objects.CreateOpts{
+			Content:     bytes.NewReader([]byte{}),
+			NoETag:      true,
+			CopyFrom:    escapeObjectName(segments[0].Path),
+			IfNoneMatch: ifNoneMatch,
+		})
+		if rs.Err != nil {
+			return swiftError(rs.Err)
+		}
+		return s.DeleteSegments(segments)
+	}
+
+	return s.putManifest(name, segments, ifNoneMatch)
+}
+
+func (s *Swift) putManifest(name string, segments []Segment, ifNoneMatch string) (err error) {
+	manifest, err := json.Marshal(segments)
+	if err != nil {
+		return err
+	}
+
+	rs := objects.Create(s.SwiftClient, s.config.Container, name, objects.CreateOpts{
+		Content:           bytes.NewReader(manifest),
+		MultipartManifest: "put",
+		IfNoneMatch:       ifNoneMatch,
+	})
+	return swiftError(rs.Err)
+}
+
+func (s *Swift) DeleteSegments(segments []Segment) (err error) {
+	for _, seg := range segments {
+		container, name := splitSegmentPath(seg.Path)
+		rs := objects.Delete(s.SwiftClient, container, name, objects.DeleteOpts{})
+		if err := swiftError(rs.Err); err != nil && err != ErrObjectNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Swift) GetSegments(name string) (segments []Segment, err error) {
+	header, err := s.head(name).Extract()
+	if err != nil {
+		return nil, swiftError(err)
+	} else if !header.StaticLargeObject {
+		return nil, nil
+	}
+	return s.getManifest(name)
+}
+
+func (s *Swift) CopyToSegment(name, segname string) (seg Segment, err error) {
+	if err = s.prepareSegmentContainer(); err != nil {
+		return seg, err
+	}
+
+	info, err := s.Get(name)
+	if err != nil {
+		return seg, err
+	}
+
+	rCopy := objects.Copy(s.SwiftClient, s.config.Container, name, objects.CopyOpts{
+		Destination: fmt.Sprintf("%s%s%s", s.config.SegmentContainerName(), Delimiter, segname),
+	})
+	if rCopy.Err != nil {
+		return seg, swiftError(rCopy.Err)
+	}
+
+	seg = Segment{
+		Path: Delimiter + s.config.SegmentContainerName() + Delimiter + segname,
+		ETag: strings.Trim(info.Hash, `"`),
+		Size: info.Bytes,
+	}
+	return seg, nil
+}
+
+// Create the segment container if not exists. PUT request for the existing container does nothing.
+func (s *Swift) prepareSegmentContainer() error {
+	s.segmentLock.Lock()
+	defer s.segmentLock.Unlock()
+
+	if s.segmentContainerReady {
+		return nil
+	}
+
+	rs := containers.Create(s.SwiftClient, s.config.SegmentContainerName(), containers.CreateOpts{})
+	if rs.Err != nil {
+		return swiftError(rs.Err)
+	}
+	s.segmentContainerReady = true
+	return nil
+}
+
+// segmentReader computes the size and MD5 hash of the segment while uploading.
+type segmentReader struct {
+	r    io.Reader
+	hash hash.Hash
+	size int64
+}
+
+func (r *segmentReader) Read(p []byte) (n int, err error) {
+	n, err = r.r.Read(p)
+	r.hash.Write(p[:n])
+	r.size += int64(n)
+	return n, err
+}
+
+// existsError converts the error of the conditional request (If-None-Match: *) to ErrObjectExists.
+func existsError(err error) error {
+	if serr, ok := err.(*StoreError); ok && serr.StatusCode == 412 {
+		return ErrObjectExists
+	}
+	return err
+}
+
+// swiftError converts the errors of gophercloud to the errors of ObjectStore.
+// 404 becomes ErrObjectNotFound, and the others become StoreError with the status code and the request ID.
+func swiftError(err error) error {
+	var resp gophercloud.ErrUnexpectedResponseCode
+	switch e := err.(type) {
+	case nil:
+		return nil
+	case gophercloud.ErrDefault404:
+		return ErrObjectNotFound
+	case gophercloud.ErrUnexpectedResponseCode:
+		resp = e
+	case *gophercloud.ErrUnexpectedResponseCode:
+		resp = *e
+	case *gophercloud.ErrErrorAfterReauthentication:
+		// 401 of the expired token is retried after re-authentication. The status of the request is in the original error.
+		return swiftError(e.ErrOriginal)
+	case *gophercloud.ErrUnableToReauthenticate:
+		return swiftError(e.ErrOriginal)
+	case gophercloud.ErrDefault400:
+		resp = e.ErrUnexpectedResponseCode
+	case gophercloud.ErrDefault401:
+		resp = e.ErrUnexpectedResponseCode
+	case gophercloud.ErrDefault403:
+		resp = e.ErrUnexpectedResponseCode
+	case gophercloud.ErrDefault405:
+		resp = e.ErrUnexpectedResponseCode
+	case gophercloud.ErrDefault408:
+		resp = e.ErrUnexpectedResponseCode
+	case gophercloud.ErrDefault409:
+		resp = e.ErrUnexpectedResponseCode
+	case gophercloud.ErrDefault429:
+		resp = e.ErrUnexpectedResponseCode
+	case gophercloud.ErrDefault500:
+		resp = e.ErrUnexpectedResponseCode
+	case gophercloud.ErrDefault503:
+		resp = e.ErrUnexpectedResponseCode
+	case *StoreError:
+		return err
+	default:
+		// no response (e.g. timeout or connection refused)
+		if err == ErrObjectNotFound || err == ErrContainerNotFound {
+			return err
+		}
+		return &StoreError{Err: err}
+	}
+
+	return &StoreError{
+		StatusCode: resp.Actual,
+		RequestID:  resp.ResponseHeader.Get("X-Trans-Id"),
+		Err:        err,
+	}
+}
+
 func (s *Swift) getObjectStorageClient() (*gophercloud.ServiceClient, error) {
 	if s.authClient == nil {
 		return nil, errors.New("Auth client must be initialized in advance")
@@ -2,18 +2,27 @@ package main
 
 import (
 	"os"
+	"strconv"
 	"strings"
 	"time"
 )
 
+// Metadata keys of the file attributes that are set by the client with Setstat
+const (
+	MetaMtime = "Mtime" // unix time
+	MetaAtime = "Atime" // unix time
+	MetaMode  = "Mode"  // permission bits in octal
+)
+
 // SwiftFile implements os.FileInfo interfaces.
 // There interfaces are necessary for sftp.Handlers.
 type SwiftFile struct {
 	objectname string
 	size       int64
 	modtime    time.Time
-	symlink    string
+	symlink    string // object name that the symlink points to
 	isdir      bool
+	mode       os.FileMode // permission bits set by the client (0 means default)
 
 	tmpFile *os.File
 }
@@ -48,6 +57,20 @@ func (f *SwiftFile) Size() int64 {
 }
 
 func (f *SwiftFile) Mode() os.FileMode {
+	if f.symlink != "" {
+		return os.ModeSymlink | os.FileMode(0777)
+	}
+
+	if f.isdir {
+		if f.mode != 0 {
+			return os.ModeDir | f.mode
+		}
+		return os.ModeDir | os.FileMode(0755)
+	}
+
+	if f.mode != 0 {
+		return f.mode
+	}
 	return os.FileMode(0666)
 }
 
@@ -62,3 +85,18 @@ func (f *SwiftFile) IsDir() bool {
 func (f *SwiftFile) Sys() interface{} {
 	return dummyStat()
 }
+
+// applyMetadata overrides the attributes with the values in the object metadata.
+// SFTP reports the access time as the same as the modification time, so Atime is only stored.
+func (f *SwiftFile) applyMetadata(metadata map[string]string) {
+	if v, ok := metadata[MetaMtime]; ok {
+		if sec, err := strconv.ParseInt(v, 10, 64); err == nil {
+			f.modtime = time.Unix(sec, 0)
+		}
+	}
+	if v, ok := metadata[MetaMode]; ok {
+		if mode, err := strconv.ParseUint(v, 8, 32); err == nil {
+			f.mode = os.FileMode(mode) & os.ModePerm
+		}
+	}
+}
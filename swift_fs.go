@@ -1,9 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -16,19 +21,38 @@ const (
 )
 
 // SwiftFS implements sftp.Handlers interface.
+// The methods are called concurrently by the workers of sftp.RequestServer.
 type SwiftFS struct {
 	log *logrus.Entry
 
-	lock         sync.Mutex
-	swift        *Swift
+	paths        pathLocks // serializes the commands on the same paths
+	store        ObjectStore
+	timeout      time.Duration
+	segmentSize  int64
+	capacity     int64  // bytes
+	listMetadata int    // max number of the objects in the listing whose metadata are read
+	home         string // object name of the root directory for the client
+	mode         AccessMode
+	acl          *ACL
+	username     string // user of the rules in the ACL
+	writingsLock sync.Mutex
+	writings     map[string]*swiftWriter // the files that are being written
 	waitReadings []*SwiftFile
 	waitWritings []*SwiftFile
 }
 
-func NewSwiftFS(s *Swift) *SwiftFS {
+func NewSwiftFS(s ObjectStore, c Config) *SwiftFS {
 	fs := &SwiftFS{
-		log:   log,
-		swift: s,
+		log:     log,
+		store:   s,
+		timeout: time.Duration(c.SwiftTimeout) * time.Second,
+		mode:    AccessReadWrite,
+
+		segmentSize: int64(c.SegmentSize) * 1024 * 1024,
+		capacity:    c.StorageCapacity * 1024 * 1024 * 1024,
+		writings:    map[string]*swiftWriter{},
+
+		listMetadata: c.ListMetadataLimit,
 	}
 
 	return fs
@@ -38,32 +62,54 @@ func (fs *SwiftFS) SetLogger(clog *logrus.Entry) {
 	fs.log = clog
 }
 
+// SetHomeDirectory jails the client in the directory. The client sees it as "/".
+func (fs *SwiftFS) SetHomeDirectory(dir string) {
+	fs.home = strings.Trim(path.Clean(Delimiter+dir), Delimiter)
+}
+
+// SetAccessMode restricts the operations of the client.
+func (fs *SwiftFS) SetAccessMode(mode AccessMode) {
+	fs.mode = mode
+}
+
 func (fs *SwiftFS) Fileread(r *sftp.Request) (io.ReaderAt, error) {
-	fs.lock.Lock()
-	defer fs.lock.Unlock()
+	if err := fs.permit(r.Method, r.Filepath, fs.mode.CanRead()); err != nil {
+		return nil, err
+	} else if err = fs.authorize(r.Method, r.Filepath, ACLRead); err != nil {
+		return nil, err
+	}
 
 	f, err := fs.lookup(r.Filepath)
 	if err != nil || f == nil {
 		fs.log.Infof("%s %s", r.Method, r.Filepath)
 
-		fs.log.Warnf("%s %s", r.Filepath, err.Error())
-		return nil, sftp.ErrSshFxFailure
+		return nil, fs.sftpError(r.Filepath, err)
 
 	} else if f == nil {
 		fs.log.Infof("%s %s", r.Method, r.Filepath)
 
 		err = fmt.Errorf("File not found. [%s]", r.Filepath)
-		fs.log.Warnf("%s %s", r.Filepath, err.Error())
+		return nil, fs.sftpError(r.Filepath, err)
+
+	} else if f.IsDir() {
+		fs.log.Infof("%s %s", r.Method, r.Filepath)
+
+		fs.log.Warnf("%s Is a directory", r.Filepath)
 		return nil, sftp.ErrSshFxFailure
 	}
 
+	// The file that the symlink points to must be also readable.
+	if err = fs.authorizeResolved(r.Method, r.Filepath, f, ACLRead); err != nil {
+		return nil, err
+	}
+
 	fs.log.Infof("%s %s (size=%d)", r.Method, r.Filepath, f.Size())
 
 	reader := &swiftReader{
 		log:     fs.log,
-		swift:   fs.swift,
+		store:   fs.store,
 		sf:      f,
-		timeout: time.Duration(fs.swift.config.SwiftTimeout) * time.Second,
+		timeout: fs.timeout,
 
 		afterClosed: func(r *swiftReader) {
 			if r.downloadErr != nil {
@@ -77,8 +123,7 @@ func (fs *SwiftFS) Fileread(r *sftp.Request) (io.ReaderAt, error) {
 	if err = reader.Begin(); err != nil {
 		reader.Close()
 
-		fs.log.Warnf("%s %s", r.Filepath, err.Error())
-		return nil, sftp.ErrSshFxFailure
+		return nil, fs.sftpError(r.Filepath, err)
 	}
 
 	fs.log.Infof("Transferring %s ...", r.Filepath)
@@ -87,25 +132,55 @@ func (fs *SwiftFS) Fileread(r *sftp.Request) (io.ReaderAt, error) {
 }
 
 func (fs *SwiftFS) Filewrite(r *sftp.Request) (io.WriterAt, error) {
-	fs.lock.Lock()
-	defer fs.lock.Unlock()
-
 	fs.log.Infof("%s %s", r.Method, r.Filepath)
 
+	if err := fs.permit(r.Method, r.Filepath, fs.mode.CanWrite()); err != nil {
+		return nil, err
+	} else if err = fs.authorize(r.Method, r.Filepath, ACLWrite); err != nil {
+		return nil, err
+	}
+
+	// The drop box users can't overwrite the existing files.
+	if !fs.mode.CanModify() {
+		if _, err := fs.lookup(r.Filepath); err == nil {
+			return nil, fs.permit(r.Method, r.Filepath, false)
+		}
+	}
+
 	f := &SwiftFile{
-		objectname: r.Filepath[1:], // strip slash
+		objectname: fs.filepath2object(r.Filepath),
 		size:       0,
 		modtime:    time.Now(),
 		symlink:    "",
 		isdir:      false,
 	}
 
+	// Appending to the symlink continues the file that it points to.
+	flags := r.Pflags()
+	if flags.Append {
+		if target, err := fs.lookup(r.Filepath); err == nil && !target.isdir {
+			if err = fs.authorizeResolved(r.Method, r.Filepath, target, ACLWrite); err != nil {
+				return nil, err
+			}
+			f.objectname = target.objectname
+		}
+	}
+
 	writer := &swiftWriter{
-		log:     fs.log,
-		swift:   fs.swift,
-		sf:      f,
-		timeout: time.Duration(fs.swift.config.SwiftTimeout) * time.Second,
+		log:         fs.log,
+		store:       fs.store,
+		sf:          f,
+		timeout:     fs.timeout,
+		segmentSize: fs.segmentSize,
+		exclusive:   flags.Excl || !fs.mode.CanModify(),
+		appending:   flags.Append && !flags.Trunc,
 		afterClosed: func(w *swiftWriter) {
+			fs.writingsLock.Lock()
+			if fs.writings[f.objectname] == w {
+				delete(fs.writings, f.objectname)
+			}
+			fs.writingsLock.Unlock()
+
 			if w.uploadErr != nil {
 				fs.log.Infof("Faild to transfer '%s' [%s]", f.Name(), w.uploadErr)
 			} else {
@@ -115,20 +190,30 @@ func (fs *SwiftFS) Filewrite(r *sftp.Request) (io.WriterAt, error) {
 	}
 
 	if err := writer.Begin(); err != nil {
-		writer.Close()
+		// Don't upload the data that has been written in Begin()
+		writer.Abort()
 
-		fs.log.Warnf("%s %s", r.Filepath, err.Error())
-		return nil, sftp.ErrSshFxFailure
+		return nil, fs.sftpError(r.Filepath, err)
 	}
 
+	fs.writingsLock.Lock()
+	fs.writings[f.objectname] = writer
+	fs.writingsLock.Unlock()
+
 	fs.log.Infof("Transferring %s ...", r.Filepath)
 
 	return writer, nil
 }
 
+// Filecmd may be called concurrently. The commands on the same paths are serialized,
+// so that e.g. two requests can't rename the same file at once.
 func (fs *SwiftFS) Filecmd(r *sftp.Request) error {
-	fs.lock.Lock()
-	defer fs.lock.Unlock()
+	names := []string{fs.filepath2object(r.Filepath)}
+	if r.Target != "" {
+		names = append(names, fs.filepath2object(r.Target))
+	}
+	unlock := fs.paths.Lock(names...)
+	defer unlock()
 
 	if r.Target != "" {
 		fs.log.Infof("%s %s %s", r.Method, r.Filepath, r.Target)
@@ -136,40 +221,116 @@ func (fs *SwiftFS) Filecmd(r *sftp.Request) error {
 		fs.log.Infof("%s %s", r.Method, r.Filepath)
 	}
 
+	// The drop box users can create the directories and set the attributes of the uploaded files.
+	allowed := fs.mode.CanModify()
+	if r.Method == "Mkdir" || r.Method == "Setstat" {
+		allowed = fs.mode.CanWrite()
+	}
+	if err := fs.permit(r.Method, r.Filepath, allowed); err != nil {
+		return err
+	} else if err = fs.authorizeCmd(r); err != nil {
+		return err
+	}
+
 	switch r.Method {
 	case "Rename":
-		f, err := fs.lookup(r.Filepath)
+		f, err := fs.lookupLink(r.Filepath)
 		if err != nil {
-			fs.log.Warnf("%s %s", r.Filepath, err.Error())
-			return sftp.ErrSshFxNoSuchFile
+			return fs.sftpError(r.Filepath, err)
+		} else if err = fs.authorizeResolved(r.Method, r.Filepath, f, ACLRename); err != nil {
+			return err
+		} else if f.IsDir() {
+			return fs.renameDir(f, fs.filepath2object(r.Target))
 		}
 
-		tf := SwiftFile{
-			objectname: r.Target,
+		err = fs.store.Rename(f.objectname, fs.filepath2object(r.Target))
+		if err != nil {
+			return fs.sftpError(r.Filepath, err)
 		}
-		target := &SwiftFile{
-			objectname: tf.Name(),
-			size:       0,
-			modtime:    time.Now(),
-			symlink:    "",
-			isdir:      false,
+
+	case "Remove":
+		f, err := fs.lookupLink(r.Filepath)
+		if err != nil {
+			return fs.sftpError(r.Filepath, err)
+		} else if err = fs.authorizeResolved(r.Method, r.Filepath, f, ACLDelete); err != nil {
+			return err
+		} else if f.IsDir() {
+			fs.log.Warnf("%s Is a directory", r.Filepath)
+			return sftp.ErrSshFxFailure
 		}
 
-		return fs.swift.Rename(f.Name(), target.Name())
+		err = fs.store.Delete(f.objectname)
+		if err != nil {
+			return fs.sftpError(r.Filepath, err)
+		}
 
-	case "Remove":
-		f, err := fs.lookup(r.Filepath)
+	case "Mkdir":
+		if _, err := fs.lookupLink(r.Filepath); err == nil {
+			fs.log.Warnf("%s File exists", r.Filepath)
+			return sftp.ErrSshFxFailure
+		}
+
+		// Directories are zero-byte marker objects that have a trailing delimiter.
+		name := fs.filepath2object(r.Filepath) + Delimiter
+		if err := fs.store.Put(name, bytes.NewReader([]byte{})); err != nil {
+			return fs.sftpError(r.Filepath, err)
+		}
+
+	case "Rmdir":
+		f, err := fs.lookupLink(r.Filepath)
 		if err != nil {
-			fs.log.Warnf("%s %s", r.Filepath, err.Error())
-			return sftp.ErrSshFxNoSuchFile
+			return fs.sftpError(r.Filepath, err)
+		} else if err = fs.authorizeResolved(r.Method, r.Filepath, f, ACLDelete); err != nil {
+			return err
+		} else if !f.IsDir() || f.objectname == fs.home {
+			fs.log.Warnf("%s Not a directory", r.Filepath)
+			return sftp.ErrSshFxFailure
 		}
 
-		err = fs.swift.Delete(f.Name())
+		// The marker object and one more entry are enough to know if it's empty.
+		prefix := f.objectname + Delimiter
+		objs, err := fs.store.List(prefix, Delimiter, 2)
 		if err != nil {
-			fs.log.Warnf("%s %s", r.Filepath, err.Error())
+			return fs.sftpError(r.Filepath, err)
+		}
+		for _, obj := range objs {
+			if obj.Name != prefix {
+				fs.log.Warnf("%s Directory not empty", r.Filepath)
+				return sftp.ErrSshFxFailure
+			}
+		}
+
+		// An implicit directory has no marker object. It's already empty.
+		err = fs.store.Delete(prefix)
+		if err != nil && err != ErrObjectNotFound {
+			return fs.sftpError(r.Filepath, err)
+		}
+
+	case "Symlink":
+		// r.Filepath is the target, and r.Target is the path of the new symlink.
+		// The relative target is resolved from the directory of the symlink,
+		// because Swift symlinks always point to the object name.
+		target := r.Filepath
+		if !path.IsAbs(target) {
+			target = path.Join(path.Dir(r.Target), target)
+		}
+
+		name := fs.filepath2object(target)
+		if name == "" {
+			fs.log.Warnf("%s Couldn't link to the root directory", r.Target)
+			return sftp.ErrSshFxFailure
+		} else if _, err := fs.lookupLink(r.Target); err == nil {
+			fs.log.Warnf("%s File exists", r.Target)
 			return sftp.ErrSshFxFailure
 		}
 
+		if err := fs.store.PutSymlink(fs.filepath2object(r.Target), name); err != nil {
+			return fs.sftpError(r.Target, err)
+		}
+
+	case "Setstat":
+		return fs.setstat(r)
+
 	default:
 		fs.log.Warnf("Unsupported operation (method=%s, target=%s)", r.Method, r.Target)
 		return sftp.ErrSshFxOpUnsupported
@@ -177,18 +338,196 @@ func (fs *SwiftFS) Filecmd(r *sftp.Request) error {
 	return nil
 }
 
-func (fs *SwiftFS) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
-	fs.lock.Lock()
-	defer fs.lock.Unlock()
+// setstat stores the modification time, the access time and the mode as the object metadata.
+// If the size is given, the object is truncated.
+func (fs *SwiftFS) setstat(r *sftp.Request) error {
+	flags := r.AttrFlags()
+	attrs := r.Attributes()
+
+	metadata := map[string]string{}
+	if flags.Acmodtime {
+		metadata[MetaMtime] = strconv.FormatUint(uint64(attrs.Mtime), 10)
+		metadata[MetaAtime] = strconv.FormatUint(uint64(attrs.Atime), 10)
+	}
+	if flags.Permissions {
+		metadata[MetaMode] = strconv.FormatUint(uint64(attrs.FileMode()&os.ModePerm), 8)
+	}
+
+	// The file is being written. The attributes are set after uploading.
+	name := fs.filepath2object(r.Filepath)
+	fs.writingsLock.Lock()
+	w, ok := fs.writings[name]
+	fs.writingsLock.Unlock()
+	if ok {
+		// OpenSSH's sftp and scp set the size that has been written after the transfer.
+		if flags.Size && int64(attrs.Size) != w.Size() {
+			fs.log.Warnf("%s Couldn't truncate the file during the transfer", r.Filepath)
+			return sftp.ErrSshFxOpUnsupported
+		}
+		w.setMetadata(metadata)
+		return nil
+	}
+
+	f, err := fs.lookup(r.Filepath)
+	if err != nil {
+		return fs.sftpError(r.Filepath, err)
+	} else if err = fs.authorizeResolved(r.Method, r.Filepath, f, ACLWrite); err != nil {
+		return err
+	} else if f.IsDir() {
+		// Directories may not have the marker object. Ignore the attributes.
+		fs.log.Debugf("%s Ignore the attributes for the directory", r.Filepath)
+		return nil
+	}
+
+	info, err := fs.store.Get(f.objectname)
+	if err != nil {
+		return fs.sftpError(r.Filepath, err)
+	}
+
+	if flags.Size && int64(attrs.Size) != info.Bytes {
+		// Truncating overwrites the file, which the drop box users can't do.
+		if err = fs.permit(r.Method, r.Filepath, fs.mode.CanModify()); err != nil {
+			return err
+		}
+		if err = fs.truncate(f, int64(attrs.Size)); err != nil {
+			return fs.sftpError(r.Filepath, err)
+		}
+	} else if len(metadata) == 0 {
+		return nil
+	}
+
+	// Uploading the object resets the metadata.
+	for k, v := range metadata {
+		info.Metadata[k] = v
+	}
+	if err = fs.store.SetMetadata(f.objectname, info.Metadata); err != nil {
+		return fs.sftpError(r.Filepath, err)
+	}
+	return nil
+}
+
+// truncate uploads the object again with the new size. The data is filled with zero if the size is larger.
+func (fs *SwiftFS) truncate(f *SwiftFile, size int64) error {
+	fs.log.Debugf("Truncate '%s' (size=%d)", f.objectname, size)
+
+	var content io.Reader = bytes.NewReader([]byte{})
+	if size > 0 && f.size > 0 {
+		body, err := fs.store.DownloadRange(f.objectname, 0, size)
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+		content = body
+	}
+	if size > f.size {
+		content = io.MultiReader(content, io.LimitReader(zeroReader{}, size-f.size))
+	}
+
+	// upload through the writer that handles the large objects
+	w := &swiftWriter{
+		log:         fs.log,
+		store:       fs.store,
+		sf:          &SwiftFile{objectname: f.objectname, modtime: time.Now()},
+		timeout:     fs.timeout,
+		segmentSize: fs.segmentSize,
+	}
+	if err := w.Begin(); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 32*1024)
+	var offset int64
+	for {
+		n, err := content.Read(buf)
+		if n > 0 {
+			if _, werr := w.WriteAt(buf[:n], offset); werr != nil {
+				w.Abort()
+				return werr
+			}
+			offset += int64(n)
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			w.Abort()
+			return err
+		}
+	}
+	return w.close()
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// renameDir moves all objects under the directory to the target with server-side copy.
+// The objects are moved one by one, so some of them may be left in the directory
+// if an error occurs. In that case, the error tells how many objects couldn't be moved.
+func (fs *SwiftFS) renameDir(f *SwiftFile, target string) error {
+	path := fs.object2filepath(f.objectname)
+
+	if f.objectname == fs.home || target == fs.home {
+		fs.log.Warnf("%s Couldn't rename the root directory", path)
+		return sftp.ErrSshFxFailure
+	} else if strings.HasPrefix(target+Delimiter, f.objectname+Delimiter) {
+		fs.log.Warnf("%s Couldn't move the directory into itself", path)
+		return sftp.ErrSshFxFailure
+	} else if _, err := fs.lookupLink(fs.object2filepath(target)); err == nil {
+		fs.log.Warnf("%s File exists", fs.object2filepath(target))
+		return sftp.ErrSshFxFailure
+	}
+
+	prefix := f.objectname + Delimiter
+	objs, err := fs.store.List(prefix, "", 0)
+	if err != nil {
+		return fs.sftpError(path, err)
+	}
+
+	// Move the directory marker at last, so that the directory remains until all objects are moved.
+	sort.SliceStable(objs, func(i, j int) bool {
+		return objs[j].Name == prefix && objs[i].Name != prefix
+	})
+
+	failed := 0
+	for _, obj := range objs {
+		newName := target + Delimiter + strings.TrimPrefix(obj.Name, prefix)
+		fs.log.Debugf("Rename '%s' to '%s'", obj.Name, newName)
+
+		if err = fs.store.Rename(obj.Name, newName); err != nil {
+			fs.log.Warnf("%s Couldn't move to '%s' [%s]", fs.object2filepath(obj.Name), fs.object2filepath(newName), err.Error())
+			failed++
+		}
+	}
 
+	if failed > 0 {
+		err = fmt.Errorf("%d of %d objects in the directory couldn't be renamed", failed, len(objs))
+		fs.log.Warnf("%s %s", path, err.Error())
+		return err
+	}
+	return nil
+}
+
+func (fs *SwiftFS) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
 	fs.log.Infof("%s %s", r.Method, r.Filepath)
 
 	switch r.Method {
 	case "List":
-		files, err := fs.walk(r.Filepath)
+		if err := fs.permit(r.Method, r.Filepath, fs.mode.CanRead()); err != nil {
+			return nil, err
+		} else if err = fs.authorize(r.Method, r.Filepath, ACLList); err != nil {
+			return nil, err
+		}
+
+		files, dir, err := fs.walk(r.Filepath)
 		if err != nil {
-			fs.log.Warnf("%s %s", r.Filepath, err.Error())
-			return nil, sftp.ErrSshFxFailure
+			return nil, fs.sftpError(r.Filepath, err)
+		} else if err = fs.authorizeResolved(r.Method, r.Filepath, dir, ACLList); err != nil {
+			return nil, err
 		}
 
 		list := make([]os.FileInfo, 0, len(files))
@@ -198,10 +537,14 @@ func (fs *SwiftFS) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
 		return listerat(list), nil
 
 	case "Stat":
+		// Stat is allowed to the drop box users, because the clients check the directories with it.
+		if err := fs.authorizeStat(r.Method, r.Filepath); err != nil {
+			return nil, err
+		}
+
 		f, err := fs.lookup(r.Filepath)
 		if err != nil {
-			fs.log.Warnf("%s %s", r.Filepath, err.Error())
-			return nil, sftp.ErrSshFxNoSuchFile
+			return nil, fs.sftpError(r.Filepath, err)
 		}
 		if f != nil {
 			return listerat([]os.FileInfo{f}), nil
@@ -213,80 +556,381 @@ func (fs *SwiftFS) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
 		fs.log.Warnf("Unsupported operation [method=%s, target=%s]", r.Method, r.Target)
 		return nil, sftp.ErrSshFxOpUnsupported
 	}
-	return nil, nil
 }
 
-func (fs *SwiftFS) filepath2object(path string) string {
-	return path[1:]
+// Lstat returns the symlink itself instead of the file that it points to.
+// It implements sftp.LstatFileLister interface.
+func (fs *SwiftFS) Lstat(r *sftp.Request) (sftp.ListerAt, error) {
+	fs.log.Infof("%s %s", r.Method, r.Filepath)
+
+	// Lstat is allowed to the drop box users as well as Stat.
+	if err := fs.authorizeStat(r.Method, r.Filepath); err != nil {
+		return nil, err
+	}
+
+	f, err := fs.lookupLink(r.Filepath)
+	if err != nil {
+		return nil, fs.sftpError(r.Filepath, err)
+	}
+	return listerat([]os.FileInfo{f}), nil
+}
+
+// Readlink returns the path that the symlink points to.
+// It implements sftp.ReadlinkFileLister interface.
+func (fs *SwiftFS) Readlink(p string) (string, error) {
+	fs.log.Infof("Readlink %s", p)
+
+	if err := fs.permit("Readlink", p, fs.mode.CanRead()); err != nil {
+		return "", err
+	} else if err = fs.authorize("Readlink", p, ACLRead); err != nil {
+		return "", err
+	}
+
+	f, err := fs.lookupLink(p)
+	if err != nil {
+		return "", fs.sftpError(p, err)
+	} else if err = fs.authorizeResolved("Readlink", p, f, ACLRead); err != nil {
+		return "", err
+	} else if f.symlink == "" {
+		fs.log.Warnf("%s Not a symlink", p)
+		return "", sftp.ErrSshFxFailure
+	} else if !fs.inHome(f.symlink) {
+		fs.log.Warnf("%s Symlink points to the outside of the home directory [%s]", p, f.symlink)
+		return "", sftp.ErrSshFxFailure
+	}
+	return fs.object2filepath(f.symlink), nil
+}
+
+// Parameters of the file system that are reported by statvfs
+const (
+	statvfsBlockSize = 4096
+	statvfsNameMax   = 1024 // max length of the object names in Swift
+	statvfsReadOnly  = 0x1  // SSH_FXE_STATVFS_ST_RDONLY
+)
+
+// StatVFS answers statvfs@openssh.com with the quota of the container or the account.
+// If no quota is set, the configured capacity and the account usage are used.
+// It implements sftp.StatVFSFileCmder interface.
+func (fs *SwiftFS) StatVFS(r *sftp.Request) (*sftp.StatVFS, error) {
+	fs.log.Infof("%s %s", r.Method, r.Filepath)
+
+	u, err := fs.store.Usage()
+	if err != nil {
+		return nil, fs.sftpError(r.Filepath, err)
+	}
+
+	var total, used int64
+	switch {
+	case u.QuotaBytes > 0:
+		total, used = u.QuotaBytes, u.Bytes
+	case u.AccountQuotaBytes > 0:
+		total, used = u.AccountQuotaBytes, u.AccountBytes
+	case fs.capacity > 0:
+		total, used = fs.capacity, u.AccountBytes
+	default:
+		fs.log.Warnf("%s No quota or storage capacity is set for statvfs", r.Filepath)
+		return nil, sftp.ErrSshFxOpUnsupported
+	}
+
+	free := total - used
+	if free < 0 {
+		free = 0
+	}
+
+	stat := &sftp.StatVFS{
+		Bsize:   statvfsBlockSize,
+		Frsize:  statvfsBlockSize,
+		Blocks:  uint64(total / statvfsBlockSize),
+		Bfree:   uint64(free / statvfsBlockSize),
+		Bavail:  uint64(free / statvfsBlockSize),
+		Namemax: statvfsNameMax,
+	}
+
+	// Without the quota of the count, a file can be created in each free block.
+	if u.QuotaCount > 0 {
+		stat.Files = uint64(u.QuotaCount)
+		if u.QuotaCount > u.Count {
+			stat.Ffree = uint64(u.QuotaCount - u.Count)
+		}
+	} else {
+		stat.Files = uint64(u.Count) + stat.Bfree
+		stat.Ffree = stat.Bfree
+	}
+	stat.Favail = stat.Ffree
+
+	if !fs.mode.CanWrite() {
+		stat.Flag |= statvfsReadOnly
+	}
+	return stat, nil
+}
+
+// sftpError logs the error for the path and returns the status for the SFTP client.
+func (fs *SwiftFS) sftpError(path string, err error) error {
+	fs.log.Warnf("%s %s", path, err.Error())
+	return statusError(err)
+}
+
+// filepath2object converts the path on the client to the object name.
+// The path is cleaned up, so that ".." never goes out of the home directory.
+func (fs *SwiftFS) filepath2object(p string) string {
+	p = path.Clean(Delimiter + p)
+	if p == Delimiter {
+		return fs.home
+	} else if fs.home == "" {
+		return p[1:]
+	}
+	return fs.home + p
 }
 func (fs *SwiftFS) object2filepath(name string) string {
-	return Delimiter + name
+	if fs.home == "" {
+		return Delimiter + name
+	} else if name == fs.home {
+		return Delimiter
+	}
+	return strings.TrimPrefix(name, fs.home)
 }
 
-// Return SwiftFile objects in the specific directory
-func (fs *SwiftFS) walk(dirname string) ([]*SwiftFile, error) {
-	files, err := fs.allFiles()
+// inHome returns true if the object is in the home directory of the client.
+// The symlinks to the other containers have a leading delimiter, and they are never in it.
+func (fs *SwiftFS) inHome(name string) bool {
+	if strings.HasPrefix(name, Delimiter) {
+		return false
+	} else if fs.home == "" {
+		return true
+	}
+	return name == fs.home || strings.HasPrefix(name, fs.home+Delimiter)
+}
+
+// Return SwiftFile objects in the specific directory and the directory itself.
+// If the directory is a symlink, the returned directory is the one that it points to.
+func (fs *SwiftFS) walk(dirname string) ([]*SwiftFile, *SwiftFile, error) {
+	fs.log.Debugf("Updating file list...")
+
+	dir := &SwiftFile{
+		objectname: fs.filepath2object(dirname),
+		modtime:    time.Now(),
+		isdir:      true,
+	}
+
+	// Ask the object storage only for the objects in the directory
+	prefix := dir.objectname
+	if prefix != "" && !strings.HasSuffix(prefix, Delimiter) {
+		prefix += Delimiter
+	}
+
+	objs, err := fs.store.List(prefix, Delimiter, 0)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	list := make([]*SwiftFile, 0, len(files))
-	for _, f := range files {
-		if f.Abs() != dirname && f.Dir() == dirname {
-			list = append(list, f)
+	// Nothing is found. The directory may be a symlink or in the directory that is a symlink.
+	if len(objs) == 0 {
+		if dir, err = fs.lookup(dirname); err != nil {
+			return nil, nil, err
+		} else if dir.isdir && dir.objectname+Delimiter != prefix {
+			prefix = dir.objectname + Delimiter
+			if objs, err = fs.store.List(prefix, Delimiter, 0); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	fs.fillMetadata(objs)
+
+	list := make([]*SwiftFile, 0, len(objs))
+	for _, obj := range objs {
+		if obj.Name == prefix {
+			// the directory itself
+			continue
+
+		} else if obj.Subdir {
+			list = append(list, &SwiftFile{
+				objectname: strings.TrimSuffix(obj.Name, Delimiter),
+				modtime:    time.Now(),
+				isdir:      true,
+			})
+			continue
+		}
+
+		f := &SwiftFile{
+			objectname: obj.Name,
+			size:       obj.Bytes,
+			modtime:    obj.LastModified,
+			symlink:    obj.SymlinkTarget,
+			isdir:      false,
 		}
+		if f.symlink != "" {
+			f.size = int64(len(f.symlink))
+		}
+		f.applyMetadata(obj.Metadata)
+		list = append(list, f)
 	}
-	return list, nil
+	return list, dir, nil
 }
 
-// Return SwiftFile object with the path
+// Max number of HEAD requests that fillMetadata sends at once
+const maxMetadataRequests = 8
+
+// Content type of the symlinks in the listing of Swift
+const symlinkContentType = "application/symlink"
+
+// fillMetadata gets the targets of the symlinks that the listing doesn't contain.
+// Swift doesn't return them in the listing, so it sends HEAD request for each symlink.
+// The metadata of the other objects (mode and mtime) are read only if the listing has no more
+// objects than listMetadata. Otherwise they are read by Stat and Lstat.
+func (fs *SwiftFS) fillMetadata(objs []ObjectInfo) {
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, maxMetadataRequests)
+	all := len(objs) <= fs.listMetadata
+
+	for i := range objs {
+		if objs[i].Subdir || objs[i].Metadata != nil {
+			continue
+		} else if !all && (objs[i].SymlinkTarget != "" || objs[i].ContentType != symlinkContentType) {
+			continue
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(obj *ObjectInfo) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			info, err := fs.store.Get(obj.Name)
+			if err != nil {
+				fs.log.Debugf("Couldn't get the metadata of '%s' [%s]", obj.Name, err.Error())
+				return
+			}
+			obj.Metadata = info.Metadata
+			obj.SymlinkTarget = info.SymlinkTarget
+		}(&objs[i])
+	}
+	wg.Wait()
+}
+
+// Max number of the symlinks that are followed in one lookup
+const maxSymlinks = 8
+
+// Return SwiftFile object with the path. The symlinks are followed,
+// so the object name of the returned SwiftFile is the one that they point to.
 func (fs *SwiftFS) lookup(path string) (*SwiftFile, error) {
+	return fs.lookupObject(fs.filepath2object(path), true, 0)
+}
+
+// lookupLink is the same as lookup, but it returns the symlink itself if the path is a symlink.
+// The symlinks in the parent directories are followed.
+func (fs *SwiftFS) lookupLink(path string) (*SwiftFile, error) {
+	return fs.lookupObject(fs.filepath2object(path), false, 0)
+}
+
+func (fs *SwiftFS) lookupObject(name string, follow bool, depth int) (*SwiftFile, error) {
+	if depth > maxSymlinks {
+		return nil, fmt.Errorf("Too many levels of symlinks")
+	}
+
 	// root path is not on the object storage and return it manually.
-	if path == "/" {
+	if name == fs.home {
 		f := &SwiftFile{
-			objectname: "",
+			objectname: name,
 			modtime:    time.Now(),
 			isdir:      true,
 		}
 		return f, nil
 	}
 
-	name := fs.filepath2object(path)
-	header, err := fs.swift.Get(name)
-	if err != nil {
+	info, err := fs.store.Get(name)
+	if err == ErrObjectNotFound {
+		f, err := fs.lookupDir(name)
+		if err != ErrObjectNotFound {
+			return f, err
+		}
+
+		// The parent directory may be a symlink.
+		resolved, err := fs.resolveParent(name)
+		if err != nil {
+			return nil, err
+		}
+		return fs.lookupObject(resolved, follow, depth+1)
+
+	} else if err != nil {
 		return nil, err
 	}
 
+	if info.SymlinkTarget != "" && follow {
+		if !fs.inHome(info.SymlinkTarget) {
+			return nil, fmt.Errorf("Symlink points to the outside of the home directory [%s]", info.SymlinkTarget)
+		}
+		return fs.lookupObject(info.SymlinkTarget, follow, depth+1)
+	}
+
 	f := &SwiftFile{
 		objectname: name,
-		size:       header.ContentLength,
-		modtime:    header.LastModified,
-		symlink:    "",
+		size:       info.Bytes,
+		modtime:    info.LastModified,
+		symlink:    info.SymlinkTarget,
 		isdir:      false,
 	}
+	if f.symlink != "" {
+		f.size = int64(len(f.symlink))
+	}
+	f.applyMetadata(info.Metadata)
 	return f, nil
 }
 
-// To synchronize objects on object storage and fs.files
-func (fs *SwiftFS) allFiles() ([]*SwiftFile, error) {
-	fs.log.Debugf("Updating file list...")
+// resolveParent replaces the nearest parent directory that is a symlink with the target.
+// It returns ErrObjectNotFound if no parent directory is a symlink.
+func (fs *SwiftFS) resolveParent(name string) (string, error) {
+	for dir := path.Dir(name); dir != "." && dir != fs.home; dir = path.Dir(dir) {
+		info, err := fs.store.Get(dir)
+		if err == ErrObjectNotFound {
+			continue
+		} else if err != nil {
+			return "", err
+		} else if info.SymlinkTarget == "" {
+			// a file is not a directory
+			return "", ErrObjectNotFound
+		} else if !fs.inHome(info.SymlinkTarget) {
+			return "", fmt.Errorf("Symlink points to the outside of the home directory [%s]", info.SymlinkTarget)
+		}
+		return info.SymlinkTarget + name[len(dir):], nil
+	}
+	return "", ErrObjectNotFound
+}
+
+// Return SwiftFile object of the directory. Directories are either marker objects
+// that have a trailing delimiter ("dir/") or implicit prefixes of the other objects.
+func (fs *SwiftFS) lookupDir(name string) (*SwiftFile, error) {
+	prefix := name + Delimiter
+
+	info, err := fs.store.Get(prefix)
+	if err == nil {
+		f := &SwiftFile{
+			objectname: name,
+			modtime:    info.LastModified,
+			isdir:      true,
+		}
+		return f, nil
+
+	} else if err != ErrObjectNotFound {
+		return nil, err
+	}
 
-	// Get object list from object storage
-	objs, err := fs.swift.List()
+	// Only one entry is needed to know that the directory exists.
+	objs, err := fs.store.List(prefix, Delimiter, 1)
 	if err != nil {
 		return nil, err
+	} else if len(objs) == 0 {
+		return nil, ErrObjectNotFound
 	}
 
-	files := make([]*SwiftFile, len(objs))
-	for i, obj := range objs {
-		files[i] = &SwiftFile{
-			objectname: obj.Name,
-			size:       obj.Bytes,
-			modtime:    obj.LastModified,
-			isdir:      false,
-		}
+	f := &SwiftFile{
+		objectname: name,
+		modtime:    time.Now(),
+		isdir:      true,
 	}
-	return files, nil
+	return f, nil
 }
 
 // Modeled after strings.Reader's ReadAt() implementation
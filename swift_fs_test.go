@@ -2,20 +2,25 @@ package main
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"reflect"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
-	"github.com/gophercloud/gophercloud"
 	"github.com/pkg/sftp"
 )
 
 func TestFileread(t *testing.T) {
-	s := swiftForTesting()
+	s := storeForTesting()
 
 	filename := "fileread-test.dat"
 	defer func() {
@@ -27,7 +32,7 @@ func TestFileread(t *testing.T) {
 		t.Error(err)
 	}
 
-	fs := NewSwiftFS(s)
+	fs := NewSwiftFS(s, defaultConfigForTesting())
 	req := sftp.NewRequest("Read", "/"+filename)
 	_, err = fs.Fileread(req)
 	if err != nil {
@@ -36,7 +41,7 @@ func TestFileread(t *testing.T) {
 }
 
 func TestFilewrite(t *testing.T) {
-	s := swiftForTesting()
+	s := storeForTesting()
 
 	filename := "filewrite-test.dat"
 	defer func() {
@@ -45,7 +50,7 @@ func TestFilewrite(t *testing.T) {
 
 	data, err := generateTestFile(filename, 1024*1024)
 
-	fs := NewSwiftFS(s)
+	fs := NewSwiftFS(s, defaultConfigForTesting())
 	req := sftp.NewRequest("Write", "/"+filename)
 	sw, err := fs.Filewrite(req)
 	if err != nil {
@@ -87,7 +92,7 @@ func TestFilewrite(t *testing.T) {
 }
 
 func TestFilecmd(t *testing.T) {
-	s := swiftForTesting()
+	s := storeForTesting()
 
 	filename := "filecmd-rename-test.dat"
 	targetName := "filecmd-rename-target-test.dat"
@@ -100,16 +105,12 @@ func TestFilecmd(t *testing.T) {
 	req := sftp.NewRequest("Rename", "/"+filename)
 	req.Target = "/" + targetName
 
-	fs := NewSwiftFS(s)
+	fs := NewSwiftFS(s, defaultConfigForTesting())
 	if err = fs.Filecmd(req); err != nil {
 		t.Error(err)
 	}
 
-	if _, err = s.Get(filename); err == nil {
-		t.Error("Original file that should be deleted exists")
-	}
-	_, ok := err.(gophercloud.ErrDefault404)
-	if !ok {
+	if _, err = s.Get(filename); err != ErrObjectNotFound {
 		t.Error("Original file that should be deleted exists")
 	}
 
@@ -123,17 +124,13 @@ func TestFilecmd(t *testing.T) {
 		t.Error(err)
 	}
 
-	if _, err = s.Get(targetName); err == nil {
-		t.Error("File that should be deleted exists")
-	}
-	_, ok = err.(gophercloud.ErrDefault404)
-	if !ok {
+	if _, err = s.Get(targetName); err != ErrObjectNotFound {
 		t.Error("File that should be deleted exists")
 	}
 }
 
 func TestFilelist(t *testing.T) {
-	s := swiftForTesting()
+	s := storeForTesting()
 
 	files := []string{
 		"filelist-foo-test.dat",
@@ -157,14 +154,26 @@ func TestFilelist(t *testing.T) {
 	}
 
 	// list
-	fs := NewSwiftFS(s)
+	c := defaultConfigForTesting()
+	fs := NewSwiftFS(s, c)
 
+	heads := 0
+	if testFakeSwift != nil && c.Backend != BackendMemory {
+		heads = testFakeSwift.headRequests()
+	}
 	req := sftp.NewRequest("List", "/")
 	l, err := fs.Filelist(req)
 	if err != nil {
 		t.Error(err)
 	}
 
+	// The listing doesn't send HEAD request for each object
+	if testFakeSwift != nil && c.Backend != BackendMemory {
+		if n := testFakeSwift.headRequests() - heads; n != 0 {
+			t.Errorf("Listing sent %d HEAD requests", n)
+		}
+	}
+
 	list := make([]os.FileInfo, len(files))
 	n, err := l.ListAt(list, 0)
 	if err != nil && err != io.EOF {
@@ -203,3 +212,1250 @@ func TestFilelist(t *testing.T) {
 		}
 	}
 }
+
+func TestFilelistSubdir(t *testing.T) {
+	s := storeForTesting()
+
+	names := []string{
+		"filelist-dir/foo.dat",
+		"filelist-dir/sub/bar.dat",
+	}
+	for _, name := range names {
+		if err := s.Put(name, bytes.NewReader([]byte(name))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func() {
+		for _, name := range names {
+			s.Delete(name)
+		}
+	}()
+
+	fs := NewSwiftFS(s, defaultConfigForTesting())
+	l, err := fs.Filelist(sftp.NewRequest("List", "/filelist-dir"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list := make([]os.FileInfo, 10)
+	n, err := l.ListAt(list, 0)
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	} else if n != 2 {
+		t.Fatalf("Count of list is wrong [%d]", n)
+	}
+
+	if list[0].Name() != "foo.dat" || list[0].IsDir() {
+		t.Errorf("Wrong file entry [%s]", list[0].Name())
+	}
+	if list[1].Name() != "sub" || !list[1].IsDir() {
+		t.Errorf("Wrong directory entry [%s]", list[1].Name())
+	}
+}
+
+func TestMkdirRmdir(t *testing.T) {
+	s := storeForTesting()
+	fs := NewSwiftFS(s, defaultConfigForTesting())
+
+	dirname := "/mkdir-test"
+	if err := fs.Filecmd(sftp.NewRequest("Mkdir", dirname)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Mkdir for an existing directory should fail
+	if err := fs.Filecmd(sftp.NewRequest("Mkdir", dirname)); err == nil {
+		t.Error("Mkdir should fail for an existing directory")
+	}
+
+	// stat
+	l, err := fs.Filelist(sftp.NewRequest("Stat", dirname))
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := make([]os.FileInfo, 1)
+	if _, err = l.ListAt(list, 0); err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	if list[0].Name() != "mkdir-test" || !list[0].IsDir() || !list[0].Mode().IsDir() {
+		t.Errorf("Wrong directory entry [%s]", list[0].Name())
+	}
+
+	// Rmdir for non-empty directory should fail
+	filename := "mkdir-test/foo.dat"
+	if err = s.Put(filename, bytes.NewReader([]byte("foo"))); err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.Filecmd(sftp.NewRequest("Rmdir", dirname)); err == nil {
+		t.Error("Rmdir should fail for non-empty directory")
+	}
+	if err = fs.Filecmd(sftp.NewRequest("Remove", "/"+filename)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = fs.Filecmd(sftp.NewRequest("Rmdir", dirname)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fs.Filelist(sftp.NewRequest("Stat", dirname)); err == nil {
+		t.Error("Directory that should be deleted exists")
+	}
+}
+
+func TestStatImplicitDir(t *testing.T) {
+	s := storeForTesting()
+	fs := NewSwiftFS(s, defaultConfigForTesting())
+
+	filename := "implicit-dir/sub/foo.dat"
+	if err := s.Put(filename, bytes.NewReader([]byte("foo"))); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Delete(filename)
+
+	for _, path := range []string{"/implicit-dir", "/implicit-dir/sub"} {
+		l, err := fs.Filelist(sftp.NewRequest("Stat", path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		list := make([]os.FileInfo, 1)
+		if _, err = l.ListAt(list, 0); err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+		if !list[0].IsDir() {
+			t.Errorf("'%s' should be a directory", path)
+		}
+	}
+
+	if _, err := fs.Filelist(sftp.NewRequest("Stat", "/implicit-di")); err == nil {
+		t.Error("Stat should fail for a partial prefix")
+	}
+}
+
+func TestRenameDir(t *testing.T) {
+	s := storeForTesting()
+	c := defaultConfigForTesting()
+	fs := NewSwiftFS(s, c)
+
+	// directory marker, objects in the sub directory and Static Large Object
+	files := map[string][]byte{
+		"rename-dir/":              []byte{},
+		"rename-dir/foo.dat":       []byte("foo"),
+		"rename-dir/sub/bar.dat":   []byte("bar"),
+		"rename-dir/sub/large.dat": []byte("segment1segment2"),
+	}
+	for name, data := range files {
+		if name == "rename-dir/sub/large.dat" {
+			continue
+		}
+		if err := s.Put(name, bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var segments []Segment
+	for i, data := range []string{"segment1", "segment2"} {
+		seg, err := s.PutSegment(fmt.Sprintf("rename-dir-test/%08d", i), strings.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		segments = append(segments, seg)
+	}
+	if err := s.PutManifest("rename-dir/sub/large.dat", segments); err != nil {
+		t.Fatal(err)
+	}
+
+	// renaming into itself or to the existing file should fail
+	req := sftp.NewRequest("Rename", "/rename-dir")
+	req.Target = "/rename-dir/sub/dest"
+	if err := fs.Filecmd(req); err == nil {
+		t.Error("Rename into itself should fail")
+	}
+	req.Target = "/rename-dir/foo.dat"
+	if err := fs.Filecmd(req); err == nil {
+		t.Error("Rename to the existing file should fail")
+	}
+
+	req.Target = "/renamed-dir"
+	if err := fs.Filecmd(req); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, data := range files {
+		if _, err := s.Get(name); err != ErrObjectNotFound {
+			t.Errorf("Original object '%s' that should be moved exists", name)
+		}
+
+		newName := "renamed-dir/" + strings.TrimPrefix(name, "rename-dir/")
+		r, _, err := s.Download(newName)
+		if err != nil {
+			t.Errorf("Object '%s' not found [%s]", newName, err)
+			continue
+		}
+		content, _ := ioutil.ReadAll(r)
+		r.Close()
+		if !bytes.Equal(content, data) {
+			t.Errorf("Wrong content of '%s'", newName)
+		}
+	}
+
+	// the segments are moved with the manifest
+	if testFakeSwift != nil && c.Backend != BackendMemory {
+		if n := testFakeSwift.countObjects(c.SegmentContainerName()); n != 2 {
+			t.Errorf("Number of the segments is wrong (%d)", n)
+		}
+	}
+
+	for name := range files {
+		s.Delete("renamed-dir/" + strings.TrimPrefix(name, "rename-dir/"))
+	}
+}
+
+func TestHomeDirectory(t *testing.T) {
+	s := storeForTesting()
+	fs := NewSwiftFS(s, defaultConfigForTesting())
+	fs.SetHomeDirectory("partners/alice")
+
+	// the object outside of the home directory
+	if err := s.Put("home-secret.dat", bytes.NewReader([]byte("secret"))); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Delete("home-secret.dat")
+
+	if err := fs.Filecmd(sftp.NewRequest("Mkdir", "/docs")); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Delete("partners/alice/docs/")
+
+	// the client can't escape from the home directory with ".."
+	w, err := fs.Filewrite(sftp.NewRequest("Put", "/../../home-secret.dat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.WriteAt([]byte("overwrite"), 0)
+	w.(io.Closer).Close()
+	defer s.Delete("partners/alice/home-secret.dat")
+
+	r, _, err := s.Download("home-secret.dat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := ioutil.ReadAll(r)
+	r.Close()
+	if string(content) != "secret" {
+		t.Errorf("The object outside of the home directory was overwritten")
+	}
+
+	// the root directory is the home directory
+	l, err := fs.Filelist(sftp.NewRequest("List", "/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := make([]os.FileInfo, 10)
+	n, _ := l.ListAt(list, 0)
+
+	names := []string{}
+	for _, f := range list[:n] {
+		names = append(names, f.Name())
+	}
+	sort.Strings(names)
+	if !reflect.DeepEqual(names, []string{"docs", "home-secret.dat"}) {
+		t.Errorf("Wrong file list in the home directory %v", names)
+	}
+
+	for _, path := range []string{"/../docs", "/docs/../../docs/./"} {
+		l, err = fs.Filelist(sftp.NewRequest("Stat", path))
+		if err != nil {
+			t.Fatalf("Stat failed for '%s' [%s]", path, err)
+		}
+		if _, err = l.ListAt(list, 0); err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+		if list[0].Name() != "docs" || !list[0].IsDir() {
+			t.Errorf("Wrong directory entry for '%s'", path)
+		}
+	}
+
+	// the absolute path in the container is also under the home directory
+	if _, err = fs.Filelist(sftp.NewRequest("Stat", "/partners/alice/docs")); err == nil {
+		t.Error("Stat should fail for the path outside of the home directory")
+	}
+
+	// the home directory can't be removed
+	if err = fs.Filecmd(sftp.NewRequest("Rmdir", "/..")); err == nil {
+		t.Error("Rmdir should fail for the home directory")
+	}
+}
+
+// Encode the file attributes of Setstat request
+func setstatRequest(path string, flags uint32, size uint64, mode, atime, mtime uint32) *sftp.Request {
+	buf := new(bytes.Buffer)
+	if flags&0x01 != 0 {
+		binary.Write(buf, binary.BigEndian, size)
+	}
+	if flags&0x04 != 0 {
+		binary.Write(buf, binary.BigEndian, mode)
+	}
+	if flags&0x08 != 0 {
+		binary.Write(buf, binary.BigEndian, atime)
+		binary.Write(buf, binary.BigEndian, mtime)
+	}
+
+	req := sftp.NewRequest("Setstat", path)
+	req.Flags = flags
+	req.Attrs = buf.Bytes()
+	return req
+}
+
+func statForTesting(fs *SwiftFS, path string) (os.FileInfo, error) {
+	l, err := fs.Filelist(sftp.NewRequest("Stat", path))
+	if err != nil {
+		return nil, err
+	}
+	list := make([]os.FileInfo, 1)
+	if _, err = l.ListAt(list, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return list[0], nil
+}
+
+func TestSetstat(t *testing.T) {
+	s := storeForTesting()
+	fs := NewSwiftFS(s, defaultConfigForTesting())
+
+	filename := "setstat-test.dat"
+	data, err := generateTestObject(filename, 1000)
+	os.Remove(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Delete(filename)
+
+	mtime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	req := setstatRequest("/"+filename, 0x04|0x08, 0, 0640, uint32(mtime.Unix()), uint32(mtime.Unix()))
+	if err = fs.Filecmd(req); err != nil {
+		t.Fatal(err)
+	}
+
+	// Stat and List report the attributes
+	f, err := statForTesting(fs, "/"+filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.ModTime().Equal(mtime) || f.Mode() != 0640 {
+		t.Errorf("Wrong attributes (mtime=%s, mode=%s)", f.ModTime(), f.Mode())
+	}
+
+	// The listing reports them only within the limit
+	fs.listMetadata = 10000
+	l, err := fs.Filelist(sftp.NewRequest("List", "/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := make([]os.FileInfo, 100)
+	n, _ := l.ListAt(list, 0)
+	found := false
+	for _, f := range list[:n] {
+		if f.Name() == filename {
+			found = true
+			if !f.ModTime().Equal(mtime) || f.Mode() != 0640 {
+				t.Errorf("Wrong attributes in the list (mtime=%s, mode=%s)", f.ModTime(), f.Mode())
+			}
+		}
+	}
+	if !found {
+		t.Errorf("'%s' not found in the list", filename)
+	}
+	fs.listMetadata = 0
+
+	// truncate and extend
+	for _, size := range []int{100, 200} {
+		if err = fs.Filecmd(setstatRequest("/"+filename, 0x01, uint64(size), 0, 0, 0)); err != nil {
+			t.Fatal(err)
+		}
+
+		r, _, err := s.Download(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := ioutil.ReadAll(r)
+		r.Close()
+
+		expected := make([]byte, size)
+		copy(expected, data[:100])
+		if !bytes.Equal(content, expected) {
+			t.Errorf("Wrong content after truncating (size=%d, len=%d)", size, len(content))
+		}
+
+		// the attributes remain
+		if f, err = statForTesting(fs, "/"+filename); err != nil {
+			t.Fatal(err)
+		} else if !f.ModTime().Equal(mtime) || f.Mode() != 0640 {
+			t.Errorf("Attributes were lost by truncating (mtime=%s, mode=%s)", f.ModTime(), f.Mode())
+		}
+	}
+}
+
+func TestSetstatWhileWriting(t *testing.T) {
+	s := storeForTesting()
+	fs := NewSwiftFS(s, defaultConfigForTesting())
+
+	filename := "setstat-writing-test.dat"
+	w, err := fs.Filewrite(sftp.NewRequest("Put", "/"+filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Delete(filename)
+	w.WriteAt([]byte("foo"), 0)
+
+	// fsetstat before closing like "put -p"
+	mtime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	req := setstatRequest("/"+filename, 0x04|0x08, 0, 0600, uint32(mtime.Unix()), uint32(mtime.Unix()))
+	if err = fs.Filecmd(req); err != nil {
+		t.Fatal(err)
+	}
+
+	// OpenSSH sets the written size after the transfer. Truncating is not supported.
+	if err = fs.Filecmd(setstatRequest("/"+filename, 0x01, 3, 0, 0, 0)); err != nil {
+		t.Errorf("Setstat with the written size should succeed [%v]", err)
+	}
+	if err = fs.Filecmd(setstatRequest("/"+filename, 0x01, 1, 0, 0, 0)); err != sftp.ErrSshFxOpUnsupported {
+		t.Errorf("Truncating during the transfer should be unsupported [%v]", err)
+	}
+	if err = w.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := statForTesting(fs, "/"+filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.ModTime().Equal(mtime) || f.Mode() != 0600 || f.Size() != 3 {
+		t.Errorf("Wrong attributes (mtime=%s, mode=%s, size=%d)", f.ModTime(), f.Mode(), f.Size())
+	}
+}
+
+func lstatForTesting(fs *SwiftFS, path string) (os.FileInfo, error) {
+	l, err := fs.Lstat(sftp.NewRequest("Lstat", path))
+	if err != nil {
+		return nil, err
+	}
+	list := make([]os.FileInfo, 1)
+	if _, err = l.ListAt(list, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return list[0], nil
+}
+
+func TestSymlink(t *testing.T) {
+	s := storeForTesting()
+	fs := NewSwiftFS(s, defaultConfigForTesting())
+
+	if err := s.Put("releases/2024-01/app.tar", bytes.NewReader([]byte("release"))); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Delete("releases/2024-01/app.tar")
+
+	// "latest" points to the release directory with the relative path
+	req := sftp.NewRequest("Symlink", "releases/2024-01")
+	req.Target = "/latest"
+	if err := fs.Filecmd(req); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Delete("latest")
+
+	target, err := fs.Readlink("/latest")
+	if err != nil {
+		t.Fatal(err)
+	} else if target != "/releases/2024-01" {
+		t.Errorf("Wrong symlink target '%s'", target)
+	}
+
+	// Lstat returns the symlink, and Stat returns the directory
+	f, err := lstatForTesting(fs, "/latest")
+	if err != nil {
+		t.Fatal(err)
+	} else if f.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("Lstat should return the symlink [mode=%s]", f.Mode())
+	}
+	f, err = statForTesting(fs, "/latest")
+	if err != nil {
+		t.Fatal(err)
+	} else if !f.IsDir() {
+		t.Errorf("Stat should return the directory [mode=%s]", f.Mode())
+	}
+
+	// list and read the files through the symlink
+	l, err := fs.Filelist(sftp.NewRequest("List", "/latest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := make([]os.FileInfo, 10)
+	n, _ := l.ListAt(list, 0)
+	if n != 1 || list[0].Name() != "app.tar" {
+		t.Errorf("Wrong file list through the symlink %v", list[:n])
+	}
+
+	r, err := fs.Fileread(sftp.NewRequest("Get", "/latest/app.tar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 7)
+	if _, err = r.ReadAt(buf, 0); err != nil && err != io.EOF {
+		t.Fatal(err)
+	} else if string(buf) != "release" {
+		t.Errorf("Wrong content through the symlink '%s'", buf)
+	}
+	r.(io.Closer).Close()
+
+	// the symlink in the listing of the parent directory
+	l, err = fs.Filelist(sftp.NewRequest("List", "/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, _ = l.ListAt(list, 0)
+	found := false
+	for _, f := range list[:n] {
+		if f.Name() == "latest" {
+			found = f.Mode()&os.ModeSymlink != 0
+		}
+	}
+	if !found {
+		t.Errorf("The symlink is not listed")
+	}
+
+	// Remove deletes the symlink, not the target
+	if err = fs.Filecmd(sftp.NewRequest("Remove", "/latest")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Get("releases/2024-01/app.tar"); err != nil {
+		t.Errorf("The target was removed with the symlink [%s]", err)
+	}
+
+	// dangling symlink
+	req = sftp.NewRequest("Symlink", "/missing")
+	req.Target = "/dangling"
+	if err = fs.Filecmd(req); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Delete("dangling")
+
+	if _, err = statForTesting(fs, "/dangling"); err == nil {
+		t.Error("Stat should fail for the dangling symlink")
+	}
+	if _, err = lstatForTesting(fs, "/dangling"); err != nil {
+		t.Errorf("Lstat failed for the dangling symlink [%s]", err)
+	}
+}
+
+func TestSymlinkOutsideHome(t *testing.T) {
+	s := storeForTesting()
+	fs := NewSwiftFS(s, defaultConfigForTesting())
+	fs.SetHomeDirectory("partners/alice")
+
+	if err := s.Put("symlink-secret.dat", bytes.NewReader([]byte("secret"))); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Delete("symlink-secret.dat")
+
+	// the symlink that is created outside of SFTP
+	if err := s.PutSymlink("partners/alice/escape", "symlink-secret.dat"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Delete("partners/alice/escape")
+
+	if _, err := fs.Fileread(sftp.NewRequest("Get", "/escape")); err == nil {
+		t.Error("Fileread should fail for the symlink to the outside of the home directory")
+	}
+	if _, err := fs.Readlink("/escape"); err == nil {
+		t.Error("Readlink should fail for the symlink to the outside of the home directory")
+	}
+
+	// the target of the new symlink is in the home directory
+	req := sftp.NewRequest("Symlink", "/../symlink-secret.dat")
+	req.Target = "/link"
+	if err := fs.Filecmd(req); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Delete("partners/alice/link")
+
+	info, err := s.Get("partners/alice/link")
+	if err != nil {
+		t.Fatal(err)
+	} else if info.SymlinkTarget != "partners/alice/symlink-secret.dat" {
+		t.Errorf("Wrong symlink target '%s'", info.SymlinkTarget)
+	}
+}
+
+func TestStatusError(t *testing.T) {
+	if testFakeSwift == nil {
+		t.Skip("Faults can be injected only to the fake Swift")
+	}
+	s := storeForTesting()
+	if _, ok := s.(*Swift); !ok {
+		t.Skip("Swift backend is required")
+	}
+	fs := NewSwiftFS(s, defaultConfigForTesting())
+	container := defaultConfigForTesting().Container
+
+	if err := s.Put("fault.txt", bytes.NewReader([]byte("fault"))); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Delete("fault.txt")
+
+	targets := []struct {
+		status int
+		want   error
+	}{
+		{403, sftp.ErrSshFxPermissionDenied},
+		{401, sftp.ErrSshFxPermissionDenied},
+		{404, sftp.ErrSshFxNoSuchFile},
+		{413, errors.New("Quota exceeded or the file is too large")},
+		{503, errors.New("Object storage is unavailable (status=503)")},
+	}
+
+	for _, target := range targets {
+		testFakeSwift.setFault(container, "fault.txt", target.status)
+
+		// the request ID is kept in the error of the store
+		_, err := s.Get("fault.txt")
+		if serr, ok := err.(*StoreError); ok {
+			if serr.StatusCode != target.status || serr.RequestID == "" {
+				t.Errorf("Wrong StoreError (status=%d, request-id=%s)", serr.StatusCode, serr.RequestID)
+			}
+		} else if target.status != 404 {
+			t.Errorf("StoreError should be returned for status %d [%v]", target.status, err)
+		}
+
+		_, err = fs.Fileread(sftp.NewRequest("Get", "/fault.txt"))
+		if err == nil || err.Error() != target.want.Error() {
+			t.Errorf("Wrong status for %d [%v]", target.status, err)
+		}
+	}
+	testFakeSwift.setFault(container, "fault.txt", 0)
+}
+
+// blockingStore blocks List() for the prefix until release is closed.
+type blockingStore struct {
+	ObjectStore
+	prefix  string
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingStore) List(prefix, delimiter string, limit int) ([]ObjectInfo, error) {
+	if prefix == s.prefix {
+		close(s.started)
+		<-s.release
+	}
+	return s.ObjectStore.List(prefix, delimiter, limit)
+}
+
+func TestSlowListDoesNotBlock(t *testing.T) {
+	s := storeForTesting()
+	if err := s.Put("slow/file.txt", bytes.NewReader([]byte("slow"))); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Delete("slow/file.txt")
+
+	bs := &blockingStore{
+		ObjectStore: s,
+		prefix:      "slow/",
+		started:     make(chan struct{}),
+		release:     make(chan struct{}),
+	}
+	fs := NewSwiftFS(bs, defaultConfigForTesting())
+
+	listed := make(chan error)
+	go func() {
+		_, err := fs.Filelist(sftp.NewRequest("List", "/slow"))
+		listed <- err
+	}()
+	<-bs.started
+
+	// the other requests run during the listing
+	if _, err := statForTesting(fs, "/slow/file.txt"); err != nil {
+		t.Errorf("Stat failed during the listing [%s]", err)
+	}
+	if err := fs.Filecmd(sftp.NewRequest("Mkdir", "/slow-other")); err != nil {
+		t.Errorf("Mkdir failed during the listing [%s]", err)
+	}
+	defer s.Delete("slow-other/")
+
+	close(bs.release)
+	if err := <-listed; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConcurrentRequests(t *testing.T) {
+	s := storeForTesting()
+	fs := NewSwiftFS(s, defaultConfigForTesting())
+
+	const n = 16
+	var wg sync.WaitGroup
+	errs := make(chan error, n*4)
+
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			name := fmt.Sprintf("/concurrent/file%02d.txt", i)
+			content := []byte(strings.Repeat(fmt.Sprintf("%02d", i), 100))
+
+			w, err := fs.Filewrite(sftp.NewRequest("Put", name))
+			if err != nil {
+				errs <- err
+				return
+			}
+			w.WriteAt(content, 0)
+			if err = w.(io.Closer).Close(); err != nil {
+				errs <- err
+				return
+			}
+
+			if _, err = fs.Filelist(sftp.NewRequest("List", "/concurrent")); err != nil {
+				errs <- err
+			}
+			if _, err = statForTesting(fs, name); err != nil {
+				errs <- err
+			}
+
+			r, err := fs.Fileread(sftp.NewRequest("Get", name))
+			if err != nil {
+				errs <- err
+				return
+			}
+			buf := make([]byte, len(content))
+			if _, err = r.ReadAt(buf, 0); err != nil && err != io.EOF {
+				errs <- err
+			} else if !bytes.Equal(buf, content) {
+				errs <- fmt.Errorf("Wrong content of '%s'", name)
+			}
+			r.(io.Closer).Close()
+
+			if err = fs.Filecmd(sftp.NewRequest("Remove", name)); err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestConcurrentRename(t *testing.T) {
+	s := storeForTesting()
+	fs := NewSwiftFS(s, defaultConfigForTesting())
+
+	if err := s.Put("rename-race.txt", bytes.NewReader([]byte("race"))); err != nil {
+		t.Fatal(err)
+	}
+
+	// only one of the requests moves the file
+	var wg sync.WaitGroup
+	results := make(chan error, 2)
+	for _, target := range []string{"/rename-race-1.txt", "/rename-race-2.txt"} {
+		wg.Add(1)
+		go func(target string) {
+			defer wg.Done()
+
+			req := sftp.NewRequest("Rename", "/rename-race.txt")
+			req.Target = target
+			results <- fs.Filecmd(req)
+		}(target)
+	}
+	wg.Wait()
+	close(results)
+	defer s.Delete("rename-race-1.txt")
+	defer s.Delete("rename-race-2.txt")
+
+	succeeded := 0
+	for err := range results {
+		if err == nil {
+			succeeded++
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("%d requests renamed the same file", succeeded)
+	}
+}
+
+// Open flags of SFTP
+const (
+	testFlagWrite  = 0x02
+	testFlagAppend = 0x04
+	testFlagCreat  = 0x08
+	testFlagTrunc  = 0x10
+	testFlagExcl   = 0x20
+)
+
+func writeForTesting(fs *SwiftFS, path string, flags uint32, content []byte) error {
+	req := sftp.NewRequest("Put", path)
+	req.Flags = flags
+
+	w, err := fs.Filewrite(req)
+	if err != nil {
+		return err
+	}
+	if _, err = w.WriteAt(content, 0); err != nil {
+		w.(io.Closer).Close()
+		return err
+	}
+	return w.(io.Closer).Close()
+}
+
+func TestFilewriteExclusive(t *testing.T) {
+	s := storeForTesting()
+	fs := NewSwiftFS(s, defaultConfigForTesting())
+	flags := uint32(testFlagWrite | testFlagCreat | testFlagExcl)
+
+	if err := writeForTesting(fs, "/exclusive.txt", flags, []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Delete("exclusive.txt")
+
+	if err := writeForTesting(fs, "/exclusive.txt", flags, []byte("second")); err != errFileAlreadyExists {
+		t.Errorf("Exclusive open should fail for the existing file [%v]", err)
+	}
+
+	// Another client creates the file during the transfer
+	req := sftp.NewRequest("Put", "/exclusive-race.txt")
+	req.Flags = flags
+	w, err := fs.Filewrite(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.WriteAt([]byte("loser"), 0)
+
+	if err = writeForTesting(fs, "/exclusive-race.txt", flags, []byte("winner")); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Delete("exclusive-race.txt")
+
+	if err = w.(io.Closer).Close(); err != errFileAlreadyExists {
+		t.Errorf("Closing the file should fail if the file is created in the meantime [%v]", err)
+	}
+
+	r, _, err := s.Download("exclusive-race.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := ioutil.ReadAll(r)
+	r.Close()
+	if string(content) != "winner" {
+		t.Errorf("The file was overwritten '%s'", content)
+	}
+}
+
+func TestFilewriteAppend(t *testing.T) {
+	s := storeForTesting()
+	c := defaultConfigForTesting()
+	c.SegmentSize = 1
+	fs := NewSwiftFS(s, c)
+
+	// small object is copied
+	if err := s.Put("append.txt", bytes.NewReader([]byte("abc"))); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Delete("append.txt")
+
+	req := sftp.NewRequest("Put", "/append.txt")
+	req.Flags = testFlagWrite | testFlagAppend
+	w, err := fs.Filewrite(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.WriteAt([]byte("def"), 3); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, _, err := s.Download("append.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := ioutil.ReadAll(r)
+	r.Close()
+	if string(content) != "abcdef" {
+		t.Errorf("Wrong content after appending '%s'", content)
+	}
+
+	// The offsets from 0 are written at the end as well.
+	w, err = fs.Filewrite(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, off := range []int64{0, 3} {
+		if _, err = w.WriteAt([]byte("ghi"), off); err != nil {
+			t.Fatalf("Write at offset %d failed [%v]", off, err)
+		}
+	}
+	if err = w.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, _, err = s.Download("append.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ = ioutil.ReadAll(r)
+	r.Close()
+	if string(content) != "abcdefghighi" {
+		t.Errorf("Wrong content after appending from offset 0 '%s'", content)
+	}
+
+	// large object continues with the segments
+	head := bytes.Repeat([]byte("0123456789abcdef"), minSegmentSize/16+1000)
+	if err = s.Put("append-large.dat", bytes.NewReader(head)); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Delete("append-large.dat")
+
+	expected := head
+	for i := 0; i < 2; i++ {
+		tail := []byte(fmt.Sprintf("tail%d", i))
+
+		req = sftp.NewRequest("Put", "/append-large.dat")
+		req.Flags = testFlagWrite | testFlagAppend
+		w, err = fs.Filewrite(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = w.WriteAt(tail, int64(len(expected))); err != nil {
+			t.Fatal(err)
+		}
+		if err = w.(io.Closer).Close(); err != nil {
+			t.Fatal(err)
+		}
+		expected = append(expected, tail...)
+
+		r, _, err = s.Download("append-large.dat")
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ = ioutil.ReadAll(r)
+		r.Close()
+		if !bytes.Equal(content, expected) {
+			t.Errorf("Wrong content after appending %d times (size=%d, expected=%d)", i+1, len(content), len(expected))
+		}
+	}
+
+	segments, err := s.GetSegments("append-large.dat")
+	if err != nil {
+		t.Fatal(err)
+	} else if len(segments) != 2 {
+		t.Errorf("The file should be a large object with 2 segments [%d]", len(segments))
+	}
+}
+
+func TestAccessMode(t *testing.T) {
+	s := storeForTesting()
+	fs := NewSwiftFS(s, defaultConfigForTesting())
+
+	if err := s.Put("access-mode.txt", bytes.NewReader([]byte("content"))); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Delete("access-mode.txt")
+	defer s.Delete("access-mode-dir/")
+	defer s.Delete("access-mode-dir/upload.txt")
+
+	type operation struct {
+		name string
+		do   func() error
+	}
+	operations := []operation{
+		{"Get", func() error {
+			_, err := fs.Fileread(sftp.NewRequest("Get", "/access-mode.txt"))
+			return err
+		}},
+		{"List", func() error {
+			_, err := fs.Filelist(sftp.NewRequest("List", "/"))
+			return err
+		}},
+		{"Stat", func() error {
+			_, err := fs.Filelist(sftp.NewRequest("Stat", "/access-mode.txt"))
+			return err
+		}},
+		{"Lstat", func() error {
+			_, err := fs.Lstat(sftp.NewRequest("Lstat", "/access-mode.txt"))
+			return err
+		}},
+		{"Mkdir", func() error {
+			return fs.Filecmd(sftp.NewRequest("Mkdir", "/access-mode-dir"))
+		}},
+		{"Put", func() error {
+			return writeForTesting(fs, "/access-mode-dir/upload.txt", testFlagWrite|testFlagCreat, []byte("upload"))
+		}},
+		{"Overwrite", func() error {
+			return writeForTesting(fs, "/access-mode.txt", testFlagWrite|testFlagCreat|testFlagTrunc, []byte("overwritten"))
+		}},
+		{"Truncate", func() error {
+			return fs.Filecmd(setstatRequest("/access-mode.txt", 0x01, 0, 0, 0, 0))
+		}},
+		{"Rename", func() error {
+			req := sftp.NewRequest("Rename", "/access-mode.txt")
+			req.Target = "/access-mode-renamed.txt"
+			if err := fs.Filecmd(req); err != nil {
+				return err
+			}
+			return s.Rename("access-mode-renamed.txt", "access-mode.txt")
+		}},
+	}
+
+	tests := []struct {
+		mode    AccessMode
+		allowed []string
+	}{
+		{AccessReadOnly, []string{"Get", "List", "Stat", "Lstat"}},
+		{AccessWriteOnly, []string{"Stat", "Lstat", "Mkdir", "Put"}},
+		{AccessReadWrite, []string{"Get", "List", "Stat", "Lstat", "Mkdir", "Put", "Overwrite", "Truncate", "Rename"}},
+	}
+
+	for _, test := range tests {
+		fs.SetAccessMode(test.mode)
+		s.Delete("access-mode-dir/upload.txt")
+		s.Delete("access-mode-dir/")
+
+		for _, op := range operations {
+			allowed := false
+			for _, name := range test.allowed {
+				allowed = allowed || name == op.name
+			}
+
+			err := op.do()
+			if allowed && err != nil {
+				t.Errorf("%s should be allowed in %s mode [%v]", op.name, test.mode, err)
+			} else if !allowed && err != sftp.ErrSshFxPermissionDenied {
+				t.Errorf("%s should be denied in %s mode [%v]", op.name, test.mode, err)
+			}
+		}
+	}
+}
+
+func TestACLRules(t *testing.T) {
+	s := storeForTesting()
+	fs := NewSwiftFS(s, defaultConfigForTesting())
+
+	acl := NewACL("misc/acl.conf")
+	if err := acl.Load(); err != nil {
+		t.Fatal(err)
+	}
+	fs.SetACL(acl, "alice")
+
+	if err := s.Put("reports/summary.txt", bytes.NewReader([]byte("summary"))); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Delete("reports/summary.txt")
+	if err := s.Put("acl-secret.txt", bytes.NewReader([]byte("secret"))); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Delete("acl-secret.txt")
+	if err := s.PutSymlink("reports/secret-link", "acl-secret.txt"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Delete("reports/secret-link")
+
+	if err := writeForTesting(fs, "/incoming/upload.txt", testFlagWrite|testFlagCreat, []byte("upload")); err != nil {
+		t.Errorf("Upload to /incoming should be allowed [%v]", err)
+	}
+	defer s.Delete("incoming/upload.txt")
+
+	if _, err := fs.Fileread(sftp.NewRequest("Get", "/reports/summary.txt")); err != nil {
+		t.Errorf("Download from /reports should be allowed [%v]", err)
+	}
+	if _, err := fs.Filelist(sftp.NewRequest("Stat", "/incoming")); err != nil {
+		t.Errorf("Stat of the parent directory should be allowed [%v]", err)
+	}
+
+	denied := map[string]func() error{
+		"Get /incoming": func() error {
+			_, err := fs.Fileread(sftp.NewRequest("Get", "/incoming/upload.txt"))
+			return err
+		},
+		"Get symlink": func() error {
+			_, err := fs.Fileread(sftp.NewRequest("Get", "/reports/secret-link"))
+			return err
+		},
+		"List /": func() error {
+			_, err := fs.Filelist(sftp.NewRequest("List", "/"))
+			return err
+		},
+		"Put /reports": func() error {
+			return writeForTesting(fs, "/reports/upload.txt", testFlagWrite|testFlagCreat, []byte("upload"))
+		},
+		"Remove": func() error {
+			return fs.Filecmd(sftp.NewRequest("Remove", "/incoming/upload.txt"))
+		},
+		"Rename": func() error {
+			req := sftp.NewRequest("Rename", "/incoming/upload.txt")
+			req.Target = "/incoming/renamed.txt"
+			return fs.Filecmd(req)
+		},
+	}
+	for name, do := range denied {
+		if err := do(); err != sftp.ErrSshFxPermissionDenied {
+			t.Errorf("%s should be denied [%v]", name, err)
+		}
+	}
+}
+
+func TestACLSymlinks(t *testing.T) {
+	s := storeForTesting()
+	fs := NewSwiftFS(s, defaultConfigForTesting())
+
+	f, err := ioutil.TempFile("", "swift-sftp-acl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`
+[[rules]]
+path  = "/incoming/**"
+users = ["alice"]
+allow = ["list", "read", "write", "rename", "delete", "mkdir"]
+
+[[rules]]
+path  = "/reports/**"
+users = ["alice"]
+allow = ["list", "read"]
+`)
+	f.Close()
+
+	acl := NewACL(f.Name())
+	if err := acl.Load(); err != nil {
+		t.Fatal(err)
+	}
+	fs.SetACL(acl, "alice")
+
+	if err := s.Put("reports/2018/01/summary.pdf", bytes.NewReader([]byte("summary"))); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Delete("reports/2018/01/summary.pdf")
+	if err := s.PutSymlink("incoming/r", "reports/2018/01/summary.pdf"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Delete("incoming/r")
+	if err := s.Put("acl-secret/plan.txt", bytes.NewReader([]byte("plan"))); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Delete("acl-secret/plan.txt")
+	if err := s.PutSymlink("incoming/d", "acl-secret"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Delete("incoming/d")
+
+	// The rules for /incoming don't cover the files that the symlinks point to.
+	denied := map[string]func() error{
+		"Setstat": func() error {
+			return fs.Filecmd(setstatRequest("/incoming/r", 0x01, 0, 0, 0, 0))
+		},
+		"List": func() error {
+			_, err := fs.Filelist(sftp.NewRequest("List", "/incoming/d"))
+			return err
+		},
+		"Get": func() error {
+			_, err := fs.Fileread(sftp.NewRequest("Get", "/incoming/d/plan.txt"))
+			return err
+		},
+		"Remove": func() error {
+			return fs.Filecmd(sftp.NewRequest("Remove", "/incoming/d/plan.txt"))
+		},
+		"Rename": func() error {
+			req := sftp.NewRequest("Rename", "/incoming/d/plan.txt")
+			req.Target = "/incoming/plan.txt"
+			return fs.Filecmd(req)
+		},
+	}
+	for name, do := range denied {
+		if err := do(); err != sftp.ErrSshFxPermissionDenied {
+			t.Errorf("%s through the symlink should be denied [%v]", name, err)
+		}
+	}
+
+	for name, expected := range map[string]string{"reports/2018/01/summary.pdf": "summary", "acl-secret/plan.txt": "plan"} {
+		r, _, err := s.Download(name)
+		if err != nil {
+			t.Errorf("%s should be left [%v]", name, err)
+			continue
+		}
+		content, _ := ioutil.ReadAll(r)
+		r.Close()
+		if string(content) != expected {
+			t.Errorf("%s should be unchanged [%s]", name, content)
+		}
+	}
+
+	// The symlink itself is in /incoming
+	if err := fs.Filecmd(sftp.NewRequest("Remove", "/incoming/r")); err != nil {
+		t.Errorf("Remove of the symlink should be allowed [%v]", err)
+	}
+}
+
+func TestStatVFS(t *testing.T) {
+	s := storeForTesting()
+	c := defaultConfigForTesting()
+	fs := NewSwiftFS(s, c)
+
+	if err := s.Put("statvfs.dat", bytes.NewReader(make([]byte, 8192))); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Delete("statvfs.dat")
+
+	u, err := s.Usage()
+	if err != nil {
+		t.Fatal(err)
+	} else if u.Bytes < 8192 || u.Count < 1 || u.AccountBytes < u.Bytes {
+		t.Fatalf("Wrong usage %+v", u)
+	}
+
+	// No quota and no capacity
+	if _, err = fs.StatVFS(sftp.NewRequest("StatVFS", "/")); err != sftp.ErrSshFxOpUnsupported {
+		t.Errorf("StatVFS should be unsupported without quota and capacity [%v]", err)
+	}
+
+	// Configured capacity with the account usage
+	c.StorageCapacity = 1
+	fs = NewSwiftFS(s, c)
+	stat, err := fs.StatVFS(sftp.NewRequest("StatVFS", "/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.TotalSpace() != 1024*1024*1024 {
+		t.Errorf("Wrong total space %d", stat.TotalSpace())
+	}
+	if used := stat.TotalSpace() - stat.FreeSpace(); used < uint64(u.AccountBytes) || used > uint64(u.AccountBytes)+statvfsBlockSize {
+		t.Errorf("Wrong used space %d (account=%d)", used, u.AccountBytes)
+	}
+
+	// The read-only users see the read-only file system
+	fs.SetAccessMode(AccessReadOnly)
+	if stat, err = fs.StatVFS(sftp.NewRequest("StatVFS", "/")); err != nil || stat.Flag&statvfsReadOnly == 0 {
+		t.Errorf("File system should be read-only (flag=%x) [%v]", stat.Flag, err)
+	}
+
+	if testFakeSwift == nil || c.Backend == BackendMemory {
+		return
+	}
+
+	// Quotas of the container
+	quota := u.Bytes + 1024*1024
+	testFakeSwift.setMetadata(c.Container, map[string]string{"Quota-Bytes": strconv.FormatInt(quota, 10), "Quota-Count": strconv.FormatInt(u.Count+10, 10)})
+	defer testFakeSwift.setMetadata(c.Container, map[string]string{"Quota-Bytes": "", "Quota-Count": ""})
+
+	if stat, err = fs.StatVFS(sftp.NewRequest("StatVFS", "/")); err != nil {
+		t.Fatal(err)
+	}
+	if stat.TotalSpace() != uint64(quota) {
+		t.Errorf("Total space should be the quota of the container %d", stat.TotalSpace())
+	}
+	if free := stat.FreeSpace(); free != 1024*1024 {
+		t.Errorf("Wrong free space %d (used=%d)", free, u.Bytes)
+	}
+	if stat.Files != uint64(u.Count+10) || stat.Ffree != 10 {
+		t.Errorf("Wrong number of files %d/%d (count=%d)", stat.Ffree, stat.Files, u.Count)
+	}
+}
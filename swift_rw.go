@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
@@ -8,26 +10,39 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"regexp"
 	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	readAheadSize  = 1024 * 1024       // Size of the data that swiftReader reads from Object Storage at once
+	readBufferSize = readAheadSize * 4 // Size of the sliding buffer of swiftReader
+)
+
 // swiftReader implements io.ReadAt interface
+//
+// ReadAt is served with the range requests to Object Storage. swiftReader reads ahead
+// the data into the sliding buffer, so that the sequential reads are done in single request
+// and the partial reads don't download the whole object.
 type swiftReader struct {
 	// Required to set in initialized
 	log     *logrus.Entry
-	swift   *Swift
+	store   ObjectStore
 	sf      *SwiftFile
 	timeout time.Duration
 
 	// Not required
 	m            sync.Mutex
-	tmpfile      *os.File
+	body         io.ReadCloser // response body of the range request
+	buf          []byte
+	bufOffset    int64 // offset of buf[0] in the object
 	downloadErr  error
 	downloadSize int64
 	readSize     int64
+	etag         string
 
 	afterClosed func(r *swiftReader)
 }
@@ -36,121 +51,293 @@ func (r *swiftReader) Begin() (err error) {
 	r.log.Debugf("Send '%s' (size=%d) to client", r.sf.Name(), r.sf.Size())
 
 	// Download size
-	headers, err := r.swift.Get(r.sf.Name())
+	info, err := r.store.Get(r.sf.objectname)
 	if err != nil {
 		return err
 	}
-	r.downloadSize = headers.ContentLength
-	if r.downloadSize == 0 {
-		return fmt.Errorf("Couldn't detect download size (Missing Content-length header).")
-	}
+	r.downloadSize = info.Bytes
+	r.etag = info.Hash
 
-	// Create tmpfile
-	fname, err := createTmpFile()
-	if err != nil {
-		return err
-	}
+	return nil
+}
 
-	// Open tmpfile
-	r.tmpfile, err = os.OpenFile(fname, os.O_RDONLY, 0000)
-	if err != nil {
-		r.log.Warnf("Couldn't open tmpfile. [%v]", err.Error())
-		return err
+var md5Pattern = regexp.MustCompile("^[0-9a-f]{32}$")
+
+// MD5 returns the MD5 of the file from the ETag. It's empty for the large objects,
+// because their ETags are quoted and calculated from the segments.
+func (r *swiftReader) MD5() string {
+	if !md5Pattern.MatchString(r.etag) {
+		return ""
 	}
+	return r.etag
+}
 
-	// start download
-	go func() {
-		if err := r.download(fname); err != nil {
-			r.downloadErr = err
+// fill reads the chunk that contains pos into the buffer.
+// It continues the current range request if pos is just ahead of the buffer.
+func (r *swiftReader) fill(pos int64) (err error) {
+	end := r.bufOffset + int64(len(r.buf))
+	if r.body == nil || pos < r.bufOffset || pos >= end+readAheadSize {
+		if r.body != nil {
+			r.body.Close()
 		}
-	}()
-	return nil
-}
 
-func (r *swiftReader) download(tmpFileName string) (err error) {
-	r.log.Debugf("Create tmpfile. [%s]", tmpFileName)
-	fw, err := os.OpenFile(tmpFileName, os.O_WRONLY|os.O_TRUNC, 0000)
-	if err != nil {
-		r.log.Warnf("%v", err.Error())
-		return err
+		r.log.Debugf("Download '%s' (offset=%d) from Object Storage", r.sf.Name(), pos)
+		r.body, err = r.store.DownloadRange(r.sf.objectname, pos, -1)
+		if err != nil {
+			r.body = nil
+			return err
+		}
+		r.buf = r.buf[:0]
+		r.bufOffset = pos
+		end = pos
 	}
-	defer fw.Close()
 
-	body, size, err := r.swift.Download(r.sf.Name())
-	if err != nil {
-		return err
+	size := int64(readAheadSize)
+	if rest := r.downloadSize - end; rest < size {
+		size = rest
+	}
+
+	if r.buf == nil {
+		r.buf = make([]byte, 0, readBufferSize)
+	}
+
+	// slide the buffer
+	if drop := len(r.buf) + int(size) - readBufferSize; drop > 0 {
+		copy(r.buf, r.buf[drop:])
+		r.buf = r.buf[:len(r.buf)-drop]
+		r.bufOffset += int64(drop)
 	}
-	defer body.Close()
 
-	r.log.Debugf("Download '%s' (size=%d) from Object Storage", r.sf.Name(), size)
-	_, err = io.Copy(fw, body)
+	l := len(r.buf)
+	n, err := io.ReadFull(r.body, r.buf[l:l+int(size)])
+	r.buf = r.buf[:l+n]
 	if err != nil {
-		r.log.Warnf("Error occured during copying [%v]", err.Error())
+		r.log.Warnf("Error occured during downloading [%v]", err.Error())
+		r.body.Close()
+		r.body = nil
 		return err
 	}
-	r.log.Debugf("Download completed")
-
 	return nil
 }
 
 func (r *swiftReader) ReadAt(p []byte, off int64) (n int, err error) {
-	start := time.Now()
-	for {
-		n, err = r.tmpfile.ReadAt(p, off)
-		if n != 0 {
-			r.readSize += int64(n)
-			return n, err
-
-		} else if r.readSize == r.downloadSize {
-			r.log.Debugf("Send EOF to client. [%s]", r.sf.Name())
-			return n, io.EOF
-		}
-
-		time.Sleep(100 * time.Millisecond)
-		r.log.Debugf("Wait for downloading. [%s] ", r.sf.Name())
-
-		if time.Now().Sub(start) > r.timeout {
-			r.log.Warnf("Download timeout. [%s]", r.sf.Name())
-			break
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	for n < len(p) && off+int64(n) < r.downloadSize {
+		pos := off + int64(n)
+		if pos < r.bufOffset || pos >= r.bufOffset+int64(len(r.buf)) {
+			if err = r.fill(pos); err != nil {
+				r.downloadErr = err
+				return n, statusError(err)
+			}
+			continue
 		}
+		n += copy(p[n:], r.buf[pos-r.bufOffset:])
 	}
+	r.readSize += int64(n)
 
-	r.downloadErr = errors.New("Timeout for downloading")
-	return -1, r.downloadErr
+	if n < len(p) {
+		r.log.Debugf("Send EOF to client. [%s]", r.sf.Name())
+		return n, io.EOF
+	}
+	return n, nil
 }
 
 func (r *swiftReader) Close() error {
+	r.m.Lock()
+	defer r.m.Unlock()
+
 	if r.afterClosed != nil {
 		defer r.afterClosed(r)
 	}
 
-	// remove temporary file
-	if r.tmpfile != nil {
-		os.Remove(r.tmpfile.Name())
+	if r.body != nil {
+		r.body.Close()
+		r.body = nil
 	}
 
 	return nil
 }
 
+// Max size of the data that swiftWriter keeps in memory while waiting for the preceding writes.
+// The request server processes the write requests in parallel, so they may arrive out of order
+// even if the client writes the file sequentially.
+const maxPendingWriteSize = 4 * 1024 * 1024
+
 // swiftWriter implements io.WriteAt interface
+//
+// If segmentSize is set, the data is streamed to Object Storage as the segments of
+// Static Large Object while the client is writing it sequentially. swiftWriter falls back
+// to the temporary file when the client writes the file out of order.
 type swiftWriter struct {
 	// Required to set in initialized
 	log     *logrus.Entry
-	swift   *Swift
+	store   ObjectStore
 	sf      *SwiftFile
 	timeout time.Duration
 
+	// Files larger than this size are uploaded as Static Large Object (bytes)
+	// Zero means that the file is always uploaded as single object through the temporary file.
+	segmentSize int64
+
+	// Open flags
+	exclusive bool // fail if the object exists (O_EXCL)
+	appending bool // continue the existing object (O_APPEND)
+
+	// O_APPEND writes go to the end of the existing object. The clients like OpenSSH's
+	// "reput" send the offsets from the end, and the others send them from 0.
+	// The first write tells which one the client does.
+	appendBase    int64 // size of the existing object
+	appendOffset  int64 // added to the offsets of the client
+	appendChecked bool
+
 	// Not required
+	m              sync.Mutex
+	size           int64 // end of the data written by the client
 	tmpfile        *os.File
 	uploadComplete bool
 	uploadErr      error
 
+	// streaming
+	stream        *io.PipeWriter
+	streamDone    chan error
+	written       int64  // size of the data that has been sent to the stream
+	streamStart   int64  // offset where the stream started
+	streamSegs    int    // number of the segments when the stream started
+	segmentHead   []byte // beginning of the segment being streamed while it's smaller than minSegmentSize
+	pending       map[int64][]byte
+	pendingSize   int64
+	segmentPrefix string
+	segments      []Segment
+	keepSegments  int       // number of the leading segments that belong to the existing object
+	staleSegments []Segment // segments of the existing object that are replaced by the copy
+
+	// attributes set by the client before closing
+	metaLock sync.Mutex
+	metadata map[string]string
+
 	afterClosed func(w *swiftWriter)
 }
 
 func (w *swiftWriter) Begin() (err error) {
 	w.log.Debugf("Receive '%s' from client", w.sf.Name())
 
+	w.segmentPrefix = fmt.Sprintf("%s/slo/%d", w.sf.objectname, time.Now().UnixNano())
+
+	// Check it in advance not to upload the file in vain.
+	// The conditional request at last prevents the others from creating it in the meantime.
+	if w.exclusive {
+		if _, err = w.store.Get(w.sf.objectname); err == nil {
+			return ErrObjectExists
+		} else if err != ErrObjectNotFound {
+			return err
+		}
+	}
+
+	var existing *ObjectInfo
+	if w.appending {
+		if existing, err = w.store.Get(w.sf.objectname); err == ErrObjectNotFound {
+			existing = nil
+		} else if err != nil {
+			return err
+		}
+	}
+
+	if w.segmentSize > 0 {
+		if existing != nil {
+			if err = w.reuseSegments(existing); err != nil {
+				return err
+			}
+		}
+		w.beginStream()
+
+	} else if err = w.openTmpFile(); err != nil {
+		return err
+	}
+
+	if existing != nil {
+		w.size = existing.Bytes
+		w.appendBase = existing.Bytes
+	}
+
+	// The existing object couldn't be used as the segments. Copy the content.
+	if existing != nil && existing.Bytes > 0 && w.written == 0 {
+		return w.copyExisting()
+	}
+	return nil
+}
+
+// Swift's minimum size of the segments except the last one
+const minSegmentSize = 1024 * 1024
+
+// reuseSegments puts the existing object at the beginning of the large object for O_APPEND.
+// The segments of the existing large object are reused, and the normal object is copied to a segment.
+// Nothing is done if the object is too small to be a segment.
+func (w *swiftWriter) reuseSegments(existing *ObjectInfo) error {
+	segments, err := w.store.GetSegments(w.sf.objectname)
+	if err != nil {
+		return err
+	}
+
+	if segments != nil {
+		for _, seg := range segments {
+			if seg.Size < minSegmentSize {
+				w.staleSegments = segments
+				return nil
+			}
+		}
+		w.keepSegments = len(segments)
+
+	} else if existing.Bytes >= minSegmentSize {
+		seg, err := w.store.CopyToSegment(w.sf.objectname, fmt.Sprintf("%s/%08d", w.segmentPrefix, 0))
+		if err != nil {
+			return err
+		}
+		segments = []Segment{seg}
+
+	} else {
+		return nil
+	}
+
+	w.log.Debugf("Continue '%s' with %d segments (size=%d)", w.sf.Name(), len(segments), existing.Bytes)
+	w.segments = segments
+	w.written = existing.Bytes
+	return nil
+}
+
+// copyExisting writes the content of the existing object at the beginning of the file for O_APPEND.
+func (w *swiftWriter) copyExisting() error {
+	w.log.Debugf("Copy the content of '%s' to continue it", w.sf.Name())
+
+	body, _, err := w.store.Download(w.sf.objectname)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	if w.stream == nil {
+		_, err = io.Copy(w.tmpfile, body)
+		return err
+	}
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if werr := w.writeStream(buf[:n]); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+func (w *swiftWriter) openTmpFile() (err error) {
 	// Create tmpfile
 	fname, err := createTmpFile()
 	if err != nil {
@@ -166,6 +353,160 @@ func (w *swiftWriter) Begin() (err error) {
 	return nil
 }
 
+func (w *swiftWriter) beginStream() {
+	pr, pw := io.Pipe()
+
+	w.stream = pw
+	w.streamDone = make(chan error, 1)
+	w.pending = map[int64][]byte{}
+	w.streamStart = w.written
+	w.streamSegs = len(w.segments)
+
+	go func() {
+		err := w.uploadStream(pr)
+		if err != nil {
+			// WriteAt() returns the error to the client
+			pr.CloseWithError(err)
+		}
+		w.streamDone <- err
+	}()
+}
+
+// uploadStream reads the stream and uploads it as the segments until EOF
+func (w *swiftWriter) uploadStream(pr io.Reader) error {
+	br := bufio.NewReader(pr)
+	for {
+		if _, err := br.Peek(1); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		name := fmt.Sprintf("%s/%08d", w.segmentPrefix, len(w.segments))
+		w.log.Debugf("Upload: segment '%s' (streaming)", name)
+
+		seg, err := w.store.PutSegment(name, io.LimitReader(br, w.segmentSize))
+		if err != nil {
+			return err
+		}
+		w.segments = append(w.segments, seg)
+	}
+}
+
+// closeStream sends EOF to the stream and waits for uploading the last segment
+func (w *swiftWriter) closeStream() error {
+	w.stream.Close()
+	err := <-w.streamDone
+	w.stream = nil
+	return err
+}
+
+// fallback stops streaming and writes the rest of the file to the temporary file.
+// The segments that have already been uploaded are kept as the beginning of the file.
+// The segment being streamed is discarded if it's smaller than minSegmentSize, and its data
+// is written to the temporary file, because only the last segment can be smaller than that.
+func (w *swiftWriter) fallback() error {
+	w.log.Debugf("Write out of order. Use tmpfile for the rest of '%s' (offset=%d)", w.sf.Name(), w.written)
+
+	head := w.segmentPos()
+	if head >= minSegmentSize {
+		head = 0
+	}
+
+	if head == 0 {
+		if err := w.closeStream(); err != nil {
+			return err
+		}
+
+	} else {
+		complete := w.streamSegs + int((w.written-head-w.streamStart)/w.segmentSize)
+
+		w.stream.CloseWithError(errors.New("Segment discarded"))
+		err := <-w.streamDone
+		w.stream = nil
+
+		if len(w.segments) < complete {
+			// The stream had failed before
+			return err
+		} else if len(w.segments) > complete {
+			w.store.DeleteSegments(w.segments[complete:])
+			w.segments = w.segments[:complete]
+		}
+		w.written -= head
+	}
+
+	if err := w.openTmpFile(); err != nil {
+		return err
+	}
+	if head > 0 {
+		if _, err := w.tmpfile.WriteAt(w.segmentHead[:head], w.written); err != nil {
+			return err
+		}
+	}
+	w.segmentHead = nil
+
+	for off, data := range w.pending {
+		if _, err := w.tmpfile.WriteAt(data, off); err != nil {
+			return err
+		}
+	}
+	w.pending = nil
+	w.pendingSize = 0
+	return nil
+}
+
+// segmentPos returns the offset of the stream in the segment being uploaded.
+func (w *swiftWriter) segmentPos() int64 {
+	return (w.written - w.streamStart) % w.segmentSize
+}
+
+// send writes the data to the stream, and keeps the beginning of the segment for fallback().
+func (w *swiftWriter) send(p []byte) error {
+	n, err := w.stream.Write(p)
+	for b := p[:n]; len(b) > 0; {
+		pos := w.segmentPos()
+		if pos == 0 {
+			w.segmentHead = w.segmentHead[:0]
+		}
+
+		l := w.segmentSize - pos
+		if l > int64(len(b)) {
+			l = int64(len(b))
+		}
+		if pos < minSegmentSize {
+			k := minSegmentSize - pos
+			if k > l {
+				k = l
+			}
+			w.segmentHead = append(w.segmentHead, b[:k]...)
+		}
+
+		w.written += l
+		b = b[l:]
+	}
+	return err
+}
+
+func (w *swiftWriter) writeStream(p []byte) error {
+	if err := w.send(p); err != nil {
+		return err
+	}
+
+	// send the pending data that follows
+	for {
+		data, ok := w.pending[w.written]
+		if !ok {
+			return nil
+		}
+		delete(w.pending, w.written)
+		w.pendingSize -= int64(len(data))
+
+		if err := w.send(data); err != nil {
+			return err
+		}
+	}
+}
+
 func (w *swiftWriter) upload() (err error) {
 	fname := w.tmpfile.Name()
 	w.log.Debugf("Upload: create tmpfile. [%s]", fname)
@@ -176,10 +517,107 @@ func (w *swiftWriter) upload() (err error) {
 	}
 	defer fr.Close()
 
-	return w.swift.Put(w.sf.Name(), fr)
+	s, err := fr.Stat()
+	if err != nil {
+		return err
+	}
+
+	if len(w.segments) > 0 || (w.segmentSize > 0 && s.Size() > w.segmentSize) {
+		return w.uploadSegments(fr, s.Size())
+	}
+	return w.put(fr)
+}
+
+func (w *swiftWriter) put(content io.Reader) error {
+	if w.exclusive {
+		return w.store.PutExclusive(w.sf.objectname, content)
+	}
+	return w.store.Put(w.sf.objectname, content)
+}
+
+// uploadSegments uploads the rest of the file that hasn't been streamed, and then
+// creates Static Large Object. Swift doesn't accept the object larger than 5 GiB in single request.
+func (w *swiftWriter) uploadSegments(fr *os.File, size int64) (err error) {
+	for offset := w.written; offset < size; offset += w.segmentSize {
+		name := fmt.Sprintf("%s/%08d", w.segmentPrefix, len(w.segments))
+		w.log.Debugf("Upload: segment '%s' (offset=%d)", name, offset)
+
+		seg, err := w.store.PutSegment(name, io.NewSectionReader(fr, offset, w.segmentSize))
+		if err != nil {
+			return err
+		}
+		w.segments = append(w.segments, seg)
+	}
+
+	return w.putManifest()
+}
+
+func (w *swiftWriter) putManifest() error {
+	if len(w.segments) == 0 {
+		// empty file
+		return w.put(bytes.NewReader([]byte{}))
+	} else if w.exclusive {
+		return w.store.PutManifestExclusive(w.sf.objectname, w.segments)
+	}
+	return w.store.PutManifest(w.sf.objectname, w.segments)
 }
 
 func (w *swiftWriter) WriteAt(p []byte, off int64) (n int, err error) {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	if w.appending && !w.appendChecked {
+		w.appendChecked = true
+		if off < w.appendBase {
+			w.appendOffset = w.appendBase
+		}
+	}
+	off += w.appendOffset
+
+	defer func() {
+		if end := off + int64(n); end > w.size {
+			w.size = end
+		}
+	}()
+
+	if w.stream != nil {
+		switch {
+		case off == w.written:
+			if err = w.writeStream(p); err != nil {
+				w.log.Debugf("%v", err)
+				return 0, statusError(err)
+			}
+			return len(p), nil
+
+		case off > w.written && w.pendingSize+int64(len(p)) <= maxPendingWriteSize:
+			// p is reused by the caller
+			data := make([]byte, len(p))
+			copy(data, p)
+			w.pending[off] = data
+			w.pendingSize += int64(len(data))
+			return len(p), nil
+
+		case off > w.written:
+			if err = w.fallback(); err != nil {
+				w.log.Debugf("%v", err)
+				return 0, statusError(err)
+			}
+
+		default:
+			err = fmt.Errorf("Couldn't rewrite the data that has already been uploaded (offset=%d)", off)
+			w.log.Debugf("%v", err)
+			return 0, err
+		}
+
+	} else if w.tmpfile == nil {
+		return 0, errors.New("Writer has already been closed")
+
+	} else if off < w.written {
+		err = fmt.Errorf("Couldn't rewrite the data that has already been uploaded (offset=%d)", off)
+		w.log.Debugf("%v", err)
+		return 0, err
+	}
+
 	n, err = w.tmpfile.WriteAt(p, off)
 	if err != nil {
 		w.log.Debugf("%v", err)
@@ -187,13 +625,53 @@ func (w *swiftWriter) WriteAt(p []byte, off int64) (n int, err error) {
 	return n, err
 }
 
+// Close uploads the file and returns the status for the SFTP client.
+// The error itself is in w.uploadErr.
 func (w *swiftWriter) Close() error {
+	return statusError(w.close())
+}
+
+func (w *swiftWriter) close() error {
+	w.m.Lock()
+	defer w.m.Unlock()
+
 	if w.afterClosed != nil {
 		defer w.afterClosed(w)
 	}
 
-	// start uploading
-	if w.tmpfile != nil {
+	defer func() {
+		w.uploadComplete = true
+
+		// cleanup the segments that have been uploaded
+		if w.uploadErr != nil && len(w.segments) > w.keepSegments {
+			w.store.DeleteSegments(w.segments[w.keepSegments:])
+		}
+	}()
+
+	// The file has a hole. Write it to the tmpfile.
+	if w.stream != nil && len(w.pending) > 0 {
+		if err := w.fallback(); err != nil {
+			w.uploadErr = err
+			return err
+		}
+	}
+
+	if w.stream != nil {
+		// finish streaming
+		if err := w.closeStream(); err != nil {
+			w.uploadErr = err
+		} else if err = w.putManifest(); err != nil {
+			w.uploadErr = err
+		}
+
+		if w.uploadErr != nil {
+			w.log.Debugf("Upload: complete with error. [%v]", w.uploadErr)
+			return w.uploadErr
+		}
+		w.log.Debugf("'%s' (size=%d) was uploaded successfully", w.sf.Name(), w.written)
+
+	} else if w.tmpfile != nil {
+		// start uploading
 		s, err := w.tmpfile.Stat()
 		if err != nil {
 			return err
@@ -201,11 +679,6 @@ func (w *swiftWriter) Close() error {
 
 		w.log.Debugf("Upload '%s' (size=%d) to Object Storage", w.sf.Name(), s.Size())
 
-		//go func() {
-		defer func() {
-			w.uploadComplete = true
-		}()
-
 		if err := w.upload(); err != nil {
 			w.uploadErr = err
 			w.log.Debugf("Upload: complete with error. [%v]", err)
@@ -218,13 +691,98 @@ func (w *swiftWriter) Close() error {
 			return w.uploadErr
 		}
 		w.log.Debugf("'%s' was uploaded successfully", w.sf.Name())
+	}
+
+	// The content of the existing large object was copied to the new one
+	if len(w.staleSegments) > 0 {
+		if err := w.store.DeleteSegments(w.staleSegments); err != nil {
+			w.log.Warnf("Couldn't delete the segments of the previous '%s' [%v]", w.sf.Name(), err)
+		}
+	}
 
-		//}()
+	// The attributes that were set by the client during the transfer
+	w.metaLock.Lock()
+	defer w.metaLock.Unlock()
+	if len(w.metadata) > 0 {
+		if err := w.store.SetMetadata(w.sf.objectname, w.metadata); err != nil {
+			w.log.Warnf("Couldn't set the attributes to '%s' [%v]", w.sf.Name(), err)
+			return err
+		}
 	}
 
 	return nil
 }
 
+// Abort discards the data without uploading it.
+func (w *swiftWriter) Abort() {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	if w.stream != nil {
+		w.stream.CloseWithError(errors.New("Transfer aborted"))
+		<-w.streamDone
+		w.stream = nil
+	}
+	if w.tmpfile != nil {
+		os.Remove(w.tmpfile.Name())
+		w.tmpfile = nil
+	}
+	if len(w.segments) > w.keepSegments {
+		w.store.DeleteSegments(w.segments[w.keepSegments:])
+	}
+	w.segments = nil
+}
+
+// Size returns the size of the file that has been written so far.
+func (w *swiftWriter) Size() int64 {
+	w.m.Lock()
+	defer w.m.Unlock()
+	return w.size
+}
+
+// replace discards the file and creates the object with put instead, e.g. with the server-side copy.
+// The attributes set by the client are still saved on closing. It fails if the data has been written.
+func (w *swiftWriter) replace(put func() error) error {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	if w.size > 0 {
+		return fmt.Errorf("Couldn't replace the data that has been written to '%s'", w.sf.Name())
+	} else if w.uploadComplete {
+		return errors.New("Writer has already been closed")
+	}
+
+	if w.stream != nil {
+		w.stream.CloseWithError(errors.New("Replaced with the other object"))
+		<-w.streamDone
+		w.stream = nil
+	}
+	if w.tmpfile != nil {
+		w.tmpfile.Close()
+		os.Remove(w.tmpfile.Name())
+		w.tmpfile = nil
+	}
+
+	if err := put(); err != nil {
+		w.uploadErr = err
+		return err
+	}
+	return nil
+}
+
+// setMetadata keeps the attributes until the file is uploaded.
+func (w *swiftWriter) setMetadata(metadata map[string]string) {
+	w.metaLock.Lock()
+	defer w.metaLock.Unlock()
+
+	if w.metadata == nil {
+		w.metadata = map[string]string{}
+	}
+	for k, v := range metadata {
+		w.metadata[k] = v
+	}
+}
+
 func createTmpFile() (string, error) {
 	t := time.Now().Format(time.RFC3339Nano)
 	h := sha256.Sum256([]byte(t))
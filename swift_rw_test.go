@@ -27,7 +27,7 @@ func generateTestFile(filename string, size int64) (data []byte, err error) {
 }
 
 func generateTestObject(filename string, size int64) (data []byte, err error) {
-	s := swiftForTesting()
+	s := storeForTesting()
 
 	data, err = generateTestFile(filename, size)
 	if err != nil {
@@ -42,7 +42,7 @@ func generateTestObject(filename string, size int64) (data []byte, err error) {
 }
 
 func TestReaderDownload(t *testing.T) {
-	s := swiftForTesting()
+	s := storeForTesting()
 
 	filename := "reader-test.dat"
 	data, err := generateTestObject(filename, 1024*1024)
@@ -63,9 +63,9 @@ func TestReaderDownload(t *testing.T) {
 
 	r := swiftReader{
 		log:     log,
-		swift:   s,
+		store:   s,
 		sf:      f,
-		timeout: time.Duration(s.config.SwiftTimeout) * time.Second,
+		timeout: time.Duration(defaultConfigForTesting().SwiftTimeout) * time.Second,
 	}
 
 	if err = r.Begin(); err != nil {
@@ -89,13 +89,77 @@ func TestReaderDownload(t *testing.T) {
 		t.Errorf("Both contents does't matche")
 	}
 
-	if _, err := os.Stat(r.tmpfile.Name()); err == nil {
-		t.Errorf("Temporary file is sill exist")
+	if r.body != nil {
+		t.Errorf("Response body is still open")
+	}
+}
+
+func TestReaderRange(t *testing.T) {
+	s := storeForTesting()
+
+	filename := "reader-range-test.dat"
+	size := int64(readBufferSize + readAheadSize/2)
+	data, err := generateTestObject(filename, size)
+	os.Remove(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Delete(filename)
+
+	r := swiftReader{
+		log:     log,
+		store:   s,
+		sf:      &SwiftFile{objectname: filename, modtime: time.Now()},
+		timeout: time.Duration(defaultConfigForTesting().SwiftTimeout) * time.Second,
+	}
+	if err = r.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	tests := []struct {
+		off  int64
+		size int
+	}{
+		{size - 1024, 1024},                      // the tail of the object
+		{0, 1024},                                // seek backward
+		{1024, 64 * 1024},                        // sequential read
+		{readAheadSize - 10, 20},                 // across the chunks
+		{readAheadSize * 2, 32 * 1024},           // read ahead
+		{readAheadSize / 2, 32 * 1024},           // still in the sliding buffer
+		{size - 100, 1024},                       // EOF
+		{size, 1024},                             // out of range
+		{readBufferSize - 1, readAheadSize + 10}, // larger than the chunk
+	}
+
+	for _, tt := range tests {
+		buf := make([]byte, tt.size)
+		n, err := r.ReadAt(buf, tt.off)
+
+		expected := int64(tt.size)
+		if tt.off+expected > size {
+			expected = size - tt.off
+			if err != io.EOF {
+				t.Errorf("ReadAt should return EOF (off=%d, err=%v)", tt.off, err)
+			}
+		} else if err != nil {
+			t.Errorf("ReadAt returned error (off=%d, err=%v)", tt.off, err)
+		}
+
+		if int64(n) != expected {
+			t.Errorf("Size of the data is wrong (off=%d, n=%d)", tt.off, n)
+		} else if bytes.Compare(buf[:n], data[tt.off:tt.off+int64(n)]) != 0 {
+			t.Errorf("Both contents does't matche (off=%d)", tt.off)
+		}
+
+		if len(r.buf) > readBufferSize {
+			t.Errorf("Buffer is too large (%d)", len(r.buf))
+		}
 	}
 }
 
 func TestWriterUpload(t *testing.T) {
-	s := swiftForTesting()
+	s := storeForTesting()
 
 	filename := "writer-test.dat"
 	data, err := generateTestFile(filename, 1024*1024)
@@ -116,9 +180,9 @@ func TestWriterUpload(t *testing.T) {
 
 	w := swiftWriter{
 		log:     log,
-		swift:   s,
+		store:   s,
 		sf:      f,
-		timeout: time.Duration(s.config.SwiftTimeout) * time.Second,
+		timeout: time.Duration(defaultConfigForTesting().SwiftTimeout) * time.Second,
 	}
 
 	if err = w.Begin(); err != nil {
@@ -155,3 +219,288 @@ func TestWriterUpload(t *testing.T) {
 		t.Errorf("Temporary file is sill exist")
 	}
 }
+
+func TestWriterUploadSegments(t *testing.T) {
+	s := storeForTesting()
+	c := defaultConfigForTesting()
+
+	filename := "writer-segments-test.dat"
+	data, err := generateTestFile(filename, 1024*1024)
+	defer func() {
+		os.Remove(filename)
+	}()
+
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	f := &SwiftFile{
+		objectname: filename,
+		size:       0,
+		modtime:    time.Now(),
+	}
+
+	w := swiftWriter{
+		log:     log,
+		store:   s,
+		sf:      f,
+		timeout: time.Duration(c.SwiftTimeout) * time.Second,
+
+		// the file is split into 4 segments
+		segmentSize: 300 * 1024,
+	}
+
+	if err = w.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	w.WriteAt(data, 0)
+	w.Close()
+
+	if w.uploadErr != nil {
+		t.Fatal(w.uploadErr)
+	}
+
+	u, size, err := s.Download(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploaded, _ := ioutil.ReadAll(u)
+	u.Close()
+
+	if size != int64(len(data)) {
+		t.Errorf("Size of the object is wrong (%d)", size)
+	}
+	if bytes.Compare(uploaded, data) != 0 {
+		t.Errorf("Both contents does't matche")
+	}
+
+	if testFakeSwift != nil && c.Backend != BackendMemory {
+		if n := testFakeSwift.countObjects(c.SegmentContainerName()); n != 4 {
+			t.Errorf("Number of the segments is wrong (%d)", n)
+		}
+	}
+
+	// the segments are deleted together with the manifest
+	if err = s.Delete(filename); err != nil {
+		t.Fatal(err)
+	}
+	if testFakeSwift != nil && c.Backend != BackendMemory {
+		if n := testFakeSwift.countObjects(c.SegmentContainerName()); n != 0 {
+			t.Errorf("Segments are still exist (%d)", n)
+		}
+	}
+}
+
+func TestWriterStreaming(t *testing.T) {
+	s := storeForTesting()
+	c := defaultConfigForTesting()
+
+	for _, size := range []int64{0, 1000, 1024 * 1024} {
+		filename := "writer-streaming-test.dat"
+		data, err := generateTestFile(filename, size)
+		os.Remove(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := swiftWriter{
+			log:         log,
+			store:       s,
+			sf:          &SwiftFile{objectname: filename, modtime: time.Now()},
+			timeout:     time.Duration(c.SwiftTimeout) * time.Second,
+			segmentSize: 300 * 1024,
+		}
+		if err = w.Begin(); err != nil {
+			t.Fatal(err)
+		}
+
+		// The request server may process the write requests in parallel.
+		// Swap some of them to emulate it.
+		chunk := int64(32 * 1024)
+		for offset := int64(0); offset < size; offset += chunk * 2 {
+			for _, off := range []int64{offset + chunk, offset} {
+				if off >= size {
+					continue
+				}
+				end := off + chunk
+				if end > size {
+					end = size
+				}
+				if _, err = w.WriteAt(data[off:end], off); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+
+		if err = w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if w.tmpfile != nil {
+			t.Errorf("Temporary file should not be used (size=%d)", size)
+		}
+
+		u, _, err := s.Download(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		uploaded, _ := ioutil.ReadAll(u)
+		u.Close()
+
+		if bytes.Compare(uploaded, data) != 0 {
+			t.Errorf("Both contents does't matche (size=%d)", size)
+		}
+
+		if err = s.Delete(filename); err != nil {
+			t.Fatal(err)
+		}
+		if testFakeSwift != nil && c.Backend != BackendMemory {
+			if n := testFakeSwift.countObjects(c.SegmentContainerName()); n != 0 {
+				t.Errorf("Segments are still exist (size=%d, segments=%d)", size, n)
+			}
+		}
+	}
+}
+
+func TestWriterOutOfOrder(t *testing.T) {
+	s := storeForTesting()
+	c := defaultConfigForTesting()
+
+	filename := "writer-outoforder-test.dat"
+	size := int64(maxPendingWriteSize + 1024*1024)
+	data, err := generateTestFile(filename, size)
+	os.Remove(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := swiftWriter{
+		log:         log,
+		store:       s,
+		sf:          &SwiftFile{objectname: filename, modtime: time.Now()},
+		timeout:     time.Duration(c.SwiftTimeout) * time.Second,
+		segmentSize: 1024 * 1024,
+	}
+	if err = w.Begin(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first chunk is streamed, and the others are written in reverse order
+	chunk := int64(64 * 1024)
+	offsets := []int64{0}
+	for off := size - chunk; off > 0; off -= chunk {
+		offsets = append(offsets, off)
+	}
+	for i, off := range offsets {
+		if _, err = w.WriteAt(data[off:off+chunk], off); err != nil {
+			t.Fatal(err)
+		}
+
+		// rewriting the streamed data is not allowed
+		if i == 0 {
+			if _, err = w.WriteAt(data[0:chunk], 0); err == nil {
+				t.Errorf("Rewriting the streamed data should be failed")
+			}
+		}
+	}
+
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if w.tmpfile == nil {
+		t.Fatalf("Temporary file should be used")
+	} else if _, err := os.Stat(w.tmpfile.Name()); err == nil {
+		t.Errorf("Temporary file is sill exist")
+	}
+
+	u, _, err := s.Download(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploaded, _ := ioutil.ReadAll(u)
+	u.Close()
+
+	if bytes.Compare(uploaded, data) != 0 {
+		t.Errorf("Both contents does't matche")
+	}
+	checkSegmentSizeForTesting(t, s, filename)
+	s.Delete(filename)
+}
+
+// checkSegmentSizeForTesting checks that the segments except the last one are not smaller than minSegmentSize.
+func checkSegmentSizeForTesting(t *testing.T, s ObjectStore, name string) {
+	segments, err := s.GetSegments(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, seg := range segments {
+		if i < len(segments)-1 && seg.Size < minSegmentSize {
+			t.Errorf("Segment %d of '%s' is too small (size=%d)", i, name, seg.Size)
+		}
+	}
+}
+
+func TestWriterFallbackSegments(t *testing.T) {
+	s := storeForTesting()
+	c := defaultConfigForTesting()
+
+	filename := "writer-fallback-test.dat"
+	size := int64(maxPendingWriteSize + 3*1024*1024)
+	data, err := generateTestFile(filename, size)
+	os.Remove(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The fallback happens in the second segment (streamed=1.5MiB), or just after it (streamed=2MiB).
+	for _, streamed := range []int64{1536 * 1024, 2048 * 1024} {
+		w := swiftWriter{
+			log:         log,
+			store:       s,
+			sf:          &SwiftFile{objectname: filename, modtime: time.Now()},
+			timeout:     time.Duration(c.SwiftTimeout) * time.Second,
+			segmentSize: 1024 * 1024,
+		}
+		if err = w.Begin(); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = w.WriteAt(data[:streamed], 0); err != nil {
+			t.Fatal(err)
+		}
+
+		// The rest is written in reverse order, which exceeds maxPendingWriteSize
+		chunk := int64(64 * 1024)
+		for off := size - chunk; off >= streamed; off -= chunk {
+			if _, err = w.WriteAt(data[off:off+chunk], off); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err = w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if w.tmpfile == nil {
+			t.Fatalf("Temporary file should be used")
+		}
+
+		u, _, err := s.Download(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		uploaded, _ := ioutil.ReadAll(u)
+		u.Close()
+		if !bytes.Equal(uploaded, data) {
+			t.Errorf("Both contents does't matche (streamed=%d)", streamed)
+		}
+		checkSegmentSizeForTesting(t, s, filename)
+
+		if err = s.Delete(filename); err != nil {
+			t.Fatal(err)
+		}
+		if testFakeSwift != nil && c.Backend != BackendMemory {
+			if n := testFakeSwift.countObjects(c.SegmentContainerName()); n != 0 {
+				t.Errorf("Segments are still exist (streamed=%d, segments=%d)", streamed, n)
+			}
+		}
+	}
+}
@@ -5,11 +5,12 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
 )
 
 func TestAuthFromEnv(t *testing.T) {
-	s := swiftForTesting()
+	s := storeForTesting()
 	if err := s.Init(); err != nil {
 		fmt.Printf("%v", err)
 		t.Fail()
@@ -17,7 +18,7 @@ func TestAuthFromEnv(t *testing.T) {
 }
 
 func TestPut(t *testing.T) {
-	s := swiftForTesting()
+	s := storeForTesting()
 
 	filename := "testdata.obj"
 
@@ -32,7 +33,7 @@ func TestPut(t *testing.T) {
 		t.Errorf("%v", err)
 	}
 
-	ls, err := s.List()
+	ls, err := s.List("", "", 0)
 	if err != nil {
 		t.Errorf("%v", err)
 	}
@@ -53,7 +54,7 @@ func TestPut(t *testing.T) {
 }
 
 func TestGet(t *testing.T) {
-	s := swiftForTesting()
+	s := storeForTesting()
 
 	filename := "testdata.obj"
 
@@ -68,7 +69,7 @@ func TestGet(t *testing.T) {
 }
 
 func TestDownload(t *testing.T) {
-	s := swiftForTesting()
+	s := storeForTesting()
 
 	filename := "testdata.obj"
 	// remove test file
@@ -92,3 +93,395 @@ func TestDownload(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestListPrefixAndDelimiter(t *testing.T) {
+	s := storeForTesting()
+
+	// make listing pages small to check pagination
+	if testFakeSwift != nil {
+		testFakeSwift.listLimit = 3
+		defer func() {
+			testFakeSwift.listLimit = 10000
+		}()
+	}
+
+	names := []string{
+		"list-test/a.dat",
+		"list-test/b.dat",
+		"list-test/c.dat",
+		"list-test/d.dat",
+		"list-test/sub1/e.dat",
+		"list-test/sub1/f.dat",
+		"list-test/sub2/g.dat",
+	}
+	for _, name := range names {
+		if err := s.Put(name, bytes.NewReader([]byte(name))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func() {
+		for _, name := range names {
+			s.Delete(name)
+		}
+	}()
+
+	// all objects in the prefix
+	ls, err := s.List("list-test/", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(ls) != len(names) {
+		t.Fatalf("Count of list is different from count of test data [%d != %d]", len(ls), len(names))
+	}
+	for i, obj := range ls {
+		if obj.Name != names[i] || obj.Subdir {
+			t.Errorf("Wrong object [i=%d, %s != %s]", i, obj.Name, names[i])
+		}
+	}
+
+	// objects and pseudo-directories just under the prefix
+	expected := []string{
+		"list-test/a.dat",
+		"list-test/b.dat",
+		"list-test/c.dat",
+		"list-test/d.dat",
+		"list-test/sub1/",
+		"list-test/sub2/",
+	}
+	ls, err = s.List("list-test/", Delimiter, 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(ls) != len(expected) {
+		t.Fatalf("Count of list is different from count of expected [%d != %d]", len(ls), len(expected))
+	}
+	for i, obj := range ls {
+		if obj.Name != expected[i] {
+			t.Errorf("Wrong object [i=%d, %s != %s]", i, obj.Name, expected[i])
+		}
+		if obj.Subdir != strings.HasSuffix(expected[i], Delimiter) {
+			t.Errorf("Wrong subdir flag [%s]", obj.Name)
+		}
+	}
+
+	// the first entries with limit
+	for _, limit := range []int{1, 5} {
+		ls, err = s.List("list-test/", Delimiter, limit)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(ls) != limit {
+			t.Errorf("Count of list should be the limit [%d != %d]", len(ls), limit)
+		} else if ls[limit-1].Name != expected[limit-1] {
+			t.Errorf("Wrong object with limit [%s != %s]", ls[limit-1].Name, expected[limit-1])
+		}
+	}
+}
+
+func TestForContainer(t *testing.T) {
+	s := storeForTesting()
+
+	other, err := s.ForContainer("ojs-test-container-other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = other.CreateContainer(); err != nil {
+		t.Fatal(err)
+	}
+	defer other.DeleteContainer()
+
+	filename := "for-container-test.dat"
+	if err = other.Put(filename, bytes.NewReader([]byte("foo"))); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = other.Get(filename); err != nil {
+		t.Errorf("Object not found in the other container [%s]", err)
+	}
+	if _, err = s.Get(filename); err != ErrObjectNotFound {
+		t.Errorf("Object should not be in the original container")
+	}
+
+	// The authenticated client is reused.
+	if testFakeSwift != nil && defaultConfigForTesting().Backend != BackendMemory {
+		tokens := testFakeSwift.issuedTokens()
+		for i := 0; i < 3; i++ {
+			if _, err = s.ForContainer("ojs-test-container-other"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if n := testFakeSwift.issuedTokens() - tokens; n != 0 {
+			t.Errorf("ForContainer() should not authenticate again (tokens=%d)", n)
+		}
+	}
+}
+
+func TestPutSymlink(t *testing.T) {
+	s := storeForTesting()
+
+	if err := s.Put("symlink/target.txt", bytes.NewReader([]byte("target"))); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Delete("symlink/target.txt")
+
+	if err := s.PutSymlink("symlink/link", "symlink/target.txt"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Delete("symlink/link")
+
+	// Get returns the symlink itself
+	info, err := s.Get("symlink/link")
+	if err != nil {
+		t.Fatal(err)
+	} else if info.SymlinkTarget != "symlink/target.txt" {
+		t.Errorf("Wrong symlink target '%s'", info.SymlinkTarget)
+	}
+
+	// Download follows the symlink
+	r, _, err := s.Download("symlink/link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := ioutil.ReadAll(r)
+	r.Close()
+	if string(content) != "target" {
+		t.Errorf("Wrong content through the symlink '%s'", content)
+	}
+
+	// Rename moves the symlink, not the target
+	if err = s.Rename("symlink/link", "symlink/renamed"); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Delete("symlink/renamed")
+
+	info, err = s.Get("symlink/renamed")
+	if err != nil {
+		t.Fatal(err)
+	} else if info.SymlinkTarget != "symlink/target.txt" {
+		t.Errorf("Wrong symlink target after rename '%s'", info.SymlinkTarget)
+	}
+
+	// Delete removes only the symlink
+	if err = s.Delete("symlink/renamed"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Get("symlink/target.txt"); err != nil {
+		t.Errorf("The target was deleted with the symlink [%s]", err)
+	}
+}
+
+func TestCopy(t *testing.T) {
+	s := storeForTesting()
+
+	if err := s.Put("copy/small.txt", bytes.NewReader([]byte("small"))); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Delete("copy/small.txt")
+	if err := s.SetMetadata("copy/small.txt", map[string]string{MetaMode: "600"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// large object with two segments
+	large := append(bytes.Repeat([]byte("0123456789abcdef"), minSegmentSize/16), []byte("tail")...)
+	seg1, err := s.PutSegment("copy/large.dat/slo/00000000", bytes.NewReader(large[:minSegmentSize]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	seg2, err := s.PutSegment("copy/large.dat/slo/00000001", bytes.NewReader(large[minSegmentSize:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.PutManifest("copy/large.dat", []Segment{seg1, seg2}); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.SetMetadata("copy/large.dat", map[string]string{MetaMode: "640"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for src, content := range map[string][]byte{"copy/small.txt": []byte("small"), "copy/large.dat": large} {
+		dst := src + ".copy"
+		if err = s.Copy(src, dst); err != nil {
+			t.Fatal(err)
+		}
+		defer s.Delete(dst)
+
+		info, err := s.Get(dst)
+		if err != nil {
+			t.Fatal(err)
+		} else if src, _ := s.Get(src); info.Metadata[MetaMode] != src.Metadata[MetaMode] {
+			t.Errorf("Metadata should be copied %v", info.Metadata)
+		}
+
+		r, _, err := s.Download(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		copied, _ := ioutil.ReadAll(r)
+		r.Close()
+		if !bytes.Equal(copied, content) {
+			t.Errorf("Wrong content of '%s' (size=%d)", dst, len(copied))
+		}
+	}
+
+	// The copy doesn't share the segments with the original.
+	if err = s.Delete("copy/large.dat"); err != nil {
+		t.Fatal(err)
+	}
+	r, _, err := s.Download("copy/large.dat.copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	copied, _ := ioutil.ReadAll(r)
+	r.Close()
+	if !bytes.Equal(copied, large) {
+		t.Errorf("Copy is broken by deleting the original (size=%d)", len(copied))
+	}
+}
+
+func TestPutManifestSingleSegment(t *testing.T) {
+	s := storeForTesting()
+	c := defaultConfigForTesting()
+	segs, err := s.ForContainer(c.SegmentContainerName())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name := "single/small.dat"
+	defer s.Delete(name)
+	put := func(exclusive bool, content string) error {
+		seg, err := s.PutSegment(name+"/slo/00000000", bytes.NewReader([]byte(content)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exclusive {
+			err = s.PutManifestExclusive(name, []Segment{seg})
+		} else {
+			err = s.PutManifest(name, []Segment{seg})
+		}
+		s.DeleteSegments([]Segment{seg})
+		return err
+	}
+
+	// The single segment becomes the normal object.
+	if err = put(false, "single"); err != nil {
+		t.Fatal(err)
+	}
+	if segments, err := s.GetSegments(name); err != nil || segments != nil {
+		t.Errorf("The object should not be a large object %v [%v]", segments, err)
+	}
+	if list, err := segs.List(name+"/", "", 0); err != nil || len(list) != 0 {
+		t.Errorf("The segment should be deleted %v [%v]", list, err)
+	}
+
+	r, _, err := s.Download(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := ioutil.ReadAll(r)
+	r.Close()
+	if string(content) != "single" {
+		t.Errorf("Wrong content '%s'", content)
+	}
+
+	// overwrite
+	if err = put(false, "overwritten"); err != nil {
+		t.Fatal(err)
+	}
+	if err = put(true, "exclusive"); err != ErrObjectExists {
+		t.Errorf("Exclusive upload should fail for the existing object [%v]", err)
+	}
+	s.Delete(name)
+	if err = put(true, "exclusive"); err != nil {
+		t.Errorf("Exclusive upload should succeed for the new object [%v]", err)
+	}
+}
+
+func TestOverwriteLargeObject(t *testing.T) {
+	s := storeForTesting()
+	c := defaultConfigForTesting()
+	segs, err := s.ForContainer(c.SegmentContainerName())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	putLarge := func(name, prefix string) []Segment {
+		data := bytes.Repeat([]byte("0123456789abcdef"), minSegmentSize/16)
+		var segments []Segment
+		for i := 0; i < 2; i++ {
+			seg, err := s.PutSegment(fmt.Sprintf("%s/slo/%s/%08d", name, prefix, i), bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			segments = append(segments, seg)
+		}
+		if err := s.PutManifest(name, segments); err != nil {
+			t.Fatal(err)
+		}
+		return segments
+	}
+
+	// segmentsLeft returns the names of the segments under the prefix in the segment container.
+	segmentsLeft := func(prefix string) []string {
+		list, err := segs.List(prefix, "", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, obj := range list {
+			names = append(names, obj.Name)
+		}
+		return names
+	}
+
+	name := "overwrite/large.dat"
+	defer s.Delete(name)
+	putLarge(name, "1")
+
+	// overwritten with the other large object
+	second := putLarge(name, "2")
+	if left := segmentsLeft(name + "/slo/1/"); len(left) != 0 {
+		t.Errorf("Old segments should be deleted %v", left)
+	}
+
+	// appending reuses the segments
+	seg, err := s.PutSegment(name+"/slo/3/00000000", bytes.NewReader([]byte("tail")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.PutManifest(name, append(second, seg)); err != nil {
+		t.Fatal(err)
+	}
+	if left := segmentsLeft(name + "/slo/"); len(left) != 3 {
+		t.Errorf("Reused segments should be kept %v", left)
+	}
+
+	// overwritten with the normal object
+	if err = s.Put(name, bytes.NewReader([]byte("small"))); err != nil {
+		t.Fatal(err)
+	}
+	if left := segmentsLeft(name + "/slo/"); len(left) != 0 {
+		t.Errorf("Old segments should be deleted by Put %v", left)
+	}
+
+	// renamed and copied onto the large object
+	putLarge(name, "4")
+	other := "overwrite/other.dat"
+	putLarge(other, "5")
+	if err = s.Rename(other, name); err != nil {
+		t.Fatal(err)
+	}
+	if left := segmentsLeft(name + "/slo/"); len(left) != 0 {
+		t.Errorf("Old segments should be deleted by Rename %v", left)
+	}
+	if left := segmentsLeft(other + "/slo/"); len(left) != 2 {
+		t.Errorf("Segments of the renamed object should be kept %v", left)
+	}
+
+	if err = s.Put(other, bytes.NewReader([]byte("small"))); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Delete(other)
+	if err = s.Copy(other, name); err != nil {
+		t.Fatal(err)
+	}
+	if left := segmentsLeft(other + "/slo/"); len(left) != 0 {
+		t.Errorf("Old segments should be deleted by Copy %v", left)
+	}
+}
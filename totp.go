@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/hotp"
+	"github.com/pquerna/otp/totp"
+)
+
+// Rules for the users who don't have the TOTP seed
+const (
+	TOTPUnenrolledDeny  = "deny"
+	TOTPUnenrolledAllow = "allow"
+)
+
+const (
+	// Default issuer of the otpauth:// URI
+	DefaultTOTPIssuer = "swift-sftp"
+
+	// Time step of the codes (sec)
+	totpPeriod = 30
+
+	// The codes of the previous and the next time step are accepted for the clock skew.
+	totpSkew = 1
+)
+
+// TOTP is the time-based one-time password (RFC 6238) for the second factor.
+// The seeds of the users are stored in the file in the format of "username:seed" (Base32).
+// The file is read on each authentication like the password file, so enrolling the user doesn't need restarting the server.
+type TOTP struct {
+	path string
+
+	m    sync.Mutex
+	used map[string]uint64 // username -> the last time step used
+}
+
+func NewTOTP(path string) *TOTP {
+	return &TOTP{
+		path: path,
+		used: map[string]uint64{},
+	}
+}
+
+// Load reads the seeds file. It returns the empty map if the file doesn't exist.
+func (t *TOTP) Load() (map[string]string, error) {
+	data, err := ioutil.ReadFile(t.path)
+	if os.IsNotExist(err) {
+		return map[string]string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	seeds := map[string]string{}
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("Invalid line %d in TOTP file '%s'", n, t.path)
+		}
+		if _, err = hotp.GenerateCode(kv[1], 0); err != nil {
+			return nil, fmt.Errorf("Invalid seed of '%s' in TOTP file '%s' [%v]", kv[0], t.path, err)
+		}
+		seeds[kv[0]] = kv[1]
+	}
+	return seeds, s.Err()
+}
+
+// Seed returns the seed of the user. It returns "" if the user is not enrolled.
+func (t *TOTP) Seed(username string) (string, error) {
+	seeds, err := t.Load()
+	if err != nil {
+		return "", err
+	}
+	return seeds[username], nil
+}
+
+// Verify checks the code of the user at the time.
+// The code that has been used once is rejected to prevent the replay.
+func (t *TOTP) Verify(username, seed, code string, now time.Time) bool {
+	opts := hotp.ValidateOpts{Digits: otp.DigitsSix, Algorithm: otp.AlgorithmSHA1}
+	current := uint64(now.Unix()) / totpPeriod
+
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		expected, err := hotp.GenerateCodeCustom(seed, step, opts)
+		if err != nil {
+			return false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) != 1 {
+			continue
+		}
+
+		if last, ok := t.used[username]; ok && step <= last {
+			return false
+		}
+		t.used[username] = step
+		return true
+	}
+	return false
+}
+
+// Enroll generates the new seed of the user and writes it to the file.
+// The seed of the user that has been enrolled is replaced.
+func (t *TOTP) Enroll(username, issuer string) (*otp.Key, error) {
+	if username == "" || strings.ContainsAny(username, ":\r\n") {
+		return nil, fmt.Errorf("Username '%s' is not allowed for TOTP", username)
+	}
+	if issuer == "" {
+		issuer = DefaultTOTPIssuer
+	}
+
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      issuer,
+		AccountName: username,
+		Period:      totpPeriod,
+		Digits:      otp.DigitsSix,
+		Algorithm:   otp.AlgorithmSHA1,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep the other lines including the comments
+	data, err := ioutil.ReadFile(t.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), username+":") || line == "" {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	lines = append(lines, username+":"+key.Secret())
+
+	if err = ioutil.WriteFile(t.path, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// ParseTOTPUnenrolled validates the rule for the users who don't have the seed.
+func ParseTOTPUnenrolled(s string) (string, error) {
+	switch s {
+	case "", TOTPUnenrolledDeny:
+		return TOTPUnenrolledDeny, nil
+	case TOTPUnenrolledAllow:
+		return TOTPUnenrolledAllow, nil
+	}
+	return "", errors.New("TOTP rule for unenrolled users must be 'deny' or 'allow'")
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp/totp"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestTOTPEnroll(t *testing.T) {
+	filename := "./totp_test"
+	if err := ioutil.WriteFile(filename, []byte("# comment\nbob:JBSWY3DPEHPK3PXP\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(filename)
+
+	tp := NewTOTP(filename)
+	key, err := tp.Enroll("alice", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(key.URL(), "otpauth://totp/swift-sftp:alice?") || !strings.Contains(key.URL(), "secret="+key.Secret()) {
+		t.Errorf("Wrong URI '%s'", key.URL())
+	}
+
+	// enroll again
+	if key, err = tp.Enroll("alice", "example"); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadFile(filename)
+	if expected := "# comment\nbob:JBSWY3DPEHPK3PXP\nalice:" + key.Secret() + "\n"; string(data) != expected {
+		t.Errorf("Wrong TOTP file '%s' (expected=%s)", data, expected)
+	}
+
+	for _, username := range []string{"bob", "alice"} {
+		if seed, err := tp.Seed(username); err != nil || seed == "" {
+			t.Errorf("'%s' should be enrolled [%v]", username, err)
+		}
+	}
+	if seed, err := tp.Seed("carol"); err != nil || seed != "" {
+		t.Errorf("'carol' should not be enrolled [%v]", err)
+	}
+
+	if _, err = tp.Enroll("a:b", ""); err == nil {
+		t.Errorf("Username with ':' should be rejected")
+	}
+
+	// broken seed
+	ioutil.WriteFile(filename, []byte("bob:not-base32!\n"), 0600)
+	if _, err = tp.Load(); err == nil {
+		t.Errorf("Broken seed should be rejected")
+	}
+}
+
+func TestTOTPVerify(t *testing.T) {
+	tp := NewTOTP("./totp_test")
+	seed := "JBSWY3DPEHPK3PXP"
+	now := time.Now()
+
+	code, err := totp.GenerateCode(seed, now.Add(-totpPeriod*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tp.Verify("alice", seed, code, now) {
+		t.Errorf("The code of the previous step should be accepted")
+	}
+	if tp.Verify("alice", seed, code, now) {
+		t.Errorf("The code should not be used twice")
+	}
+	if !tp.Verify("bob", seed, code, now) {
+		t.Errorf("The other user should use the code")
+	}
+
+	// The code before the used one is also rejected.
+	old, _ := totp.GenerateCode(seed, now.Add(-2*totpPeriod*time.Second))
+	if tp.Verify("carol", seed, old, now) {
+		t.Errorf("The code out of the skew should be rejected")
+	}
+	code, _ = totp.GenerateCode(seed, now)
+	if !tp.Verify("alice", seed, code, now) {
+		t.Errorf("The code of the current step should be accepted")
+	}
+	if tp.Verify("dave", seed, "abcdef", now) {
+		t.Errorf("Wrong code should be rejected")
+	}
+}
+
+// sshAuthForTesting authenticates the client on the server and returns the permissions of the connection.
+func sshAuthForTesting(t *testing.T, sConf *ssh.ServerConfig, auth ...ssh.AuthMethod) (*ssh.Permissions, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	result := make(chan *ssh.Permissions, 1)
+	go func() {
+		nConn, err := listener.Accept()
+		if err != nil {
+			result <- nil
+			return
+		}
+		defer nConn.Close()
+
+		conn, _, _, err := ssh.NewServerConn(nConn, sConf)
+		if err != nil {
+			result <- nil
+			return
+		}
+		result <- conn.Permissions
+		conn.Close()
+	}()
+
+	client, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+		User:            "alice",
+		Auth:            auth,
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err == nil {
+		client.Close()
+	}
+	return <-result, err
+}
+
+// totpAnswerForTesting answers the keyboard-interactive questions with the code.
+func totpAnswerForTesting(code func() string) ssh.AuthMethod {
+	return ssh.KeyboardInteractive(func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+		answers := make([]string, len(questions))
+		for i := range questions {
+			answers[i] = code()
+		}
+		return answers, nil
+	})
+}
+
+func TestAuthTOTP(t *testing.T) {
+	c := defaultConfigForTesting()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keysFile := "./authorized_keys_totp_test"
+	line := `environment="SWIFT_SFTP_CONTAINER=tenant-a" ` + string(ssh.MarshalAuthorizedKey(signer.PublicKey()))
+	if err = ioutil.WriteFile(keysFile, []byte(line), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(keysFile)
+	c.AuthorizedKeysPath = keysFile
+
+	totpFile := "./totp_test"
+	if err = ioutil.WriteFile(totpFile, []byte{}, 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(totpFile)
+	c.TOTPFilePath = totpFile
+
+	// unenrolled user
+	sConf, err := initServer(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = sshAuthForTesting(t, sConf, ssh.PublicKeys(signer), totpAnswerForTesting(func() string { return "" })); err == nil {
+		t.Errorf("Unenrolled user should be denied")
+	}
+
+	c.TOTPUnenrolled = TOTPUnenrolledAllow
+	if sConf, err = initServer(c); err != nil {
+		t.Fatal(err)
+	}
+	if perms, err := sshAuthForTesting(t, sConf, ssh.PublicKeys(signer), totpAnswerForTesting(func() string { return "" })); err != nil || perms.Extensions[permContainer] != "tenant-a" {
+		t.Errorf("Unenrolled user should be allowed %v [%v]", perms, err)
+	}
+
+	// enrolled user
+	otpKey, err := NewTOTP(totpFile).Enroll("alice", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sConf, err = initServer(c); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = sshAuthForTesting(t, sConf, ssh.PublicKeys(signer), totpAnswerForTesting(func() string { return "000000" })); err == nil {
+		if code, _ := totp.GenerateCode(otpKey.Secret(), time.Now()); code != "000000" {
+			t.Errorf("Wrong code should be rejected")
+		}
+	}
+
+	perms, err := sshAuthForTesting(t, sConf, ssh.PublicKeys(signer), totpAnswerForTesting(func() string {
+		code, _ := totp.GenerateCode(otpKey.Secret(), time.Now())
+		return code
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The permissions of the public key are kept.
+	if perms.Extensions[permContainer] != "tenant-a" {
+		t.Errorf("Wrong container '%s'", perms.Extensions[permContainer])
+	}
+
+	// The public key alone is not enough.
+	if _, err = sshAuthForTesting(t, sConf, ssh.PublicKeys(signer)); err == nil {
+		t.Errorf("Public key without the code should be rejected")
+	}
+}